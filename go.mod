@@ -4,14 +4,19 @@ go 1.22
 
 require (
 	github.com/go-echarts/go-echarts/v2 v2.4.2
+	github.com/klauspost/compress v1.18.0
 	github.com/opencoff/go-logger v0.7.2
 	github.com/opencoff/go-utils v0.9.8
 	github.com/opencoff/pflag v1.0.6-sh1
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.27.0
+	golang.org/x/sys v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/opencoff/go-mmap v0.1.2 // indirect
 	golang.org/x/crypto v0.25.0 // indirect
-	golang.org/x/sys v0.22.0 // indirect
 	golang.org/x/term v0.22.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
@@ -0,0 +1,247 @@
+// hdr.go - mergeable log-linear latency histograms
+//
+// Values are binned into 2^_SubBits linear sub-buckets per power of
+// two (HDR style): values below 2^_SubBits are exact and larger values
+// are within 1/2^(_SubBits+1) (0.4%) of their bucket midpoint. Count,
+// min, max and sum are exact.
+
+// Package hdr implements compact, mergeable latency histograms
+package hdr
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	_SubBits  = 7
+	_SubCount = 1 << _SubBits
+)
+
+// Histogram is a histogram of durations; the zero value is an empty
+// histogram.
+type Histogram struct {
+	n     uint64
+	min   int64
+	max   int64
+	sum   float64
+	sumsq float64
+
+	// counts[i] is the count of bucket base+i
+	base   int
+	counts []uint64
+}
+
+// New returns a new empty histogram
+func New() *Histogram {
+	return &Histogram{}
+}
+
+// Record adds 'd' to the histogram
+func (h *Histogram) Record(d time.Duration) {
+	h.RecordN(d, 1)
+}
+
+// RecordN adds 'n' occurrences of 'd' to the histogram
+func (h *Histogram) RecordN(d time.Duration, n uint64) {
+	if n == 0 {
+		return
+	}
+
+	v := max(int64(d), 0)
+	if h.n == 0 || v < h.min {
+		h.min = v
+	}
+	if h.n == 0 || v > h.max {
+		h.max = v
+	}
+
+	h.n += n
+	h.sum += float64(v) * float64(n)
+	h.sumsq += float64(v) * float64(v) * float64(n)
+	h.add(index(v), n)
+}
+
+// Merge adds the counts in 'o' to 'h'
+func (h *Histogram) Merge(o *Histogram) {
+	if o.n == 0 {
+		return
+	}
+
+	if h.n == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if h.n == 0 || o.max > h.max {
+		h.max = o.max
+	}
+
+	h.n += o.n
+	h.sum += o.sum
+	h.sumsq += o.sumsq
+	for i, c := range o.counts {
+		h.add(o.base+i, c)
+	}
+}
+
+// Reset empties the histogram
+func (h *Histogram) Reset() {
+	*h = Histogram{counts: h.counts[:0]}
+}
+
+func (h *Histogram) Count() uint64      { return h.n }
+func (h *Histogram) Min() time.Duration { return time.Duration(h.min) }
+func (h *Histogram) Max() time.Duration { return time.Duration(h.max) }
+
+func (h *Histogram) Mean() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / float64(h.n))
+}
+
+// Stddev returns the population standard deviation
+func (h *Histogram) Stddev() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+
+	m := h.sum / float64(h.n)
+	v := h.sumsq/float64(h.n) - m*m
+	return time.Duration(math.Sqrt(max(v, 0)))
+}
+
+// Quantile returns the value at quantile 'q' (0 <= q <= 1); the
+// sample at rank (n-1)*q like a sorted list of the raw samples.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+
+	q = min(max(q, 0), 1)
+	rank := uint64(float64(h.n-1) * q)
+
+	var cum uint64
+	for i, c := range h.counts {
+		cum += c
+		if cum > rank {
+			lo, hi := bounds(h.base + i)
+			v := lo + (hi-lo)/2
+			return time.Duration(min(max(v, h.min), h.max))
+		}
+	}
+	return time.Duration(h.max)
+}
+
+// Each calls 'fp' with the lower bound and count of each non-empty
+// bucket in ascending order.
+func (h *Histogram) Each(fp func(lo time.Duration, n uint64)) {
+	for i, c := range h.counts {
+		if c > 0 {
+			lo, _ := bounds(h.base + i)
+			fp(time.Duration(lo), c)
+		}
+	}
+}
+
+// String returns the buckets as space separated "lo:count" pairs; lo
+// is in nanoseconds.
+func (h *Histogram) String() string {
+	var b strings.Builder
+	h.Each(func(lo time.Duration, n uint64) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%d:%d", int64(lo), n)
+	})
+	return b.String()
+}
+
+// Parse makes a histogram from the output of String() and the exact
+// count, min, max, sum and sum of squares.
+func Parse(s string, n uint64, min, max time.Duration, sum, sumsq float64) (*Histogram, error) {
+	h := &Histogram{}
+
+	var tot uint64
+	for _, f := range strings.Fields(s) {
+		a, b, ok := strings.Cut(f, ":")
+		if !ok {
+			return nil, fmt.Errorf("hdr: malformed bucket '%s'", f)
+		}
+
+		lo, err := strconv.ParseInt(a, 10, 64)
+		if err != nil || lo < 0 {
+			return nil, fmt.Errorf("hdr: malformed bucket '%s'", f)
+		}
+		c, err := strconv.ParseUint(b, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("hdr: malformed bucket '%s'", f)
+		}
+
+		h.add(index(lo), c)
+		tot += c
+	}
+
+	if tot != n {
+		return nil, fmt.Errorf("hdr: bucket counts (%d) don't add up to %d", tot, n)
+	}
+
+	h.n = n
+	h.min = int64(min)
+	h.max = int64(max)
+	h.sum = sum
+	h.sumsq = sumsq
+	return h, nil
+}
+
+// Sums returns the exact sum and sum of squares of the samples; these
+// are needed to recreate the histogram via Parse().
+func (h *Histogram) Sums() (float64, float64) {
+	return h.sum, h.sumsq
+}
+
+// add 'n' to bucket 'i'; grow the counts as needed
+func (h *Histogram) add(i int, n uint64) {
+	if len(h.counts) == 0 {
+		h.base = i
+		h.counts = append(h.counts[:0], n)
+		return
+	}
+
+	if i < h.base {
+		c := make([]uint64, h.base-i+len(h.counts))
+		copy(c[h.base-i:], h.counts)
+		h.counts = c
+		h.base = i
+	}
+
+	for i-h.base >= len(h.counts) {
+		h.counts = append(h.counts, 0)
+	}
+	h.counts[i-h.base] += n
+}
+
+// return the bucket for 'v'
+func index(v int64) int {
+	if v < _SubCount {
+		return int(v)
+	}
+
+	shift := bits.Len64(uint64(v)) - 1 - _SubBits
+	top := int(v >> shift)
+	return (shift+1)*_SubCount + top - _SubCount
+}
+
+// return the smallest and largest values in bucket 'i'
+func bounds(i int) (int64, int64) {
+	if i < _SubCount {
+		return int64(i), int64(i)
+	}
+
+	shift := i/_SubCount - 1
+	top := int64(i%_SubCount + _SubCount)
+	return top << shift, (top+1)<<shift - 1
+}
@@ -0,0 +1,190 @@
+package hdr
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestIndexBounds(t *testing.T) {
+	tests := []struct {
+		v      int64
+		lo, hi int64
+	}{
+		{0, 0, 0},
+		{1, 1, 1},
+		{_SubCount - 1, _SubCount - 1, _SubCount - 1},
+		{_SubCount, _SubCount, _SubCount},
+		{2*_SubCount - 1, 2*_SubCount - 1, 2*_SubCount - 1},
+		{2 * _SubCount, 2 * _SubCount, 2*_SubCount + 1},
+		{2*_SubCount + 1, 2 * _SubCount, 2*_SubCount + 1},
+		{1000, 1000, 1003},
+		{int64(time.Millisecond), 999424, 1003519},
+		{int64(time.Second), 998244352, 1002438655},
+		{math.MaxInt64, math.MaxInt64 - 1<<(62-_SubBits) + 1, math.MaxInt64},
+	}
+
+	for _, tc := range tests {
+		i := index(tc.v)
+		lo, hi := bounds(i)
+		if lo != tc.lo || hi != tc.hi {
+			t.Fatalf("%d: exp bucket [%d, %d], saw [%d, %d]", tc.v, tc.lo, tc.hi, lo, hi)
+		}
+
+		// the bounds are in the same bucket and next to the
+		// buckets on either side
+		if index(lo) != i || index(hi) != i {
+			t.Fatalf("%d: bounds [%d, %d] not in bucket %d", tc.v, lo, hi, i)
+		}
+		if i > 0 {
+			if _, h := bounds(i - 1); h != lo-1 {
+				t.Fatalf("%d: bucket %d ends at %d; exp %d", tc.v, i-1, h, lo-1)
+			}
+		}
+
+		// within 1/2^(_SubBits+1) of the midpoint
+		if mid := lo + (hi-lo)/2; math.Abs(float64(tc.v-mid)) > float64(tc.v)/(1<<(_SubBits+1)) {
+			t.Fatalf("%d: midpoint %d is too far", tc.v, mid)
+		}
+	}
+}
+
+// return a histogram of 'v'
+func hist(v ...time.Duration) *Histogram {
+	h := New()
+	for _, x := range v {
+		h.Record(x)
+	}
+	return h
+}
+
+func TestMerge(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name string
+		a, b []time.Duration
+	}{
+		{"empty", nil, nil},
+		{"into empty", nil, []time.Duration{3 * ms, ms}},
+		{"from empty", []time.Duration{3 * ms, ms}, nil},
+		{"overlap", []time.Duration{ms, 2 * ms}, []time.Duration{2 * ms, 3 * ms}},
+		{"below", []time.Duration{time.Second}, []time.Duration{10, 20, ms}},
+		{"above", []time.Duration{10, 20}, []time.Duration{time.Second, time.Minute}},
+	}
+
+	for _, tc := range tests {
+		h := hist(tc.a...)
+		h.Merge(hist(tc.b...))
+		exp := hist(append(append([]time.Duration(nil), tc.a...), tc.b...)...)
+
+		switch {
+		case h.Count() != exp.Count(), h.Min() != exp.Min(), h.Max() != exp.Max():
+			t.Fatalf("%s: exp n=%d [%s, %s], saw n=%d [%s, %s]", tc.name,
+				exp.Count(), exp.Min(), exp.Max(), h.Count(), h.Min(), h.Max())
+		case h.Mean() != exp.Mean():
+			t.Fatalf("%s: exp mean %s, saw %s", tc.name, exp.Mean(), h.Mean())
+		case h.String() != exp.String():
+			t.Fatalf("%s: exp buckets '%s', saw '%s'", tc.name, exp, h)
+		}
+	}
+}
+
+// return the midpoint of the bucket of 'd'
+func mid(d time.Duration) time.Duration {
+	lo, hi := bounds(index(int64(d)))
+	return time.Duration(lo + (hi-lo)/2)
+}
+
+func TestQuantile(t *testing.T) {
+	ms := time.Millisecond
+	h := hist(ms, 2*ms, 3*ms, 4*ms, 100*ms)
+
+	tests := []struct {
+		q   float64
+		exp time.Duration
+	}{
+		// the midpoint of the bucket; q is clamped to [0, 1]
+		{-1, mid(ms)},
+		{0, mid(ms)},
+		{0.25, mid(2 * ms)},
+		{0.5, mid(3 * ms)},
+		{0.75, mid(4 * ms)},
+		{1, mid(100 * ms)},
+		{2, mid(100 * ms)},
+	}
+
+	for _, tc := range tests {
+		if v := h.Quantile(tc.q); v != tc.exp {
+			t.Fatalf("q %v: exp %s, saw %s", tc.q, tc.exp, v)
+		}
+	}
+
+	// the midpoint of a bucket is clamped to the min and max; 1000
+	// and 1003 are in the bucket [1000, 1003]
+	clamp := []struct {
+		v   []time.Duration
+		exp time.Duration
+	}{
+		{[]time.Duration{1000}, 1000},
+		{[]time.Duration{1003}, 1003},
+		{[]time.Duration{1000, 1003}, 1001},
+	}
+	for _, tc := range clamp {
+		if v := hist(tc.v...).Quantile(0.5); v != tc.exp {
+			t.Fatalf("%v: exp %d, saw %d", tc.v, tc.exp, v)
+		}
+	}
+
+	if v := New().Quantile(0.5); v != 0 {
+		t.Fatalf("empty: exp 0, saw %s", v)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		v    []time.Duration
+	}{
+		{"empty", nil},
+		{"exact", []time.Duration{0, 1, 1, 127}},
+		{"spread", []time.Duration{time.Microsecond, time.Millisecond, time.Second, time.Minute}},
+		{"same", []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}},
+	}
+
+	for _, tc := range tests {
+		h := hist(tc.v...)
+		sum, sumsq := h.Sums()
+		p, err := Parse(h.String(), h.Count(), h.Min(), h.Max(), sum, sumsq)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+
+		switch {
+		case p.String() != h.String():
+			t.Fatalf("%s: exp '%s', saw '%s'", tc.name, h, p)
+		case p.Count() != h.Count(), p.Min() != h.Min(), p.Max() != h.Max():
+			t.Fatalf("%s: exp n=%d [%s, %s], saw n=%d [%s, %s]", tc.name,
+				h.Count(), h.Min(), h.Max(), p.Count(), p.Min(), p.Max())
+		case p.Mean() != h.Mean(), p.Stddev() != h.Stddev():
+			t.Fatalf("%s: exp mean %s sd %s, saw %s %s", tc.name, h.Mean(), h.Stddev(), p.Mean(), p.Stddev())
+		case p.Quantile(0.5) != h.Quantile(0.5):
+			t.Fatalf("%s: exp p50 %s, saw %s", tc.name, h.Quantile(0.5), p.Quantile(0.5))
+		}
+	}
+
+	bad := []struct {
+		s string
+		n uint64
+	}{
+		{"1000", 1},
+		{"x:1", 1},
+		{"-5:1", 1},
+		{"1000:y", 1},
+		{"1000:1 2000:1", 3},
+	}
+	for _, tc := range bad {
+		if _, err := Parse(tc.s, tc.n, 0, 0, 0, 0); err == nil {
+			t.Fatalf("'%s' (n=%d): exp an error", tc.s, tc.n)
+		}
+	}
+}
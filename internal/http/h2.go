@@ -0,0 +1,272 @@
+// h2.go - minimal HTTP/2 client to aid in timing measurements
+//
+// This is just enough of HTTP/2 to send a handful of concurrent
+// requests on a connection and time the responses: connection
+// preface, SETTINGS exchange, per-stream headers and flow control.
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// H2Conn is a HTTP/2 connection
+type H2Conn struct {
+	*TlsConn
+
+	// time from sending the connection preface till the server's
+	// SETTINGS arrive
+	Settings time.Duration
+
+	timeout time.Duration
+	fr      *http2.Framer
+	hbuf    bytes.Buffer
+	henc    *hpack.Encoder
+	nextID  uint32
+
+	// set once the server sends GOAWAY
+	goaway bool
+}
+
+// H2Stream is the outcome of a request on a H2Conn
+type H2Stream struct {
+	Req *Request
+
+	ID         uint32
+	StatusCode int
+	Headers    Header
+	BodyLen    int
+
+	// time from sending the request to the response headers and
+	// to the end of the stream
+	Ttfb time.Duration
+	Done time.Duration
+
+	// set if the server reset the stream
+	Err error
+
+	sent time.Time
+	done bool
+}
+
+// DialH2 makes a TLS connection to 'host' on 'port', negotiates h2
+// via ALPN and completes the HTTP/2 connection preface.
+func (c *Client) DialH2(ctx context.Context, host string, port int) (*H2Conn, error) {
+	tc, err := c.dialTLS(ctx, host, port, nil, []string{http2.NextProtoTLS})
+	if err != nil {
+		return nil, err
+	}
+
+	if p := tc.ConnectionState().NegotiatedProtocol; p != http2.NextProtoTLS {
+		tc.Close()
+		return nil, fmt.Errorf("http: h2 %s: server negotiated '%s'", tc.Tcp.Addr, p)
+	}
+
+	h := &H2Conn{
+		TlsConn: tc,
+		timeout: c.Timeout,
+		fr:      http2.NewFramer(tc, tc),
+		nextID:  1,
+	}
+	h.henc = hpack.NewEncoder(&h.hbuf)
+	h.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+
+	if err = h.preface(); err != nil {
+		tc.Close()
+		return nil, fmt.Errorf("http: h2 %s: %w", tc.Tcp.Addr, err)
+	}
+	return h, nil
+}
+
+// send the client preface and wait for the server SETTINGS
+func (h *H2Conn) preface() error {
+	h.SetDeadline(time.Now().Add(h.timeout))
+
+	st := time.Now()
+	if _, err := h.Write([]byte(http2.ClientPreface)); err != nil {
+		return err
+	}
+
+	if err := h.fr.WriteSettings(http2.Setting{ID: http2.SettingEnablePush, Val: 0}); err != nil {
+		return err
+	}
+
+	// The server's first frame must be SETTINGS
+	f, err := h.fr.ReadFrame()
+	if err != nil {
+		return err
+	}
+
+	sf, ok := f.(*http2.SettingsFrame)
+	if !ok || sf.IsAck() {
+		return fmt.Errorf("expected SETTINGS, saw %s", f.Header().Type)
+	}
+	h.Settings = time.Now().Sub(st)
+
+	return h.fr.WriteSettingsAck()
+}
+
+// Do sends all the requests concurrently on the connection and
+// waits for all of them to complete. The response bodies are
+// discarded.
+func (h *H2Conn) Do(reqs []*Request) ([]H2Stream, error) {
+	if h.goaway {
+		return nil, ErrGoaway
+	}
+
+	h.SetDeadline(time.Now().Add(h.timeout))
+
+	streams := make([]H2Stream, len(reqs))
+	byid := make(map[uint32]*H2Stream, len(reqs))
+	for i, r := range reqs {
+		s := &streams[i]
+		s.Req = r
+		s.ID = h.nextID
+		h.nextID += 2
+
+		hdr, err := h.encode(r)
+		if err != nil {
+			return nil, err
+		}
+
+		s.sent = time.Now()
+		err = h.fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      s.ID,
+			BlockFragment: hdr,
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("http: h2 %s: write: %w", h.Tcp.Addr, err)
+		}
+		byid[s.ID] = s
+	}
+
+	for pending := len(streams); pending > 0; {
+		f, err := h.fr.ReadFrame()
+		if err != nil {
+			return nil, fmt.Errorf("http: h2 %s: read: %w", h.Tcp.Addr, err)
+		}
+
+		now := time.Now()
+		s := byid[f.Header().StreamID]
+
+		switch f := f.(type) {
+		case *http2.MetaHeadersFrame:
+			if s == nil {
+				break
+			}
+			if s.Ttfb == 0 {
+				s.Ttfb = now.Sub(s.sent)
+				s.Headers = make(Header)
+				for _, hf := range f.RegularFields() {
+					s.Headers.Add(hf.Name, hf.Value)
+				}
+				s.StatusCode, _ = strconv.Atoi(f.PseudoValue("status"))
+			}
+
+		case *http2.DataFrame:
+			n := len(f.Data())
+			if s != nil {
+				s.BodyLen += n
+			}
+
+			// return the flow control credits for the connection
+			// and the stream
+			if n > 0 {
+				if err = h.fr.WriteWindowUpdate(0, uint32(n)); err != nil {
+					return nil, err
+				}
+				if s != nil && !f.StreamEnded() {
+					if err = h.fr.WriteWindowUpdate(s.ID, uint32(n)); err != nil {
+						return nil, err
+					}
+				}
+			}
+
+		case *http2.RSTStreamFrame:
+			if s != nil {
+				s.Err = fmt.Errorf("http: h2 stream %d: reset: %s", s.ID, f.ErrCode)
+			}
+
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err = h.fr.WriteSettingsAck(); err != nil {
+					return nil, err
+				}
+			}
+
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				if err = h.fr.WritePing(true, f.Data); err != nil {
+					return nil, err
+				}
+			}
+
+		case *http2.GoAwayFrame:
+			h.goaway = true
+			for _, s := range byid {
+				if !s.done && s.ID > f.LastStreamID {
+					return nil, ErrGoaway
+				}
+			}
+		}
+
+		if s != nil && !s.done && (s.Err != nil || f.Header().Flags.Has(http2.FlagDataEndStream)) {
+			s.done = true
+			s.Done = now.Sub(s.sent)
+			pending--
+		}
+	}
+	return streams, nil
+}
+
+// encode the request headers
+func (h *H2Conn) encode(r *Request) ([]byte, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return nil, fmt.Errorf("http: url %s: %w", r.URL, err)
+	}
+
+	h.hbuf.Reset()
+	e := h.henc
+	e.WriteField(hpack.HeaderField{Name: ":method", Value: r.Method})
+	e.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	e.WriteField(hpack.HeaderField{Name: ":authority", Value: u.Host})
+	e.WriteField(hpack.HeaderField{Name: ":path", Value: u.RequestURI()})
+
+	for k, vv := range r.Headers {
+		k = strings.ToLower(k)
+		if h2skip[k] {
+			continue
+		}
+		for _, v := range vv {
+			e.WriteField(hpack.HeaderField{Name: k, Value: v})
+		}
+	}
+
+	// the framer doesn't retain the block; so no copy needed
+	return h.hbuf.Bytes(), nil
+}
+
+// connection specific headers are not allowed in HTTP/2 (RFC 9113, 8.2.2)
+var h2skip = map[string]bool{
+	"host":              true,
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
+var ErrGoaway = errors.New("http: h2 connection going away")
@@ -91,6 +91,10 @@ type Response struct {
 type Client struct {
 	Timeout time.Duration
 
+	// optional base TLS config; ServerName (if empty) and
+	// NextProtos are filled in per connection.
+	TLS *tls.Config
+
 	resolv net.Resolver
 }
 
@@ -134,55 +138,34 @@ func (c *Client) Do(req *Request, ctx context.Context) (*Response, error) {
 
 	req.Host = host
 
-	var dns, tcp, ttls, http time.Duration
-
-	// see if "host" is an IP address or name
-	ip := net.ParseIP(host)
-	if ip == nil {
-		st := time.Now()
-		ip, err = c.resolve(host, ctx)
-		if err != nil {
-			return nil, fmt.Errorf("http: dns: %s: %w", host, err)
-		}
-		dns = time.Now().Sub(st)
-	}
-
-	taddr := &net.TCPAddr{
-		IP:   ip,
-		Port: port,
-	}
-
+	var ttls, http time.Duration
 	var conn net.Conn
 	var tconn *tls.Conn
-	st := time.Now()
-	conn, err = net.DialTCP("tcp", nil, taddr)
-	if err != nil {
-		return nil, fmt.Errorf("http: dial %s (%s): %w", host, taddr, err)
-	}
-	tcp = time.Now().Sub(st)
+	var cn *Conn
 
 	if u.Scheme == "https" {
-		st := time.Now()
-		// now setup TLS
-		tcfg := &tls.Config{
-			ServerName: host,
+		tc, err := c.DialTLS(ctx, host, port, nil)
+		if err != nil {
+			return nil, err
 		}
-
-		tconn := tls.Client(conn, tcfg)
-
-		c.setDeadline(tconn)
-		if err = tconn.Handshake(); err != nil {
-			return nil, fmt.Errorf("http: tls %s: %w", taddr, err)
+		cn = &tc.Tcp
+		conn = tc.Conn
+		tconn = tc.Conn
+		ttls = tc.Tls
+	} else {
+		cn, err = c.Dial(ctx, host, port)
+		if err != nil {
+			return nil, err
 		}
-		conn = tconn
-		ttls = time.Now().Sub(st)
+		conn = cn
 	}
 
 	// Build the HTTP request manually
 	c.setWriteDeadline(conn)
-	st = time.Now()
+	st := time.Now()
 	err = req.write(conn, u.RequestURI())
 	if err != nil {
+		conn.Close()
 		return nil, fmt.Errorf("http: write %s: %w", host, err)
 	}
 
@@ -196,18 +179,145 @@ func (c *Client) Do(req *Request, ctx context.Context) (*Response, error) {
 	c.setReadDeadline(conn)
 	rx := newConnCloser(conn)
 	if err = resp.read(rx); err != nil {
+		conn.Close()
 		return nil, err
 	}
 	http = time.Now().Sub(st)
 
-	resp.Dns = dns
-	resp.Tcp = tcp
+	resp.Dns = cn.Dns
+	resp.Tcp = cn.Tcp
 	resp.Tls = ttls
 	resp.Http = http
 	resp.E2e = time.Now().Sub(start)
 	return resp, nil
 }
 
+// Conn is an established connection along with the time taken
+// to resolve the name and complete the TCP handshake.
+type Conn struct {
+	net.Conn
+
+	Addr net.Addr
+
+	Dns time.Duration
+	Tcp time.Duration
+}
+
+// Dial resolves 'host' (if needed) and makes a TCP connection to
+// it on 'port'. The returned Conn records the dns and tcp timings.
+func (c *Client) Dial(ctx context.Context, host string, port int) (*Conn, error) {
+	return c.dial(ctx, "tcp", host, port)
+}
+
+// DialUDP resolves 'host' (if needed) and returns a connected UDP
+// socket to it on 'port'. Only the dns timing is meaningful.
+func (c *Client) DialUDP(ctx context.Context, host string, port int) (*Conn, error) {
+	return c.dial(ctx, "udp", host, port)
+}
+
+func (c *Client) dial(ctx context.Context, network, host string, port int) (*Conn, error) {
+	var dns time.Duration
+	var err error
+
+	// see if "host" is an IP address or name
+	ip := net.ParseIP(host)
+	if ip == nil {
+		st := time.Now()
+		ip, err = c.resolve(host, ctx)
+		if err != nil {
+			return nil, fmt.Errorf("http: dns: %s: %w", host, err)
+		}
+		dns = time.Now().Sub(st)
+	}
+
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+	d := net.Dialer{
+		Timeout: c.Timeout,
+	}
+
+	st := time.Now()
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("http: dial %s (%s): %w", host, addr, err)
+	}
+
+	cn := &Conn{
+		Conn: conn,
+		Addr: conn.RemoteAddr(),
+		Dns:  dns,
+		Tcp:  time.Now().Sub(st),
+	}
+	return cn, nil
+}
+
+// Upgrader negotiates a protocol specific switch to TLS (eg STARTTLS)
+// on a freshly connected socket.
+type Upgrader func(conn net.Conn) error
+
+// TlsConn is an established TLS connection along with the time taken
+// for each step of setting it up.
+type TlsConn struct {
+	*tls.Conn
+
+	// the underlying tcp connection
+	Tcp Conn
+
+	StartTls time.Duration
+	Tls      time.Duration
+}
+
+// DialTLS connects to 'host' on 'port' and completes a TLS handshake.
+// If 'up' is not nil, it is called to negotiate the upgrade to TLS
+// before the handshake.
+func (c *Client) DialTLS(ctx context.Context, host string, port int, up Upgrader) (*TlsConn, error) {
+	return c.dialTLS(ctx, host, port, up, nil)
+}
+
+func (c *Client) dialTLS(ctx context.Context, host string, port int, up Upgrader, alpn []string) (*TlsConn, error) {
+	cn, err := c.Dial(ctx, host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var stls time.Duration
+
+	c.setDeadline(cn)
+	if up != nil {
+		st := time.Now()
+		if err = up(cn); err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("http: starttls %s: %w", cn.Addr, err)
+		}
+		stls = time.Now().Sub(st)
+	}
+
+	st := time.Now()
+	tcfg := &tls.Config{}
+	if c.TLS != nil {
+		tcfg = c.TLS.Clone()
+	}
+	if len(tcfg.ServerName) == 0 {
+		tcfg.ServerName = host
+	}
+	tcfg.NextProtos = alpn
+
+	tconn := tls.Client(cn, tcfg)
+
+	c.setDeadline(tconn)
+	if err = tconn.Handshake(); err != nil {
+		cn.Close()
+		return nil, fmt.Errorf("http: tls %s: %w", cn.Addr, err)
+	}
+
+	tc := &TlsConn{
+		Conn:     tconn,
+		Tcp:      *cn,
+		StartTls: stls,
+		Tls:      time.Now().Sub(st),
+	}
+	return tc, nil
+}
+
 func (c *Client) setDeadline(conn net.Conn) {
 	dl := time.Now().Add(c.Timeout)
 	conn.SetDeadline(dl)
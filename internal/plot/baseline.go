@@ -0,0 +1,239 @@
+// baseline.go - compare the columns against a baseline period (eg
+// the same hours a day or a week earlier)
+
+package plot
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// a regression is significant at this (one sided) p-value ...
+	_DeltaP = 0.01
+
+	// ... and if the median is up by at least this much; with a day
+	// of samples the tiniest difference is significant
+	_DeltaMin = 0.05
+)
+
+// Baseline is the comparison of the columns with a baseline period
+type Baseline struct {
+	// what the baseline is (eg "1d earlier")
+	Label string
+
+	// each phase over the whole period and the headline phase per
+	// hour
+	Phases   []Delta
+	Headline string
+	Hours    []Delta
+}
+
+// Delta compares the samples of a phase (or an hour) with the
+// baseline
+type Delta struct {
+	Name string
+	Cur  Stats
+	Base Stats
+
+	// the hour compared (zero for a whole phase)
+	Hour time.Time
+
+	// one sided p-value of the current samples being slower than the
+	// baseline (Mann-Whitney U test)
+	P         float64
+	Regressed bool
+}
+
+// NewDelta compares the samples in 'cur' with those in 'base'
+func NewDelta(nm string, cur, base []time.Duration) Delta {
+	d := Delta{
+		Name: nm,
+		Cur:  Summarize(nm, cur),
+		Base: Summarize(nm, base),
+		P:    mannWhitney(cur, base),
+	}
+	d.Regressed = d.P < _DeltaP && d.Cur.N > 0 && d.Base.N > 0 &&
+		float64(d.Cur.P50) >= float64(d.Base.P50)*(1+_DeltaMin)
+	return d
+}
+
+// NewBaseline compares the columns in 'cur' with those in 'base'. The
+// times of 'base' must be moved forward to line up with 'cur'; each
+// hour of the headline column of 'cur' is compared with the same hour
+// of 'base'.
+func NewBaseline(label string, cur, base *Columns) *Baseline {
+	b := &Baseline{Label: label}
+	for _, nm := range cur.Names {
+		if IsMeta(nm) {
+			continue
+		}
+		if x := base.Column(nm); len(x) > 0 {
+			b.Phases = append(b.Phases, NewDelta(nm, cur.Column(nm), x))
+		}
+	}
+
+	nm := cur.Headline()
+	b.Headline = nm
+	if len(cur.Times) < cur.Minlen || len(base.Times) < base.Minlen || base.Column(nm) == nil {
+		return b
+	}
+
+	hours := func(o *Columns) map[time.Time][]time.Duration {
+		m := make(map[time.Time][]time.Duration)
+		for i, x := range o.Column(nm) {
+			h := o.Times[i].UTC().Truncate(time.Hour)
+			m[h] = append(m[h], x)
+		}
+		return m
+	}
+
+	ch, bh := hours(cur), hours(base)
+	var keys []time.Time
+	for h := range ch {
+		if _, ok := bh[h]; ok {
+			keys = append(keys, h)
+		}
+	}
+	slices.SortFunc(keys, func(a, b time.Time) int { return a.Compare(b) })
+
+	for _, h := range keys {
+		d := NewDelta(nm, ch[h], bh[h])
+		d.Hour = h
+		b.Hours = append(b.Hours, d)
+	}
+	return b
+}
+
+// Regressions returns the phases that are significantly slower than
+// the baseline
+func (b *Baseline) Regressions() []Delta {
+	var v []Delta
+	for _, d := range b.Phases {
+		if d.Regressed {
+			v = append(v, d)
+		}
+	}
+	return v
+}
+
+// the one sided p-value of the samples in 'a' being larger than those
+// in 'b': the normal approximation of the Mann-Whitney U test with a
+// correction for ties. Returns 1 if either is empty.
+func mannWhitney(a, b []time.Duration) float64 {
+	n1, n2 := float64(len(a)), float64(len(b))
+	if n1 == 0 || n2 == 0 {
+		return 1
+	}
+
+	type obs struct {
+		x    time.Duration
+		mine bool
+	}
+	v := make([]obs, 0, len(a)+len(b))
+	for _, x := range a {
+		v = append(v, obs{x, true})
+	}
+	for _, x := range b {
+		v = append(v, obs{x, false})
+	}
+	slices.SortFunc(v, func(p, q obs) int {
+		return cmp.Compare(p.x, q.x)
+	})
+
+	// sum of the ranks of 'a'; ties get their mean rank
+	var r1, ties float64
+	for i := 0; i < len(v); {
+		j := i + 1
+		for j < len(v) && v[j].x == v[i].x {
+			j++
+		}
+
+		rank := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			if v[k].mine {
+				r1 += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	n := n1 + n2
+	u := r1 - n1*(n1+1)/2
+	sd := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sd == 0 {
+		return 1
+	}
+
+	z := (u - n1*n2/2 - 0.5) / sd
+	return 0.5 * math.Erfc(z/math.Sqrt2)
+}
+
+// Table returns the comparison as html tables: the phases and the
+// hours of the headline phase. Regressions are in red.
+func (b *Baseline) Table() string {
+	var s strings.Builder
+	deltaTable(&s, fmt.Sprintf("Compared with %s (ms)", b.Label), "phase", b.Phases)
+	if len(b.Hours) > 0 {
+		deltaTable(&s, fmt.Sprintf("%s per hour compared with %s (ms)",
+			strings.ToTitle(b.Headline), b.Label), "hour", b.Hours)
+	}
+	return s.String()
+}
+
+func deltaTable(s *strings.Builder, caption, first string, v []Delta) {
+	if len(v) == 0 {
+		return
+	}
+
+	s.WriteString(`<table style="margin: 20px auto; border-collapse: collapse; font-family: sans-serif; text-align: right">`)
+	fmt.Fprintf(s, "\n<caption>%s</caption>\n", html.EscapeString(caption))
+	fmt.Fprintf(s, `<tr><th style="text-align: left">%s</th>`, first)
+	for _, h := range []string{"count", "p50", "p90", "p99", "mean", "p-value", ""} {
+		fmt.Fprintf(s, `<th style="padding: 4px 12px">%s</th>`, h)
+	}
+	s.WriteString("</tr>\n")
+
+	td := func(x, title string) {
+		fmt.Fprintf(s, `<td style="padding: 4px 12px" title="%s">%s</td>`, title, x)
+	}
+
+	// the current value and its change; the baseline is in the tooltip
+	cell := func(cur, base time.Duration) {
+		if base == 0 {
+			td(fmt.Sprintf("%.3f", millis(cur)), "")
+			return
+		}
+		pct := 100 * (float64(cur) - float64(base)) / float64(base)
+		td(fmt.Sprintf("%.3f <small>(%+.1f%%)</small>", millis(cur), pct), fmt.Sprintf("baseline %.3f", millis(base)))
+	}
+
+	for _, d := range v {
+		style, flag := "", ""
+		if d.Regressed {
+			style, flag = ` style="color: #c00"`, "regressed"
+		}
+
+		nm := d.Name
+		if !d.Hour.IsZero() {
+			nm = d.Hour.Local().Format("01-02 15:04")
+		}
+		fmt.Fprintf(s, `<tr%s><th style="text-align: left">%s</th>`, style, html.EscapeString(nm))
+		td(fmt.Sprintf("%d", d.Cur.N), fmt.Sprintf("baseline %d", d.Base.N))
+		cell(d.Cur.P50, d.Base.P50)
+		cell(d.Cur.P90, d.Base.P90)
+		cell(d.Cur.P99, d.Base.P99)
+		cell(d.Cur.Mean, d.Base.Mean)
+		td(fmt.Sprintf("%.3g", d.P), "")
+		td(flag, "")
+		s.WriteString("</tr>\n")
+	}
+	s.WriteString("</table>\n")
+}
@@ -0,0 +1,172 @@
+// compare.go - compare a column across targets
+
+package plot
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+)
+
+// Column returns the values of column 'nm' in 'o' (nil if it has none)
+func (o *Columns) Column(nm string) []time.Duration {
+	if i := slices.Index(o.Names, nm); i >= 0 {
+		return o.Colref[i][:o.Minlen]
+	}
+	return nil
+}
+
+// CompareStats returns the stats of column 'col' of each of 'v'; each
+// is named after its target.
+func CompareStats(col string, v []*Columns) []Stats {
+	st := make([]Stats, len(v))
+	for i, o := range v {
+		st[i] = Summarize(o.Name, o.Column(col))
+		st[i].Failures = o.counter("errors")
+	}
+	return st
+}
+
+// Compare renders a comparison of column 'col' across the targets in
+// 'v' to 'fn': the samples of every target on a shared time axis, the
+// CDF of each target and a table of their percentiles. Each of 'v'
+// must have Times.
+func Compare(title, col string, v []*Columns, fn string) error {
+	page := components.NewPage()
+	page.PageTitle = title
+	page.AddCharts(newOverlay(title, col, v), newCDF(title, col, v))
+
+	var b bytes.Buffer
+	if err := page.Render(&b); err != nil {
+		return err
+	}
+
+	// the table goes below the charts
+	sparks := make([]string, len(v))
+	for i, o := range v {
+		sparks[i] = Sparkline(o.Column(col), SparkW, SparkH)
+	}
+
+	s := beforeEnd(b.String(), pctTable(col, CompareStats(col, v), sparks))
+	return os.WriteFile(fn, []byte(s), 0600)
+}
+
+// the samples of column 'col' of each target on a time axis
+func newOverlay(title, col string, v []*Columns) *charts.Line {
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    title,
+			Subtitle: fmt.Sprintf("%s latency (ms)", strings.ToTitle(col)),
+		}),
+		charts.WithLegendOpts(opts.Legend{Show: opts.Bool(true), Top: "bottom"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true), Trigger: "axis"}),
+		charts.WithXAxisOpts(opts.XAxis{Type: "time"}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "ms"}),
+		charts.WithDataZoomOpts(opts.DataZoom{Type: "slider", Start: 0, End: 100}),
+	)
+
+	for _, o := range v {
+		c := o.Column(col)
+		d := make([]opts.LineData, len(c))
+		for i, x := range c {
+			d[i].Value = []any{o.Times[i].UnixMilli(), millis(x)}
+		}
+		line.AddSeries(o.Name, d)
+	}
+
+	line.SetSeriesOptions(charts.WithLineChartOpts(opts.LineChart{ShowSymbol: opts.Bool(false)}))
+	return line
+}
+
+// percentiles plotted in the CDF; finer in the tail
+var cdfPct = func() []float64 {
+	var v []float64
+	for p := 0.0; p < 99; p++ {
+		v = append(v, p)
+	}
+	for p := 990; p <= 1000; p++ {
+		v = append(v, float64(p)/10)
+	}
+	return v
+}()
+
+// the CDF of column 'col' of each target
+func newCDF(title, col string, v []*Columns) *charts.Line {
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    fmt.Sprintf("%s: CDF", title),
+			Subtitle: fmt.Sprintf("Percentile of %s latency (ms)", strings.ToTitle(col)),
+		}),
+		charts.WithLegendOpts(opts.Legend{Show: opts.Bool(true), Top: "bottom"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true), Trigger: "item"}),
+		charts.WithXAxisOpts(opts.XAxis{Type: "value", Name: "ms", Scale: opts.Bool(true)}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "percentile", Max: 100}),
+	)
+
+	for _, o := range v {
+		if d := cdfData(o.Column(col)); len(d) > 0 {
+			line.AddSeries(o.Name, d)
+		}
+	}
+
+	line.SetSeriesOptions(charts.WithLineChartOpts(opts.LineChart{ShowSymbol: opts.Bool(false)}))
+	return line
+}
+
+// a html table with a column of percentiles and a sparkline per target
+func pctTable(col string, st []Stats, sparks []string) string {
+	var b strings.Builder
+
+	b.WriteString(`<table style="margin: 20px auto; border-collapse: collapse; font-family: sans-serif; text-align: right">`)
+	fmt.Fprintf(&b, "\n<caption>%s latency (ms)</caption>\n<tr><th></th>", html.EscapeString(strings.ToTitle(col)))
+	for i := range st {
+		fmt.Fprintf(&b, `<th style="padding: 4px 12px">%s</th>`, html.EscapeString(st[i].Name))
+	}
+	b.WriteString("</tr>\n")
+
+	row := func(nm string, f func(s *Stats) string) {
+		fmt.Fprintf(&b, `<tr><th style="text-align: left">%s</th>`, nm)
+		for i := range st {
+			fmt.Fprintf(&b, `<td style="padding: 4px 12px">%s</td>`, f(&st[i]))
+		}
+		b.WriteString("</tr>\n")
+	}
+
+	dur := func(fp func(s *Stats) time.Duration) func(s *Stats) string {
+		return func(s *Stats) string {
+			return fmt.Sprintf("%.3f", millis(fp(s)))
+		}
+	}
+
+	row("count", func(s *Stats) string { return fmt.Sprintf("%d", s.N) })
+	row("failures", func(s *Stats) string { return fmt.Sprintf("%d", s.Failures) })
+	row("min", dur(func(s *Stats) time.Duration { return s.Min }))
+	row("mean", dur(func(s *Stats) time.Duration { return s.Mean }))
+	row("p50", dur(func(s *Stats) time.Duration { return s.P50 }))
+	row("p90", dur(func(s *Stats) time.Duration { return s.P90 }))
+	row("p95", dur(func(s *Stats) time.Duration { return s.P95 }))
+	row("p99", dur(func(s *Stats) time.Duration { return s.P99 }))
+	row("p99.9", dur(func(s *Stats) time.Duration { return s.P999 }))
+	row("max", dur(func(s *Stats) time.Duration { return s.Max }))
+
+	b.WriteString(`<tr><th style="text-align: left">trend</th>`)
+	for _, sp := range sparks {
+		fmt.Fprintf(&b, `<td style="padding: 4px 12px">%s</td>`, sp)
+	}
+	b.WriteString("</tr>\n")
+	b.WriteString("</table>\n")
+	return b.String()
+}
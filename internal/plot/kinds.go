@@ -0,0 +1,379 @@
+// kinds.go - the other views of the columns: heatmap, CDF, box plots
+// and stacked phases; and the tabs to pick a view in the page
+
+package plot
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/charts"
+	"github.com/go-echarts/go-echarts/v2/components"
+	"github.com/go-echarts/go-echarts/v2/opts"
+	"github.com/go-echarts/go-echarts/v2/types"
+)
+
+// the phases that add up to the end-to-end latency (in order) and
+// the column with the end-to-end latency
+var (
+	stackPhases = []string{"dns", "tcp", "starttls", "tls", "banner", "http"}
+	e2ePhase    = "https"
+)
+
+// LagColumn is the column with the scheduling lag of the probes: how
+// late each was sent
+const LagColumn = "lag"
+
+// ReconnectColumn is the column with the setup time of the connection
+// made by each probe of a keep-alive target; 0 if it reused one
+const ReconnectColumn = "reconnect"
+
+// IsMeta returns true if column 'nm' is about the probes and not the
+// target; it is charted over time and summarized, but it isn't a
+// phase: it has no CDF, box plots, baseline, anomalies or alerts.
+func IsMeta(nm string) bool {
+	return nm == LagColumn || nm == ReconnectColumn
+}
+
+// size of the heatmap grid
+const (
+	_HeatCols = 60
+	_HeatRows = 24
+)
+
+// return the index of the column that best represents the target:
+// the end-to-end latency if there's one; else the one with the
+// largest mean (see IsMeta).
+func (o *Columns) headline() int {
+	if i := slices.Index(o.Names, e2ePhase); i >= 0 {
+		return i
+	}
+
+	k := 0
+	var best float64 = -1
+	for i, nm := range o.Names {
+		if IsMeta(nm) {
+			continue
+		}
+
+		var tot float64
+		for _, x := range o.Colref[i][:o.Minlen] {
+			tot += float64(x)
+		}
+		if tot > best {
+			k, best = i, tot
+		}
+	}
+	return k
+}
+
+// Headline returns the name of the column that best represents the
+// target (see headline)
+func (o *Columns) Headline() string {
+	if len(o.Names) == 0 {
+		return ""
+	}
+	return o.Names[o.headline()]
+}
+
+// the x-axis label of row 'i'
+func (o *Columns) rowLabel(i int) string {
+	if len(o.Times) >= o.Minlen {
+		return TimeLabel(o.Times[i])
+	}
+	return fmt.Sprintf("%d", i)
+}
+
+// the distribution of the headline column over time: rows are binned
+// into _HeatCols columns and the latencies into _HeatRows log spaced
+// bins.
+func newHeatmap(o *Columns) *charts.HeatMap {
+	k := o.headline()
+	v := o.Colref[k][:o.Minlen]
+
+	lo, hi := slices.Min(v), slices.Max(v)
+	lo = max(lo, time.Microsecond)
+	hi = max(hi, lo)
+	span := math.Log(float64(hi) / float64(lo))
+
+	bin := func(x time.Duration) int {
+		if span == 0 || x <= lo {
+			return 0
+		}
+		b := int(math.Log(float64(x)/float64(lo)) / span * _HeatRows)
+		return min(b, _HeatRows-1)
+	}
+
+	ncol := min(_HeatCols, o.Minlen)
+	counts := make([][_HeatRows]int, ncol)
+	for i, x := range v {
+		counts[i*ncol/o.Minlen][bin(x)]++
+	}
+
+	xl := make([]string, ncol)
+	for c := range xl {
+		xl[c] = o.rowLabel(c * o.Minlen / ncol)
+	}
+
+	yl := make([]string, _HeatRows)
+	for r := range yl {
+		edge := float64(lo) * math.Exp(span*float64(r)/_HeatRows)
+		yl[r] = fmt.Sprintf("%.3g", edge/float64(time.Millisecond))
+	}
+
+	var data []opts.HeatMapData
+	var most int
+	for c := range counts {
+		for r, n := range counts[c] {
+			if n > 0 {
+				data = append(data, opts.HeatMapData{Value: [3]int{c, r, n}})
+				most = max(most, n)
+			}
+		}
+	}
+
+	hm := charts.NewHeatMap()
+	hm.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    fmt.Sprintf("Latency heatmap for %s", o.Name),
+			Subtitle: fmt.Sprintf("%s latency (ms) over time; color is the number of samples", strings.ToTitle(o.Names[k])),
+		}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true)}),
+		charts.WithXAxisOpts(opts.XAxis{Type: "category", SplitArea: &opts.SplitArea{Show: opts.Bool(true)}}),
+		charts.WithYAxisOpts(opts.YAxis{Type: "category", Name: "ms", Data: yl, SplitArea: &opts.SplitArea{Show: opts.Bool(true)}}),
+		charts.WithVisualMapOpts(opts.VisualMap{
+			Calculable: opts.Bool(true),
+			Min:        0,
+			Max:        float32(most),
+			Right:      "0",
+			Top:        "middle",
+		}),
+	)
+	hm.SetXAxis(xl).AddSeries(o.Names[k], data)
+	return hm
+}
+
+// the CDF of each column
+func newCDFs(o *Columns) *charts.Line {
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    fmt.Sprintf("CDF for %s", o.Name),
+			Subtitle: "Percentile of each latency (ms)",
+		}),
+		charts.WithLegendOpts(opts.Legend{Show: opts.Bool(true), Top: "bottom"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true), Trigger: "item"}),
+		charts.WithXAxisOpts(opts.XAxis{Type: "value", Name: "ms", Scale: opts.Bool(true)}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "percentile", Max: 100}),
+	)
+
+	for i, nm := range o.Names {
+		if IsMeta(nm) {
+			continue
+		}
+		if d := cdfData(o.Colref[i][:o.Minlen]); len(d) > 0 {
+			line.AddSeries(strings.ToTitle(nm), d)
+		}
+	}
+
+	line.SetSeriesOptions(charts.WithLineChartOpts(opts.LineChart{ShowSymbol: opts.Bool(false)}))
+	return line
+}
+
+// return the points of the CDF of 'v': [ms, percentile]
+func cdfData(v []time.Duration) []opts.LineData {
+	if len(v) == 0 {
+		return nil
+	}
+
+	s := slices.Clone(v)
+	slices.Sort(s)
+
+	d := make([]opts.LineData, len(cdfPct))
+	for i, p := range cdfPct {
+		x := s[int(float64(len(s)-1)*p/100)]
+		d[i].Value = []any{millis(x), p}
+	}
+	return d
+}
+
+// box plots of each column per hour; nil if the rows aren't timed
+func newBoxes(o *Columns) *charts.BoxPlot {
+	if o.Minlen == 0 || len(o.Times) < o.Minlen {
+		return nil
+	}
+
+	// the rows of each hour
+	var hours []time.Time
+	var rows [][]int
+	for i, t := range o.Times[:o.Minlen] {
+		h := t.Truncate(time.Hour)
+		if n := len(hours); n == 0 || !hours[n-1].Equal(h) {
+			hours = append(hours, h)
+			rows = append(rows, nil)
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], i)
+	}
+
+	xl := make([]string, len(hours))
+	for i, h := range hours {
+		xl[i] = h.Local().Format("01-02 15:04")
+	}
+
+	box := charts.NewBoxPlot()
+	box.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    fmt.Sprintf("Hourly latency for %s", o.Name),
+			Subtitle: "Min, p25, p50, p75 and max of each hour (ms)",
+		}),
+		charts.WithLegendOpts(opts.Legend{Show: opts.Bool(true), Top: "bottom"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true), Trigger: "item"}),
+		charts.WithYAxisOpts(opts.YAxis{Name: "ms", Scale: opts.Bool(true)}),
+	)
+	box.SetXAxis(xl)
+
+	for j, nm := range o.Names {
+		if IsMeta(nm) {
+			continue
+		}
+
+		col := o.Colref[j]
+		d := make([]opts.BoxPlotData, len(rows))
+		for i, r := range rows {
+			s := make([]time.Duration, len(r))
+			for k, x := range r {
+				s[k] = col[x]
+			}
+			slices.Sort(s)
+
+			q := func(p int) float64 {
+				return millis(s[(len(s)-1)*p/100])
+			}
+			d[i].Value = [5]float64{q(0), q(25), q(50), q(75), q(100)}
+		}
+		box.AddSeries(strings.ToTitle(nm), d)
+	}
+	return box
+}
+
+// the phases stacked on each other and the end-to-end latency; nil if
+// there aren't two phases to stack
+func newStack(o *Columns) *charts.Line {
+	var idx []int
+	for _, nm := range stackPhases {
+		if i := slices.Index(o.Names, nm); i >= 0 {
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return nil
+	}
+
+	line := charts.NewLine()
+	line.SetGlobalOptions(
+		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
+		charts.WithTitleOpts(opts.Title{
+			Title:    fmt.Sprintf("Latency breakdown for %s", o.Name),
+			Subtitle: "How each phase adds to the end-to-end latency (ms)",
+		}),
+		charts.WithLegendOpts(opts.Legend{Show: opts.Bool(true), Top: "bottom"}),
+		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true), Trigger: "axis"}),
+		charts.WithDataZoomOpts(opts.DataZoom{Type: "slider", Start: 0, End: 100}),
+	)
+
+	xl := make([]string, o.Minlen)
+	for i := range xl {
+		xl[i] = o.rowLabel(i)
+	}
+	line.SetXAxis(xl)
+
+	for _, i := range idx {
+		line.AddSeries(strings.ToTitle(o.Names[i]), durationToFloat64(o.Colref[i][:o.Minlen]),
+			charts.WithLineChartOpts(opts.LineChart{Stack: "e2e", ShowSymbol: opts.Bool(false)}),
+			charts.WithAreaStyleOpts(opts.AreaStyle{Opacity: 0.6}),
+		)
+	}
+
+	if i := slices.Index(o.Names, e2ePhase); i >= 0 {
+		line.AddSeries(strings.ToTitle(e2ePhase), durationToFloat64(o.Colref[i][:o.Minlen]),
+			charts.WithLineChartOpts(opts.LineChart{ShowSymbol: opts.Bool(false)}),
+		)
+	}
+	return line
+}
+
+// a view of the page
+type tab struct {
+	name  string
+	chart components.Charter
+}
+
+// render the charts in 'tabs' to 'fn' as a page with a tab for each;
+// 'tail' is html that goes below the charts.
+func renderTabs(title string, tabs []tab, tail, fn string) error {
+	page := components.NewPage()
+	page.PageTitle = title
+
+	var bar strings.Builder
+	bar.WriteString(_TabStyle)
+	bar.WriteString(`<div class="tabs">`)
+	for i, t := range tabs {
+		page.AddCharts(t.chart)
+		fmt.Fprintf(&bar, `<button onclick="showTab(%d)">%s</button>`, i, t.name)
+	}
+	bar.WriteString("</div>\n")
+
+	var b bytes.Buffer
+	if err := page.Render(&b); err != nil {
+		return err
+	}
+
+	s := b.String()
+	if i := strings.Index(s, "<body>"); i >= 0 {
+		i += len("<body>")
+		s = s[:i] + "\n" + bar.String() + s[i:]
+	}
+	s = beforeEnd(s, tail+_TabJS)
+	return os.WriteFile(fn, []byte(s), 0600)
+}
+
+// insert 'x' at the end of the body of page 's'
+func beforeEnd(s, x string) string {
+	if i := strings.LastIndex(s, "</body>"); i >= 0 {
+		return s[:i] + x + s[i:]
+	}
+	return s + x
+}
+
+const _TabStyle = `<style>
+.tabs { text-align: center; margin: 10px; }
+.tabs button { border: 1px solid #ccc; background: #f8f8f8; padding: 6px 14px; cursor: pointer; }
+.tabs button.on { background: #ddd; font-weight: bold; }
+</style>
+`
+
+// each chart is in a div.container (see go-echarts base_element.tpl)
+const _TabJS = `<script type="text/javascript">
+function showTab(n) {
+    document.querySelectorAll('.container').forEach(function(c, i) {
+        c.style.display = i == n ? '' : 'none';
+        if (i == n) {
+            const e = echarts.getInstanceByDom(c.firstElementChild);
+            if (e) e.resize();
+        }
+    });
+    document.querySelectorAll('.tabs button').forEach(function(b, i) {
+        b.className = i == n ? 'on' : '';
+    });
+}
+showTab(0);
+</script>
+`
@@ -0,0 +1,111 @@
+// live.go - a chart that is updated from a stream of samples
+
+package plot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-echarts/go-echarts/v2/components"
+)
+
+// Point is a row of a live chart as sent to the browser
+type Point struct {
+	// unix millisec and the x-axis label
+	T int64  `json:"t"`
+	X string `json:"x"`
+
+	// column name and the value in millisec (as in Chart)
+	V map[string]float64 `json:"v"`
+}
+
+// NewPoint makes a point from the values 'vals' of columns 'names'
+func NewPoint(t time.Time, names []string, vals []time.Duration) Point {
+	p := Point{
+		T: t.UnixMilli(),
+		X: TimeLabel(t),
+		V: make(map[string]float64, len(names)),
+	}
+	for i, nm := range names {
+		p.V[nm] = millis(vals[i])
+	}
+	return p
+}
+
+// Live renders the chart for 'o' (which must have Times) to 'w'.
+// The page subscribes to the server-sent events at 'events'; each
+// event is a Point that is appended to the chart. Points older than
+// 'window' are dropped. The comparison with the baseline and the SLOs
+// (if any) are below the chart.
+func Live(o *Columns, w io.Writer, events string, window time.Duration) error {
+	ts := make([]int64, o.Minlen)
+	for i := range ts {
+		ts[i] = o.Times[i].UnixMilli()
+	}
+
+	tj, err := json.Marshal(ts)
+	if err != nil {
+		return err
+	}
+	ej, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+
+	line := newLine(o)
+	line.AddJSFuncs(fmt.Sprintf(_LiveJS, tj, window.Milliseconds(), ej))
+
+	page := components.NewPage()
+	page.PageTitle = fmt.Sprintf("%s (live)", o.Name)
+	page.AddCharts(line)
+	tail := o.tail()
+	if len(tail) == 0 {
+		return page.Render(w)
+	}
+
+	var b bytes.Buffer
+	if err := page.Render(&b); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, beforeEnd(b.String(), tail))
+	return err
+}
+
+// %MY_ECHARTS% is replaced by go-echarts with the chart instance
+const _LiveJS = `
+(function() {
+    const chart = %%MY_ECHARTS%%;
+    const ts = %s;
+    const span = %d;
+    const es = new EventSource(%s);
+    es.onmessage = function(ev) {
+        const p = JSON.parse(ev.data);
+        const opt = chart.getOption();
+        const x = opt.xAxis[0].data;
+        const series = opt.series;
+
+        ts.push(p.t);
+        x.push(p.x);
+        for (const s of series) {
+            const v = p.v[s.name.toLowerCase()];
+            s.data.push({value: v === undefined ? null : v});
+        }
+
+        while (ts.length > 0 && ts[0] < p.t - span) {
+            ts.shift();
+            x.shift();
+            for (const s of series) {
+                s.data.shift();
+            }
+        }
+
+        chart.setOption({
+            xAxis: [{data: x}],
+            series: series.map(s => ({name: s.name, data: s.data})),
+        });
+    };
+})();
+`
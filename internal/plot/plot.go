@@ -3,12 +3,11 @@ package plot
 
 import (
 	"fmt"
-	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/go-echarts/go-echarts/v2/charts"
-	"github.com/go-echarts/go-echarts/v2/components"
 	"github.com/go-echarts/go-echarts/v2/opts"
 	"github.com/go-echarts/go-echarts/v2/types"
 )
@@ -30,20 +29,108 @@ type Columns struct {
 	Name  string
 	Start time.Time
 
+	// user supplied labels for the target
+	Labels map[string]string
+
 	Names  []string
 	Colref [][]time.Duration
 	Minlen int
+
+	// optional time of each row; used to label the x-axis
+	Times []time.Time
+
+	// event counts accumulated alongside the columns
+	Counters []Counter
+
+	// notable events (eg path changes) at a given row
+	Marks []Mark
+
+	// optional comparison with a baseline period; shown below the
+	// charts
+	Baseline *Baseline
+
+	// optional state of the SLOs of the target; shown below the charts
+	SLOs []SLOStatus
+}
+
+// Mark annotates row 'Index' of the columns
+type Mark struct {
+	Index int
+	Label string
+}
+
+// Counter is a named count of events (eg lost packets) that don't
+// have a latency of their own.
+type Counter struct {
+	Name string
+	Val  uint64
+}
+
+// CounterString returns a printable form of the counters in 'o'
+func (o *Columns) CounterString() string {
+	v := make([]string, len(o.Counters))
+	for i := range o.Counters {
+		c := &o.Counters[i]
+		v[i] = fmt.Sprintf("%s=%d", c.Name, c.Val)
+	}
+	return strings.Join(v, " ")
 }
 
+// LabelString returns a printable form of the labels in 'o'
+func (o *Columns) LabelString() string {
+	v := make([]string, 0, len(o.Labels))
+	for k, x := range o.Labels {
+		v = append(v, fmt.Sprintf("%s=%s", k, x))
+	}
+	sort.Strings(v)
+	return strings.Join(v, " ")
+}
+
+// Chart renders the columns in 'o' to 'fn': the latencies over time
+// and in other tabs, a heatmap, the CDFs, hourly box plots and the
+// phases stacked.
 func Chart(o *Columns, fn string) error {
+	tabs := []tab{{"Latency", newLine(o)}}
+	if o.Minlen > 0 {
+		tabs = append(tabs, tab{"Heatmap", newHeatmap(o)}, tab{"CDF", newCDFs(o)})
+		if b := newBoxes(o); b != nil {
+			tabs = append(tabs, tab{"Hourly", b})
+		}
+		if s := newStack(o); s != nil {
+			tabs = append(tabs, tab{"Breakdown", s})
+		}
+	}
+	return renderTabs(fmt.Sprintf("RTT for %s", o.Name), tabs, o.tail(), fn)
+}
+
+// return the html that goes below the charts: the comparison with the
+// baseline and the SLOs
+func (o *Columns) tail() string {
+	var s string
+	if o.Baseline != nil {
+		s = o.Baseline.Table()
+	}
+	return s + SLOTable(o.SLOs)
+}
+
+// make a line chart of the columns in 'o'
+func newLine(o *Columns) *charts.Line {
 	line := charts.NewLine()
 
+	subtitle := "Various protocol latencies"
+	if len(o.Labels) > 0 {
+		subtitle += "; " + o.LabelString()
+	}
+	if len(o.Counters) > 0 {
+		subtitle += "; " + o.CounterString()
+	}
+
 	// set some global options like Title/Legend/ToolTip or anything else
 	line.SetGlobalOptions(
 		charts.WithInitializationOpts(opts.Initialization{Theme: types.ThemeWesteros}),
 		charts.WithTitleOpts(opts.Title{
 			Title:    fmt.Sprintf("RTT for %s", o.Name),
-			Subtitle: "Various protocol latencies",
+			Subtitle: subtitle,
 		}),
 		charts.WithTooltipOpts(opts.Tooltip{Show: opts.Bool(true), Trigger: "item"}),
 		charts.WithDataZoomOpts(opts.DataZoom{
@@ -53,11 +140,22 @@ func Chart(o *Columns, fn string) error {
 		}),
 	)
 
-	line.SetXAxis(makeXAxis(o.Minlen))
+	if len(o.Times) > 0 && len(o.Times) >= o.Minlen {
+		line.SetXAxis(makeTimeAxis(o.Times[:o.Minlen]))
+	} else {
+		line.SetXAxis(makeXAxis(o.Minlen))
+	}
 
+	st := o.Summary()
 	for i, nm := range o.Names {
 		v := durationToFloat64(o.Colref[i][:o.Minlen])
-		line.AddSeries(strings.ToTitle(nm), v)
+		sopt := []charts.SeriesOpts{
+			charts.WithMarkLineNameYAxisItemOpts(pctMarks(&st[i])...),
+		}
+		if i == 0 && len(o.Marks) > 0 {
+			sopt = append(sopt, charts.WithMarkLineNameXAxisItemOpts(makeMarks(o)...))
+		}
+		line.AddSeries(strings.ToTitle(nm), v, sopt...)
 	}
 
 	o1 := charts.WithLineChartOpts(opts.LineChart{Smooth: opts.Bool(true), ShowSymbol: opts.Bool(true), SymbolSize: 5, Symbol: "diamond"})
@@ -67,26 +165,55 @@ func Chart(o *Columns, fn string) error {
 	)
 
 	line.SetSeriesOptions(o1, o2)
-
-	page := components.NewPage()
-	page.AddCharts(line)
-	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	page.Render(f)
-	return nil
+	return line
 }
 
+// durations in millisec with microsec precision
 func durationToFloat64(d []time.Duration) []opts.LineData {
 	f := make([]opts.LineData, len(d))
 	for i, v := range d {
-		f[i].Value = float64(v.Milliseconds())
+		f[i].Value = millis(v)
 	}
 	return f
 }
 
+// duration in millisec with microsec precision
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
+
+// horizontal lines at the tail percentiles of a column
+func pctMarks(s *Stats) []opts.MarkLineNameYAxisItem {
+	return []opts.MarkLineNameYAxisItem{
+		{Name: "P50", YAxis: millis(s.P50)},
+		{Name: "P95", YAxis: millis(s.P95)},
+		{Name: "P99", YAxis: millis(s.P99)},
+	}
+}
+
+func makeMarks(o *Columns) []opts.MarkLineNameXAxisItem {
+	m := make([]opts.MarkLineNameXAxisItem, 0, len(o.Marks))
+	for _, k := range o.Marks {
+		if k.Index < o.Minlen {
+			m = append(m, opts.MarkLineNameXAxisItem{Name: k.Label, XAxis: k.Index})
+		}
+	}
+	return m
+}
+
+func makeTimeAxis(t []time.Time) []string {
+	x := make([]string, len(t))
+	for i := range t {
+		x[i] = TimeLabel(t[i])
+	}
+	return x
+}
+
+// TimeLabel is the x-axis label for a row at time 't'
+func TimeLabel(t time.Time) string {
+	return t.Local().Format("15:04:05")
+}
+
 func makeXAxis(n int) []int {
 	x := make([]int, n)
 	for i := range n {
@@ -0,0 +1,112 @@
+// slo.go - the state of the service level objectives of a target
+
+package plot
+
+import (
+	"fmt"
+	"html"
+	"strings"
+	"time"
+)
+
+// SLOStatus is the state of a service level objective over its
+// window
+type SLOStatus struct {
+	Name string
+
+	// the fraction of good probes wanted and what a good probe is
+	// (eg "e2e < 500ms")
+	Objective float64
+	Indicator string
+	Window    time.Duration
+
+	// probes in the window and the bad ones among them
+	Total uint64
+	Bad   uint64
+
+	// the fraction of good probes and of the error budget that is
+	// left (negative when it is overspent)
+	Compliance float64
+	Budget     float64
+
+	// burn rates over the recent windows
+	Burn []Burn
+}
+
+// Burn is the rate at which the error budget is spent over a window:
+// 1 spends exactly the budget over the window of the SLO.
+type Burn struct {
+	Window time.Duration
+	Total  uint64
+	Rate   float64
+}
+
+// Met returns true if the SLO is met over its window
+func (s *SLOStatus) Met() bool {
+	return s.Total == 0 || s.Compliance >= s.Objective
+}
+
+// SLOTable returns the SLOs in 'v' as an html table; the ones not
+// met are in red.
+func SLOTable(v []SLOStatus) string {
+	if len(v) == 0 {
+		return ""
+	}
+
+	var s strings.Builder
+	s.WriteString(`<table style="margin: 20px auto; border-collapse: collapse; font-family: sans-serif; text-align: right">`)
+	s.WriteString("\n<caption>Service level objectives</caption>\n")
+	s.WriteString(`<tr><th style="text-align: left">slo</th>`)
+	for _, h := range []string{"indicator", "objective", "window", "probes", "compliance", "budget left", "burn rate"} {
+		fmt.Fprintf(&s, `<th style="padding: 4px 12px">%s</th>`, h)
+	}
+	s.WriteString("</tr>\n")
+
+	td := func(x string) {
+		fmt.Fprintf(&s, `<td style="padding: 4px 12px">%s</td>`, x)
+	}
+
+	for i := range v {
+		x := &v[i]
+		style := ""
+		if !x.Met() {
+			style = ` style="color: #c00"`
+		}
+
+		burn := make([]string, len(x.Burn))
+		for j, b := range x.Burn {
+			burn[j] = fmt.Sprintf("%s %.2f", Window(b.Window), b.Rate)
+		}
+
+		fmt.Fprintf(&s, `<tr%s><th style="text-align: left">%s</th>`, style, html.EscapeString(x.Name))
+		td(html.EscapeString(x.Indicator))
+		td(fmt.Sprintf("%.3f%%", 100*x.Objective))
+		td(Window(x.Window))
+		td(fmt.Sprintf("%d", x.Total))
+		if x.Total == 0 {
+			td("-")
+			td("-")
+		} else {
+			td(fmt.Sprintf("%.3f%%", 100*x.Compliance))
+			td(fmt.Sprintf("%.1f%%", 100*x.Budget))
+		}
+		td(strings.Join(burn, ", "))
+		s.WriteString("</tr>\n")
+	}
+	s.WriteString("</table>\n")
+	return s.String()
+}
+
+// Window returns 'd' in days or hours when it is a whole number of
+// them (eg 28d, 6h)
+func Window(d time.Duration) string {
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
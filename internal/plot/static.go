@@ -0,0 +1,403 @@
+// static.go - static svg and png charts
+//
+// The html charts need a browser; these don't and can go into email,
+// tickets or a pdf. A chart is drawn once on a painter: the svg
+// painter writes the elements and the png painter rasterizes the same
+// shapes. Long columns are cut down to the min and max of each pixel
+// column so that the spikes survive.
+
+package plot
+
+import (
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// size of the static charts and the sparklines
+const (
+	_StaticW = 900
+	_StaticH = 420
+
+	SparkW = 120
+	SparkH = 24
+)
+
+// the colors of the westeros theme used by the html charts
+var palette = []color.RGBA{
+	{0x51, 0x6b, 0x91, 0xff},
+	{0x59, 0xc4, 0xe6, 0xff},
+	{0xed, 0xaf, 0xda, 0xff},
+	{0x93, 0xb7, 0xe3, 0xff},
+	{0xa5, 0xe7, 0xf0, 0xff},
+	{0xcb, 0xb0, 0xe3, 0xff},
+}
+
+var (
+	white = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	black = color.RGBA{0x33, 0x33, 0x33, 0xff}
+	grey  = color.RGBA{0x88, 0x88, 0x88, 0xff}
+	light = color.RGBA{0xe6, 0xe6, 0xe6, 0xff}
+)
+
+type point struct {
+	x, y float64
+}
+
+// where a text is anchored on its x coordinate
+type anchor int
+
+const (
+	anchorStart anchor = iota
+	anchorMiddle
+	anchorEnd
+)
+
+// painter draws the shapes of a static chart; the y of a text is its
+// baseline.
+type painter interface {
+	polyline(p []point, c color.RGBA, width float64, dash bool)
+	rect(x, y, w, h float64, c color.RGBA)
+	text(x, y float64, s string, c color.RGBA, a anchor)
+}
+
+// Static renders the latencies in 'o' to 'fn' as a static chart; the
+// suffix of 'fn' (.svg or .png) picks the format.
+func Static(o *Columns, fn string) error {
+	switch ext := filepath.Ext(fn); ext {
+	case ".svg":
+		s := newSvg(_StaticW, _StaticH)
+		drawChart(o, s, _StaticW, _StaticH)
+		return os.WriteFile(fn, s.bytes(), 0600)
+
+	case ".png":
+		p := newPng(_StaticW, _StaticH)
+		drawChart(o, p, _StaticW, _StaticH)
+
+		fd, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(fd, p.img); err != nil {
+			fd.Close()
+			return err
+		}
+		return fd.Close()
+
+	default:
+		return fmt.Errorf("%s: unknown static chart format '%s'", fn, ext)
+	}
+}
+
+// Sparkline returns a 'w' x 'h' svg of the values in 'v' without axes
+// or labels; the last value is marked.
+func Sparkline(v []time.Duration, w, h int) string {
+	s := newSvg(w, h)
+	if len(v) == 0 {
+		return string(s.bytes())
+	}
+
+	lo, hi := v[0], v[0]
+	for _, x := range v {
+		lo, hi = min(lo, x), max(hi, x)
+	}
+
+	const pad = 2.0
+	fw, fh := float64(w)-2*pad, float64(h)-2*pad
+	pts := decimate(v, w)
+	for i := range pts {
+		pts[i].x = pad + scale(pts[i].x, 0, float64(len(v)-1), fw)
+		pts[i].y = pad + fh - scale(pts[i].y, millis(lo), millis(hi), fh)
+	}
+
+	s.polyline(pts, palette[0], 1, false)
+	last := pts[len(pts)-1]
+	s.rect(last.x-1.5, last.y-1.5, 3, 3, color.RGBA{0xc2, 0x35, 0x31, 0xff})
+	return string(s.bytes())
+}
+
+// draw the latency chart of 'o' on 'p' of size 'w' x 'h': a line per
+// column, the p50/p95/p99 of the headline column and a legend.
+func drawChart(o *Columns, p painter, w, h float64) {
+	const left, right, top, bottom = 60.0, 20.0, 56.0, 56.0
+	pw, ph := w-left-right, h-top-bottom
+
+	subtitle := "Various protocol latencies"
+	if len(o.Labels) > 0 {
+		subtitle += "; " + o.LabelString()
+	}
+	if len(o.Counters) > 0 {
+		subtitle += "; " + o.CounterString()
+	}
+
+	p.rect(0, 0, w, h, white)
+	p.text(left, 20, fmt.Sprintf("RTT for %s", o.Name), black, anchorStart)
+	p.text(left, 38, subtitle, grey, anchorStart)
+
+	var hi time.Duration
+	for i := range o.Names {
+		for _, x := range o.Colref[i][:o.Minlen] {
+			hi = max(hi, x)
+		}
+	}
+
+	// y axis: grid lines at nice steps
+	ymax, step := niceScale(millis(hi), 5)
+	ypos := func(ms float64) float64 {
+		return top + ph - scale(ms, 0, ymax, ph)
+	}
+	for y := 0.0; y <= ymax+step/2; y += step {
+		yy := ypos(y)
+		p.polyline([]point{{left, yy}, {left + pw, yy}}, light, 1, false)
+		p.text(left-6, yy+4, strconv.FormatFloat(y, 'g', 4, 64), grey, anchorEnd)
+	}
+	p.text(left-6, top-8, "ms", grey, anchorEnd)
+	p.polyline([]point{{left, top}, {left, top + ph}, {left + pw, top + ph}}, grey, 1, false)
+
+	if o.Minlen == 0 {
+		return
+	}
+
+	// x axis: a few row labels; the ones at the ends stay inside
+	last := float64(max(o.Minlen-1, 1))
+	for k := 0; k <= 4; k++ {
+		i := k * (o.Minlen - 1) / 4
+		a := anchorMiddle
+		switch k {
+		case 0:
+			a = anchorStart
+		case 4:
+			a = anchorEnd
+		}
+		p.text(left+scale(float64(i), 0, last, pw), top+ph+18, o.rowLabel(i), grey, a)
+	}
+
+	for j := range o.Names {
+		pts := decimate(o.Colref[j][:o.Minlen], int(pw))
+		for i := range pts {
+			pts[i].x = left + scale(pts[i].x, 0, last, pw)
+			pts[i].y = ypos(pts[i].y)
+		}
+		p.polyline(pts, palette[j%len(palette)], 1.5, false)
+	}
+
+	// the tail percentiles of the headline column
+	k := o.headline()
+	st := Summarize(o.Names[k], o.Colref[k][:o.Minlen])
+	marks := []struct {
+		nm string
+		d  time.Duration
+	}{
+		{"P50", st.P50},
+		{"P95", st.P95},
+		{"P99", st.P99},
+	}
+	for _, m := range marks {
+		yy := ypos(millis(m.d))
+		p.polyline([]point{{left, yy}, {left + pw, yy}}, black, 1, true)
+		p.text(left+pw, yy-3, fmt.Sprintf("%s %s %.3f", strings.ToTitle(o.Names[k]), m.nm, millis(m.d)), black, anchorEnd)
+	}
+
+	// legend
+	x, y := left, h-14
+	for j, nm := range o.Names {
+		nm = strings.ToTitle(nm)
+		p.rect(x, y-9, 10, 10, palette[j%len(palette)])
+		p.text(x+14, y, nm, black, anchorStart)
+		x += 14 + 7*float64(len(nm)) + 18
+	}
+}
+
+// return the points [row, ms] of 'v' to draw in 'n' pixels: all of them
+// if there are few; else the min and max of each pixel in order.
+func decimate(v []time.Duration, n int) []point {
+	if len(v) <= 2*n {
+		pts := make([]point, len(v))
+		for i, x := range v {
+			pts[i] = point{float64(i), millis(x)}
+		}
+		return pts
+	}
+
+	pts := make([]point, 0, 2*n)
+	for b := range n {
+		i, j := b*len(v)/n, (b+1)*len(v)/n
+		lo, hi := i, i
+		for k := i; k < j; k++ {
+			if v[k] < v[lo] {
+				lo = k
+			}
+			if v[k] > v[hi] {
+				hi = k
+			}
+		}
+
+		a, z := min(lo, hi), max(lo, hi)
+		pts = append(pts, point{float64(a), millis(v[a])})
+		if z != a {
+			pts = append(pts, point{float64(z), millis(v[z])})
+		}
+	}
+	return pts
+}
+
+// map 'x' in [lo, hi] to [0, n]
+func scale(x, lo, hi, n float64) float64 {
+	if hi <= lo {
+		return n / 2
+	}
+	return (x - lo) / (hi - lo) * n
+}
+
+// return the top of an axis for values up to 'hi' and a round step
+// that divides it into about 'ticks' steps.
+func niceScale(hi float64, ticks int) (float64, float64) {
+	if hi <= 0 {
+		hi = 1
+	}
+
+	raw := hi / float64(ticks)
+	mag := math.Pow(10, math.Floor(math.Log10(raw)))
+	step := 10 * mag
+	for _, f := range []float64{1, 2, 2.5, 5} {
+		if raw <= f*mag {
+			step = f * mag
+			break
+		}
+	}
+	return math.Ceil(hi/step) * step, step
+}
+
+// svgPainter writes the shapes as svg elements
+type svgPainter struct {
+	b strings.Builder
+}
+
+func newSvg(w, h int) *svgPainter {
+	s := &svgPainter{}
+	fmt.Fprintf(&s.b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="12">`, w, h, w, h)
+	s.b.WriteString("\n")
+	return s
+}
+
+func (s *svgPainter) polyline(p []point, c color.RGBA, width float64, dash bool) {
+	if len(p) == 0 {
+		return
+	}
+
+	fmt.Fprintf(&s.b, `<polyline fill="none" stroke="%s" stroke-width="%g"`, hexColor(c), width)
+	if dash {
+		s.b.WriteString(` stroke-dasharray="4 3"`)
+	}
+	s.b.WriteString(` points="`)
+	for i, x := range p {
+		if i > 0 {
+			s.b.WriteByte(' ')
+		}
+		fmt.Fprintf(&s.b, "%.1f,%.1f", x.x, x.y)
+	}
+	s.b.WriteString("\"/>\n")
+}
+
+func (s *svgPainter) rect(x, y, w, h float64, c color.RGBA) {
+	fmt.Fprintf(&s.b, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`+"\n", x, y, w, h, hexColor(c))
+}
+
+func (s *svgPainter) text(x, y float64, str string, c color.RGBA, a anchor) {
+	ta := [...]string{"start", "middle", "end"}[a]
+	fmt.Fprintf(&s.b, `<text x="%.1f" y="%.1f" fill="%s" text-anchor="%s">%s</text>`+"\n", x, y, hexColor(c), ta, html.EscapeString(str))
+}
+
+func (s *svgPainter) bytes() []byte {
+	return []byte(s.b.String() + "</svg>\n")
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// pngPainter rasterizes the shapes onto an image
+type pngPainter struct {
+	img *image.RGBA
+}
+
+func newPng(w, h int) *pngPainter {
+	return &pngPainter{img: image.NewRGBA(image.Rect(0, 0, w, h))}
+}
+
+// each segment (or dash) is stroked as a quad; they're all filled at
+// once so that the joins don't darken.
+func (p *pngPainter) polyline(pts []point, c color.RGBA, width float64, dash bool) {
+	b := p.img.Bounds()
+	r := vector.NewRasterizer(b.Dx(), b.Dy())
+
+	quad := func(a, z point) {
+		dx, dy := z.x-a.x, z.y-a.y
+		l := math.Hypot(dx, dy)
+		if l == 0 {
+			return
+		}
+
+		nx, ny := -dy/l*width/2, dx/l*width/2
+		r.MoveTo(float32(a.x+nx), float32(a.y+ny))
+		r.LineTo(float32(z.x+nx), float32(z.y+ny))
+		r.LineTo(float32(z.x-nx), float32(z.y-ny))
+		r.LineTo(float32(a.x-nx), float32(a.y-ny))
+		r.ClosePath()
+	}
+
+	for i := 1; i < len(pts); i++ {
+		a, z := pts[i-1], pts[i]
+		if !dash {
+			quad(a, z)
+			continue
+		}
+
+		// 4px on, 3px off
+		l := math.Hypot(z.x-a.x, z.y-a.y)
+		for d := 0.0; d < l; d += 7 {
+			e := min(d+4, l)
+			quad(point{a.x + (z.x-a.x)*d/l, a.y + (z.y-a.y)*d/l},
+				point{a.x + (z.x-a.x)*e/l, a.y + (z.y-a.y)*e/l})
+		}
+	}
+	r.Draw(p.img, b, image.NewUniform(c), image.Point{})
+}
+
+func (p *pngPainter) rect(x, y, w, h float64, c color.RGBA) {
+	r := image.Rect(int(x), int(y), int(math.Round(x+w)), int(math.Round(y+h)))
+	draw.Draw(p.img, r, image.NewUniform(c), image.Point{}, draw.Src)
+}
+
+func (p *pngPainter) text(x, y float64, s string, c color.RGBA, a anchor) {
+	d := font.Drawer{
+		Dst:  p.img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+	}
+
+	w := float64(d.MeasureString(s).Ceil())
+	switch a {
+	case anchorMiddle:
+		x -= w / 2
+	case anchorEnd:
+		x -= w
+	}
+
+	d.Dot = fixed.P(int(x), int(y))
+	d.DrawString(s)
+}
@@ -0,0 +1,98 @@
+// stats.go - summary statistics of the columns
+
+package plot
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+// Stats summarizes a single column
+type Stats struct {
+	Name string
+	N    int
+
+	// failed probes; these have no latency
+	Failures uint64
+
+	// probes skipped because the earlier ones ran late
+	Skipped uint64
+
+	Min    time.Duration
+	Mean   time.Duration
+	Stddev time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+	P999   time.Duration
+	Max    time.Duration
+}
+
+// Summary returns the stats of each column in 'o'. The failures and
+// skipped probes are taken from the "errors" and "skipped" counters.
+func (o *Columns) Summary() []Stats {
+	fails, skipped := o.counter("errors"), o.counter("skipped")
+
+	v := make([]Stats, 0, len(o.Names))
+	for i, nm := range o.Names {
+		s := Summarize(nm, o.Colref[i])
+		s.Failures = fails
+		s.Skipped = skipped
+		v = append(v, s)
+	}
+	return v
+}
+
+// return the value of counter 'nm'
+func (o *Columns) counter(nm string) uint64 {
+	for _, c := range o.Counters {
+		if c.Name == nm {
+			return c.Val
+		}
+	}
+	return 0
+}
+
+// Summarize returns the stats of the samples in 'v'
+func Summarize(nm string, v []time.Duration) Stats {
+	st := Stats{
+		Name: nm,
+		N:    len(v),
+	}
+	if len(v) == 0 {
+		return st
+	}
+
+	s := slices.Clone(v)
+	slices.Sort(s)
+
+	var tot float64
+	for _, x := range s {
+		tot += float64(x)
+	}
+	mean := tot / float64(len(s))
+
+	var sq float64
+	for _, x := range s {
+		d := float64(x) - mean
+		sq += d * d
+	}
+
+	// p is in per-mille
+	pct := func(p int) time.Duration {
+		return s[(len(s)-1)*p/1000]
+	}
+
+	st.Min = s[0]
+	st.Mean = time.Duration(mean)
+	st.Stddev = time.Duration(math.Sqrt(sq / float64(len(s))))
+	st.P50 = pct(500)
+	st.P90 = pct(900)
+	st.P95 = pct(950)
+	st.P99 = pct(990)
+	st.P999 = pct(999)
+	st.Max = s[len(s)-1]
+	return st
+}
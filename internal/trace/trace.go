@@ -0,0 +1,226 @@
+// trace.go - traceroute to a destination
+//
+// A trace sends a few probes with increasing TTL to the destination
+// and records the address and rtt of every hop that answered. Probes
+// are either UDP datagrams (to port 33434 and up) or TCP SYNs to the
+// destination port. The probing itself is OS specific.
+
+package trace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	_DefaultMaxHops = 30
+	_DefaultQueries = 3
+	_DefaultTimeout = 1 * time.Second
+
+	// base port for UDP probes
+	_UdpPort = 33434
+)
+
+// Opts control how a trace is done
+type Opts struct {
+	// "udp" or "tcp"
+	Proto string
+
+	// destination port for tcp probes
+	Port int
+
+	// max TTL and probes per TTL
+	MaxHops int
+	Queries int
+
+	// time to wait for each probe
+	Timeout time.Duration
+}
+
+// Hop is the outcome of probing one TTL
+type Hop struct {
+	TTL int
+
+	// address of the responder; nil if nobody answered
+	Addr net.IP
+
+	Sent int
+	Rtt  []time.Duration
+}
+
+// Loss returns the fraction of probes that went unanswered
+func (h *Hop) Loss() float64 {
+	if h.Sent == 0 {
+		return 0
+	}
+	return float64(h.Sent-len(h.Rtt)) / float64(h.Sent)
+}
+
+// Avg returns the mean rtt of the answered probes
+func (h *Hop) Avg() time.Duration {
+	if len(h.Rtt) == 0 {
+		return 0
+	}
+
+	var tot time.Duration
+	for _, r := range h.Rtt {
+		tot += r
+	}
+	return tot / time.Duration(len(h.Rtt))
+}
+
+func (h *Hop) String() string {
+	if h.Addr == nil {
+		return fmt.Sprintf("%2d  *", h.TTL)
+	}
+	return fmt.Sprintf("%2d  %s  %s  loss %.0f%%", h.TTL, h.Addr, h.Avg(), 100*h.Loss())
+}
+
+// Path is the outcome of a trace
+type Path struct {
+	Dst   net.IP
+	Proto string
+	Start time.Time
+
+	// true if the destination answered
+	Reached bool
+
+	Hops []Hop
+}
+
+// Route returns the hop addresses; unknown hops are "*"
+func (p *Path) Route() []string {
+	r := make([]string, len(p.Hops))
+	for i := range p.Hops {
+		h := &p.Hops[i]
+		if h.Addr == nil {
+			r[i] = "*"
+		} else {
+			r[i] = h.Addr.String()
+		}
+	}
+	return r
+}
+
+func (p *Path) String() string {
+	return strings.Join(p.Route(), " ")
+}
+
+// Diff returns a description of the differences between the routes
+// in 'p' and 'q'. Hops that didn't answer in either trace are not
+// considered a change. An empty return means the paths are the same.
+func (p *Path) Diff(q *Path) []string {
+	var d []string
+
+	a, b := p.Route(), q.Route()
+	n := max(len(a), len(b))
+	for i := range n {
+		x, y := "-", "-"
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+
+		if x == y || x == "*" || y == "*" {
+			continue
+		}
+		d = append(d, fmt.Sprintf("hop %d: %s -> %s", i+1, x, y))
+	}
+
+	if p.Reached != q.Reached {
+		d = append(d, fmt.Sprintf("reached: %v -> %v", p.Reached, q.Reached))
+	}
+	return d
+}
+
+// Run traces the path to 'dst'
+func Run(ctx context.Context, dst net.IP, o Opts) (*Path, error) {
+	if dst = dst.To4(); dst == nil {
+		return nil, ErrIPv6
+	}
+
+	o.defaults()
+
+	var probe prober
+	switch o.Proto {
+	case "udp":
+		probe = udpProbe
+	case "tcp":
+		if o.Port <= 0 {
+			return nil, fmt.Errorf("trace: tcp needs a port")
+		}
+		probe = tcpProbe
+	default:
+		return nil, fmt.Errorf("trace: unknown proto '%s'", o.Proto)
+	}
+
+	p := &Path{
+		Dst:   dst,
+		Proto: o.Proto,
+		Start: time.Now().UTC(),
+		Hops:  make([]Hop, 0, o.MaxHops),
+	}
+
+	for ttl := 1; ttl <= o.MaxHops && !p.Reached; ttl++ {
+		h := Hop{
+			TTL: ttl,
+		}
+
+		for q := 0; q < o.Queries; q++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			r, err := probe(dst, ttl, q, &o)
+			if err != nil {
+				return nil, err
+			}
+
+			h.Sent++
+			if r.from == nil {
+				continue
+			}
+
+			h.Addr = r.from
+			h.Rtt = append(h.Rtt, r.rtt)
+			if r.reached {
+				p.Reached = true
+			}
+		}
+		p.Hops = append(p.Hops, h)
+	}
+	return p, nil
+}
+
+func (o *Opts) defaults() {
+	if o.MaxHops <= 0 {
+		o.MaxHops = _DefaultMaxHops
+	}
+	if o.Queries <= 0 {
+		o.Queries = _DefaultQueries
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = _DefaultTimeout
+	}
+}
+
+// outcome of a single probe; 'from' is nil if nothing came back
+type reply struct {
+	from    net.IP
+	rtt     time.Duration
+	reached bool
+}
+
+// send the q'th probe with 'ttl' to dst and wait for a reply
+type prober func(dst net.IP, ttl, q int, o *Opts) (reply, error)
+
+var (
+	ErrIPv6        = errors.New("trace: only IPv4 destinations are supported")
+	ErrUnsupported = errors.New("trace: not supported on this platform")
+)
@@ -0,0 +1,203 @@
+// trace_linux.go - unprivileged probes using IP_RECVERR
+//
+// Linux queues the ICMP errors (time exceeded, unreachable) for a
+// socket with IP_RECVERR set on its error queue along with the
+// address of the router that sent it. This works for UDP and for
+// TCP sockets in SYN_SENT; so we don't need raw sockets.
+
+//go:build linux
+
+package trace
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// sizeof struct sock_extended_err
+	_SizeofExtErr = 16
+
+	_IcmpUnreach  = 3
+	_IcmpTimeExcd = 11
+)
+
+func udpProbe(dst net.IP, ttl, q int, o *Opts) (reply, error) {
+	var r reply
+
+	fd, err := newSocket(unix.SOCK_DGRAM, ttl)
+	if err != nil {
+		return r, err
+	}
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrInet4{
+		Port: _UdpPort + (ttl-1)*o.Queries + q,
+	}
+	copy(sa.Addr[:], dst)
+
+	st := time.Now()
+	if err = unix.Sendto(fd, []byte("latmon"), 0, sa); err != nil {
+		return r, &net.OpError{Op: "sendto", Net: "udp", Err: err}
+	}
+
+	deadline := st.Add(o.Timeout)
+	for {
+		ev, err := wait(fd, unix.POLLERR, deadline)
+		if err != nil || ev == 0 {
+			return r, err
+		}
+
+		if r, ok := readErrQueue(fd, st); ok {
+			return r, nil
+		}
+	}
+}
+
+func tcpProbe(dst net.IP, ttl, q int, o *Opts) (reply, error) {
+	var r reply
+
+	fd, err := newSocket(unix.SOCK_STREAM|unix.SOCK_NONBLOCK, ttl)
+	if err != nil {
+		return r, err
+	}
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrInet4{
+		Port: o.Port,
+	}
+	copy(sa.Addr[:], dst)
+
+	st := time.Now()
+	err = unix.Connect(fd, sa)
+	if err != nil && !errors.Is(err, unix.EINPROGRESS) {
+		return r, &net.OpError{Op: "connect", Net: "tcp", Err: err}
+	}
+
+	deadline := st.Add(o.Timeout)
+	for {
+		ev, err := wait(fd, unix.POLLOUT|unix.POLLERR, deadline)
+		if err != nil || ev == 0 {
+			return r, err
+		}
+
+		// an icmp error from a router (or the destination)
+		if r, ok := readErrQueue(fd, st); ok {
+			return r, nil
+		}
+
+		// a SYN-ACK (the connect is done) or RST means we got to the
+		// destination; anything else on the error queue isn't an
+		// answer and the connect may still be in progress.
+		serr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			return r, &net.OpError{Op: "getsockopt", Net: "tcp", Err: err}
+		}
+
+		errno := unix.Errno(serr)
+		switch {
+		case errno == unix.ECONNREFUSED, errno == 0 && ev&unix.POLLOUT != 0:
+			r = reply{
+				from:    dst,
+				rtt:     time.Now().Sub(st),
+				reached: true,
+			}
+			return r, nil
+
+		case errno != 0:
+			// the connect failed without an icmp error we could
+			// read (eg EHOSTUNREACH); there's no answer and the
+			// socket stays in error
+			return r, nil
+		}
+	}
+}
+
+// make a socket that reports icmp errors and sends with 'ttl'
+func newSocket(typ, ttl int) (int, error) {
+	fd, err := unix.Socket(unix.AF_INET, typ|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, &net.OpError{Op: "socket", Err: err}
+	}
+
+	if err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_RECVERR, 1); err == nil {
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TTL, ttl)
+	}
+
+	if err != nil {
+		unix.Close(fd)
+		return -1, &net.OpError{Op: "setsockopt", Err: err}
+	}
+	return fd, nil
+}
+
+// wait till 'fd' has one of 'ev' or we hit the deadline and return
+// the events it has; none on timeout.
+func wait(fd int, ev int16, deadline time.Time) (int16, error) {
+	pfd := []unix.PollFd{{Fd: int32(fd), Events: ev}}
+	for {
+		ms := time.Until(deadline).Milliseconds()
+		if ms <= 0 {
+			return 0, nil
+		}
+
+		n, err := unix.Poll(pfd, int(ms))
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return 0, &net.OpError{Op: "poll", Err: err}
+		}
+		if n > 0 {
+			return pfd[0].Revents, nil
+		}
+	}
+}
+
+// read an icmp error off the socket's error queue
+func readErrQueue(fd int, st time.Time) (reply, bool) {
+	var r reply
+	var buf [64]byte
+	var oob [256]byte
+
+	_, oobn, _, _, err := unix.Recvmsg(fd, buf[:], oob[:], unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+	if err != nil {
+		return r, false
+	}
+	rtt := time.Now().Sub(st)
+
+	cm, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return r, false
+	}
+
+	for _, m := range cm {
+		if m.Header.Level != unix.IPPROTO_IP || m.Header.Type != unix.IP_RECVERR {
+			continue
+		}
+
+		// struct sock_extended_err followed by the offender's
+		// struct sockaddr_in
+		d := m.Data
+		if len(d) < _SizeofExtErr+8 || d[4] != unix.SO_EE_ORIGIN_ICMP {
+			continue
+		}
+
+		typ := d[5]
+		if typ != _IcmpTimeExcd && typ != _IcmpUnreach {
+			continue
+		}
+
+		sin := d[_SizeofExtErr:]
+		r = reply{
+			from:    net.IPv4(sin[4], sin[5], sin[6], sin[7]),
+			rtt:     rtt,
+			reached: typ == _IcmpUnreach,
+		}
+		return r, true
+	}
+	return r, false
+}
@@ -0,0 +1,17 @@
+// trace_other.go - probes for platforms we don't support yet
+
+//go:build !linux
+
+package trace
+
+import (
+	"net"
+)
+
+func udpProbe(dst net.IP, ttl, q int, o *Opts) (reply, error) {
+	return reply{}, ErrUnsupported
+}
+
+func tcpProbe(dst net.IP, ttl, q int, o *Opts) (reply, error) {
+	return reply{}, ErrUnsupported
+}
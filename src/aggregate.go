@@ -0,0 +1,448 @@
+// aggregate.go - histogram aggregation of the samples
+//
+// In aggregate mode, a target keeps the raw samples only for the
+// current time bucket (eg a minute); at the end of the bucket they are
+// folded into a histogram per column. The histograms of each bucket
+// are appended to <batch>-hist.csv; the batch and daily summaries and
+// charts are made by merging the histograms.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencoff/latmon/internal/hdr"
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+type aggregator struct {
+	width time.Duration
+
+	// start of the current bucket
+	bstart time.Time
+
+	// the buckets folded in the current batch
+	batch *aggSet
+
+	// the folded buckets not yet appended to their hist files; they
+	// are written out of the lock (see writeHists)
+	unwritten []histRow
+}
+
+// a bucket for hist file 'fn'
+type histRow struct {
+	fn    string
+	t     time.Time
+	names []string
+	hists []*hdr.Histogram
+}
+
+// aggSet is the merged histograms of a batch or a day and the
+// percentiles of each bucket in it (for the chart)
+type aggSet struct {
+	name  string
+	start time.Time
+
+	// the start of the last batch merged into this set
+	last time.Time
+
+	// samples in this set
+	n int
+
+	names []string
+	hists []*hdr.Histogram
+	rows  []aggRow
+
+	counters []plot.Counter
+	marks    []plot.Mark
+}
+
+// the percentiles of each column in a bucket
+type aggRow struct {
+	t     time.Time
+	names []string
+	pct   [][3]time.Duration
+}
+
+// the percentiles charted for each bucket
+var aggPct = [3]struct {
+	nm string
+	q  float64
+}{
+	{"p50", 0.50},
+	{"p99", 0.99},
+	{"max", 1.0},
+}
+
+const _HistHeader = "time,phase,count,min,max,sum,sumsq,buckets"
+
+func newAggregator(width time.Duration, name string, now time.Time) *aggregator {
+	return &aggregator{
+		width:  width,
+		bstart: now,
+		batch:  newAggSet(name, now),
+	}
+}
+
+func newAggSet(name string, start time.Time) *aggSet {
+	return &aggSet{
+		name:  name,
+		start: start,
+	}
+}
+
+// return the histogram for column 'nm'; make one if needed
+func (a *aggSet) hist(nm string) *hdr.Histogram {
+	i := slices.Index(a.names, nm)
+	if i < 0 {
+		a.names = append(a.names, nm)
+		a.hists = append(a.hists, hdr.New())
+		i = len(a.names) - 1
+	}
+	return a.hists[i]
+}
+
+// add a bucket of 'n' samples starting at 't'
+func (a *aggSet) record(t time.Time, n int, names []string, hists []*hdr.Histogram) {
+	r := aggRow{
+		t:     t,
+		names: names,
+		pct:   make([][3]time.Duration, len(hists)),
+	}
+
+	for i, h := range hists {
+		a.hist(names[i]).Merge(h)
+		for j, p := range aggPct {
+			r.pct[i][j] = h.Quantile(p.q)
+		}
+	}
+
+	a.rows = append(a.rows, r)
+	a.n += n
+}
+
+// merge the set 'b' into 'a'
+func (a *aggSet) merge(b *aggSet) {
+	if a.n == 0 {
+		a.start = b.start
+	}
+	a.last = b.start
+
+	for i, nm := range b.names {
+		a.hist(nm).Merge(b.hists[i])
+	}
+
+	for _, k := range b.marks {
+		k.Index += len(a.rows)
+		a.marks = append(a.marks, k)
+	}
+
+	a.rows = append(a.rows, b.rows...)
+	a.n += b.n
+	a.counters = addCounters(a.counters, b.counters)
+}
+
+// return the stats of each column in the set
+func (a *aggSet) summary() []plot.Stats {
+	var fails, skipped uint64
+	for _, c := range a.counters {
+		switch c.Name {
+		case "errors":
+			fails = c.Val
+		case "skipped":
+			skipped = c.Val
+		}
+	}
+
+	v := make([]plot.Stats, 0, len(a.names))
+	for i, nm := range a.names {
+		s := histStats(nm, a.hists[i])
+		s.Failures = fails
+		s.Skipped = skipped
+		v = append(v, s)
+	}
+	return v
+}
+
+// return the bucket percentiles as columns for charting; a column
+// missing from a bucket is charted as zero.
+func (a *aggSet) columns() plot.Columns {
+	o := plot.Columns{
+		Name:     a.name,
+		Start:    a.start,
+		Minlen:   len(a.rows),
+		Times:    make([]time.Time, len(a.rows)),
+		Counters: a.counters,
+		Marks:    a.marks,
+	}
+
+	for _, nm := range a.names {
+		for _, p := range aggPct {
+			o.Names = append(o.Names, nm+"-"+p.nm)
+			o.Colref = append(o.Colref, make([]time.Duration, len(a.rows)))
+		}
+	}
+
+	for i := range a.rows {
+		r := &a.rows[i]
+		o.Times[i] = r.t
+		for j, nm := range r.names {
+			k := slices.Index(a.names, nm) * len(aggPct)
+			for x := range aggPct {
+				o.Colref[k+x][i] = r.pct[j][x]
+			}
+		}
+	}
+	return o
+}
+
+func (a *aggSet) reset(start time.Time) {
+	a.start = start
+	a.last = time.Time{}
+	a.n = 0
+	a.names = a.names[:0]
+	a.hists = a.hists[:0]
+	a.rows = a.rows[:0]
+	a.counters = nil
+	a.marks = nil
+}
+
+// summarize histogram 'h' of column 'nm'
+func histStats(nm string, h *hdr.Histogram) plot.Stats {
+	return plot.Stats{
+		Name:   nm,
+		N:      int(h.Count()),
+		Min:    h.Min(),
+		Mean:   h.Mean(),
+		Stddev: h.Stddev(),
+		P50:    h.Quantile(0.50),
+		P90:    h.Quantile(0.90),
+		P95:    h.Quantile(0.95),
+		P99:    h.Quantile(0.99),
+		P999:   h.Quantile(0.999),
+		Max:    h.Max(),
+	}
+}
+
+// return true if the current bucket of 'hs' is done
+func (a *aggregator) due(hs *hostStats, now time.Time) bool {
+	return now.Sub(a.bstart) >= a.width || hs.samples() >= hs.batchsize
+}
+
+// return the stats of the current batch: the folded buckets and the
+// raw samples of the current bucket. This is called with the lock (on
+// hs) held.
+func (a *aggregator) status(hs *hostStats) []ColumnStats {
+	cur := newAggSet(hs.name, a.bstart)
+	for i, nm := range a.batch.names {
+		cur.hist(nm).Merge(a.batch.hists[i])
+	}
+
+	hs.each(func(nm string, v []time.Duration) {
+		h := cur.hist(nm)
+		for _, x := range v {
+			h.Record(x)
+		}
+	})
+
+	var cs []ColumnStats
+	for _, s := range cur.summary() {
+		cs = append(cs, toColumnStats(s))
+	}
+	return cs
+}
+
+// fold the raw samples of the current bucket into histograms. This
+// is called with the lock (on hs) held.
+func (m *Measurer) fold(hs *hostStats) {
+	a := hs.agg
+	now := time.Now().UTC()
+
+	n := hs.samples()
+	var names []string
+	var hists []*hdr.Histogram
+	for _, c := range hs.columns() {
+		v := *c.v
+		if len(v) == 0 {
+			continue
+		}
+
+		h := hdr.New()
+		for _, x := range v {
+			h.Record(x)
+		}
+		names = append(names, c.nm)
+		hists = append(hists, h)
+		*c.v = v[:0]
+	}
+	hs.times = hs.times[:0]
+	clear(hs.seen)
+
+	t := a.bstart
+	a.bstart = now
+	if n == 0 {
+		return
+	}
+
+	a.batch.record(t, n, names, hists)
+	if hs.outputs.Has(OutputCsv) {
+		fn := path.Join(hs.statsDir, hs.start.Format(_BatchFmt)+"-hist.csv")
+		a.unwritten = append(a.unwritten, histRow{fn, t, names, hists})
+
+		m.flushing.Add(1)
+		go func() {
+			hs.flushMu.Lock()
+			m.writeHists(hs)
+			hs.flushMu.Unlock()
+			m.flushing.Done()
+		}()
+	}
+}
+
+// append the folded buckets of 'hs' to their hist files; in the order
+// they were folded. This is called with hs.flushMu held.
+func (m *Measurer) writeHists(hs *hostStats) {
+	hs.Lock()
+	v := hs.agg.unwritten
+	hs.agg.unwritten = nil
+	hs.Unlock()
+
+	for _, r := range v {
+		if err := appendHist(r.fn, r.t, r.names, r.hists); err != nil {
+			m.log.Warn("%s", err)
+		}
+	}
+}
+
+// flush the histograms of this batch to disk and generate the charts.
+// This is called with the lock (on hs) held.
+func (m *Measurer) flushAgg(hs *hostStats) {
+	m.fold(hs)
+
+	a := hs.agg
+	o := a.batch
+	o.counters = hs.counters
+	o.marks = hs.marks
+	hs.counters = nil
+	hs.marks = nil
+
+	hs.start = time.Now().UTC()
+	a.batch = newAggSet(hs.name, hs.start)
+
+	m.flushing.Add(1)
+	go m.asyncFlushAgg(o, hs)
+}
+
+func (m *Measurer) asyncFlushAgg(o *aggSet, hs *hostStats) {
+	hs.flushMu.Lock()
+	defer hs.flushMu.Unlock()
+
+	// the last buckets of the batch
+	m.writeHists(hs)
+
+	fname := o.start.Format(_BatchFmt)
+	m.log.Info("batch-flush: %s: [%s] %d samples in %d buckets [cols: %s] %s", o.name, fname,
+		o.n, len(o.rows), strings.Join(o.names, ","), plotCounters(o.counters))
+
+	if err := writeAgg(o, hs, fname, nil); err != nil {
+		m.log.Warn("%s", err)
+	}
+
+	m.updateDailyAgg(o, hs)
+	m.rollups(hs, o.start, time.Now().UTC())
+	m.updateIndex(hs)
+	m.flushing.Done()
+}
+
+func (m *Measurer) updateDailyAgg(o *aggSet, hs *hostStats) {
+	m.Lock()
+	ds, ok := m.perHostAgg[hs.name]
+	if !ok {
+		ds = newAggSet(hs.name, o.start)
+		m.perHostAgg[hs.name] = ds
+	}
+	m.Unlock()
+
+	ds.merge(o)
+	if ds.n >= hs.perDay {
+		m.flushDailyAgg(ds, hs)
+	}
+}
+
+// write the daily histograms in 'ds' and reset it
+func (m *Measurer) flushDailyAgg(ds *aggSet, hs *hostStats) {
+	fname := dailyName(hs, ds.start)
+	m.log.Info("daily-flush: %s: [%s] %d samples in %d buckets [cols: %s] %s", ds.name, fname,
+		ds.n, len(ds.rows), strings.Join(ds.names, ","), plotCounters(ds.counters))
+
+	if hs.outputs.Has(OutputCsv) {
+		fn := path.Join(hs.statsDir, fname+"-hist.csv")
+		if err := appendHist(fn, ds.start, ds.names, ds.hists); err != nil {
+			m.log.Warn("%s", err)
+		}
+
+		fn = path.Join(hs.statsDir, fname+"-errors.csv")
+		if err := writeDailyErrors(hs.statsDir, ds.start, ds.last, fn); err != nil {
+			m.log.Warn("%s", err)
+		}
+	}
+
+	if err := writeAgg(ds, hs, fname, m.reportSLOs(hs, fname)); err != nil {
+		m.log.Warn("%s", err)
+	}
+	ds.reset(time.Time{})
+	m.updateIndex(hs)
+}
+
+// write the summary and chart of 'o'; the state of the SLOs (if any)
+// is shown below the chart.
+func writeAgg(o *aggSet, hs *hostStats, fname string, slos []plot.SLOStatus) error {
+	if hs.outputs.Has(OutputCsv) {
+		fn := path.Join(hs.statsDir, fname+"-summary.csv")
+		if err := writeSummary(o.summary(), fn); err != nil {
+			return err
+		}
+	}
+
+	if hs.outputs.Any(_ChartOutputs) && len(o.rows) > 0 {
+		c := o.columns()
+		c.Labels = hs.labels
+		c.SLOs = slos
+		return writeChart(&c, hs.outputs, path.Join(hs.chartDir, fname+".html"))
+	}
+	return nil
+}
+
+// append a row per histogram to 'fn'
+func appendHist(fn string, t time.Time, names []string, hists []*hdr.Histogram) error {
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", fn, err)
+	}
+	defer fd.Close()
+
+	if st, err := fd.Stat(); err == nil && st.Size() == 0 {
+		fmt.Fprintf(fd, "%s\n", _HistHeader)
+	}
+
+	ts := t.Format(time.RFC3339Nano)
+	for i, h := range hists {
+		sum, sumsq := h.Sums()
+		_, err = fmt.Fprintf(fd, "%s,%s,%d,%d,%d,%.0f,%g,%s\n", ts, names[i], h.Count(),
+			h.Min(), h.Max(), sum, sumsq, h)
+		if err != nil {
+			return fmt.Errorf("write %s: %w", fn, err)
+		}
+	}
+	return nil
+}
+
+func plotCounters(c []plot.Counter) string {
+	o := plot.Columns{Counters: c}
+	return o.CounterString()
+}
@@ -0,0 +1,809 @@
+// alert.go - alert rules and their notifications
+//
+// A rule is a condition on a metric of some targets over a sliding
+// window of their samples:
+//
+//	p95(e2e) > 300ms        a percentile, mean, min or max of a phase
+//	availability < 99%      successful probes over all probes
+//	cert-expiry < 14d       time until the leaf cert expires (tls)
+//	no-data > 2m            time since the last successful sample
+//	shifts(tcp) > 0         spikes or level shifts found in a phase
+//	                        (any phase by default; see anomaly.go)
+//
+// The alerter keeps a state for each rule and target. A condition
+// that holds is pending; it fires once it has held for 'for'. A
+// firing alert resolves when the value is back past 'clear' (the
+// threshold by default) so that a value hovering at the threshold
+// doesn't flap. The receivers are told when an alert fires (and every
+// 'repeat' while it does) and when it resolves; never twice for the
+// same state.
+//
+// A receiver is a webhook (the alert is POSTed as JSON) or a command
+// (run with the alert in LATMON_ALERT_* env vars and as JSON on its
+// stdin). 'latmon test-alerts' sends a test alert to each receiver.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/plot"
+	"github.com/opencoff/pflag"
+)
+
+const (
+	// interval between evaluations of the rules
+	_AlertEvery = 10 * time.Second
+
+	// default window of the rules and time limit of the receivers
+	_AlertWindow  = 5 * time.Minute
+	_AlertTimeout = 10 * time.Second
+)
+
+// metric(phase) < value or metric(phase) > value
+var alertWhenRe = regexp.MustCompile(`^\s*([a-z0-9.-]+)\s*(?:\(\s*([a-z0-9-]+)\s*\))?\s*([<>])\s*(\S+)\s*$`)
+
+// the metrics of a phase
+var latencyMetrics = []string{"min", "mean", "max", "p50", "p90", "p95", "p99", "p99.9"}
+
+// Alerts is the set of alert rules and where they're sent
+type Alerts struct {
+	Rules     []Rule
+	Receivers []Receiver
+}
+
+// Rule is an alert rule (see alert.go)
+type Rule struct {
+	Name string
+
+	// targets the rule applies to; all if empty
+	Targets []string
+
+	When   string
+	Clear  string
+	Window time.Duration
+	For    time.Duration
+	Repeat time.Duration
+
+	Receivers []string
+
+	// parsed from When and Clear
+	metric string
+	phase  string
+	op     byte
+	thr    float64
+	clr    float64
+}
+
+// Receiver is where alerts are sent: a webhook or a command
+type Receiver struct {
+	Name    string
+	Webhook string
+	Headers map[string]string
+	Exec    []string
+	Timeout time.Duration
+}
+
+// Validate parses the condition of the rule and checks the rest; on
+// error, it also returns the name of the setting at fault.
+func (r *Rule) Validate() (string, error) {
+	if len(r.Name) == 0 {
+		return "name", fmt.Errorf("missing rule name")
+	}
+
+	m := alertWhenRe.FindStringSubmatch(strings.ToLower(r.When))
+	if m == nil {
+		return "when", fmt.Errorf("%s: invalid condition '%s'", r.Name, r.When)
+	}
+	r.metric, r.phase, r.op = m[1], m[2], m[3][0]
+
+	switch {
+	case slices.Contains(latencyMetrics, r.metric):
+		if len(r.phase) == 0 {
+			r.phase = "e2e"
+		}
+		if r.phase != "e2e" && !isPhase(r.phase) {
+			return "when", fmt.Errorf("%s: unknown phase '%s'", r.Name, r.phase)
+		}
+
+	case r.metric == "spikes", r.metric == "shifts":
+		if len(r.phase) > 0 && !isPhase(r.phase) {
+			return "when", fmt.Errorf("%s: unknown phase '%s'", r.Name, r.phase)
+		}
+
+	case r.metric == "availability", r.metric == "cert-expiry", r.metric == "no-data":
+		if len(r.phase) > 0 {
+			return "when", fmt.Errorf("%s: %s has no phase", r.Name, r.metric)
+		}
+
+	default:
+		return "when", fmt.Errorf("%s: unknown metric '%s'", r.Name, r.metric)
+	}
+
+	var err error
+	if r.thr, err = r.parseValue(m[4]); err != nil {
+		return "when", fmt.Errorf("%s: %w", r.Name, err)
+	}
+
+	r.clr = r.thr
+	if len(r.Clear) > 0 {
+		if r.clr, err = r.parseValue(r.Clear); err != nil {
+			return "clear", fmt.Errorf("%s: %w", r.Name, err)
+		}
+
+		// the alert must be able to resolve
+		if (r.op == '>' && r.clr > r.thr) || (r.op == '<' && r.clr < r.thr) {
+			return "clear", fmt.Errorf("%s: clear value %s is past the threshold", r.Name, r.Clear)
+		}
+	}
+
+	if r.Window == 0 {
+		r.Window = _AlertWindow
+	}
+	if r.Window < 0 || r.For < 0 || r.Repeat < 0 {
+		return "for", fmt.Errorf("%s: negative duration", r.Name)
+	}
+	if len(r.Receivers) == 0 {
+		return "receivers", fmt.Errorf("%s: no receivers", r.Name)
+	}
+	return "", nil
+}
+
+// parse a value of the metric of the rule: a fraction (or percent)
+// for availability, a count for anomalies and a duration for the
+// rest. Durations may be in days (14d) or weeks (2w).
+func (r *Rule) parseValue(s string) (float64, error) {
+	if r.counts() {
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid count '%s'", s)
+		}
+		return float64(n), nil
+	}
+
+	if r.metric == "availability" {
+		f, err := parseFraction(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid availability '%s'", s)
+		}
+		return f, nil
+	}
+
+	d, err := ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return float64(d), nil
+}
+
+// parse a fraction in [0, 1] or a percentage (99.9%)
+func parseFraction(s string) (float64, error) {
+	var f float64
+	var err error
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		// 99.9e-2 is closer to 0.999 than 99.9/100
+		f, err = strconv.ParseFloat(p+"e-2", 64)
+	} else {
+		f, err = strconv.ParseFloat(s, 64)
+	}
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("invalid fraction '%s'", s)
+	}
+	return f, nil
+}
+
+// return true if 'v' is past 'thr' in the direction of the rule
+func (r *Rule) past(v, thr float64) bool {
+	if r.op == '>' {
+		return v > thr
+	}
+	return v < thr
+}
+
+// return true if the metric of the rule is a count of anomalies
+func (r *Rule) counts() bool {
+	return r.metric == "spikes" || r.metric == "shifts"
+}
+
+// return the printable form of 'v'
+func (r *Rule) format(v float64) string {
+	if r.counts() {
+		return fmt.Sprintf("%d", int(v))
+	}
+	if r.metric == "availability" {
+		return fmt.Sprintf("%.3f%%", 100*v)
+	}
+	return round(time.Duration(v)).String()
+}
+
+// Validate checks the receiver; on error, it also returns the name of
+// the setting at fault.
+func (rc *Receiver) Validate() (string, error) {
+	if len(rc.Name) == 0 {
+		return "name", fmt.Errorf("missing receiver name")
+	}
+
+	switch {
+	case len(rc.Webhook) > 0 && len(rc.Exec) > 0:
+		return "exec", fmt.Errorf("%s: both webhook and exec", rc.Name)
+
+	case len(rc.Webhook) > 0:
+		u, err := url.Parse(rc.Webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return "webhook", fmt.Errorf("%s: invalid webhook url '%s'", rc.Name, rc.Webhook)
+		}
+
+	case len(rc.Exec) > 0:
+		if len(rc.Exec[0]) == 0 {
+			return "exec", fmt.Errorf("%s: empty command", rc.Name)
+		}
+
+	default:
+		return "webhook", fmt.Errorf("%s: needs a webhook or exec", rc.Name)
+	}
+
+	if rc.Timeout == 0 {
+		rc.Timeout = _AlertTimeout
+	}
+	if rc.Timeout < 0 {
+		return "timeout", fmt.Errorf("%s: negative timeout", rc.Name)
+	}
+	return "", nil
+}
+
+// Alert is a notification of a change in the state of an alert
+type Alert struct {
+	Status  string    `json:"status"`
+	Rule    string    `json:"rule"`
+	Target  string    `json:"target"`
+	When    string    `json:"when"`
+	Value   string    `json:"value"`
+	Since   time.Time `json:"since"`
+	Time    time.Time `json:"time"`
+	Summary string    `json:"summary"`
+
+	receivers []string
+}
+
+// AlertState is a pending or firing alert
+type AlertState struct {
+	Rule   string    `json:"rule"`
+	Target string    `json:"target"`
+	State  string    `json:"state"`
+	Value  string    `json:"value"`
+	Since  time.Time `json:"since"`
+
+	// last time the receivers were told
+	notified time.Time
+}
+
+type alerter struct {
+	sync.Mutex
+	al Alerts
+
+	// the longest window of the rules
+	window time.Duration
+
+	// recent samples of each target; the time of its last good sample
+	// and the expiry of its cert
+	recent map[string][]Sample
+	last   map[string]time.Time
+	certs  map[string]time.Time
+
+	// rule/target -> state
+	states map[string]*AlertState
+
+	targets func() []string
+	log     logger.Logger
+
+	done  chan struct{}
+	wg    sync.WaitGroup
+	sends sync.WaitGroup
+}
+
+func newAlerter(al Alerts, targets func() []string, log logger.Logger) *alerter {
+	a := &alerter{
+		recent:  make(map[string][]Sample),
+		last:    make(map[string]time.Time),
+		certs:   make(map[string]time.Time),
+		states:  make(map[string]*AlertState),
+		targets: targets,
+		log:     log,
+		done:    make(chan struct{}),
+	}
+	a.Set(al)
+
+	a.wg.Add(1)
+	go a.run()
+	return a
+}
+
+// Set changes the rules and receivers. The states of the rules that
+// remain are kept.
+func (a *alerter) Set(al Alerts) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.al = al
+	a.window = 0
+	for i := range al.Rules {
+		a.window = max(a.window, al.Rules[i].Window)
+	}
+
+	for k, st := range a.states {
+		if !slices.ContainsFunc(al.Rules, func(r Rule) bool { return r.Name == st.Rule }) {
+			delete(a.states, k)
+		}
+	}
+}
+
+// Stop stops the alerter and waits for the notifications in flight
+func (a *alerter) Stop() {
+	close(a.done)
+	a.wg.Wait()
+	a.sends.Wait()
+}
+
+// observe is the Measurer sample hook; it must not block
+func (a *alerter) observe(s *Sample) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.window == 0 {
+		return
+	}
+
+	// with concurrent probes, the samples come in the order the
+	// probes finish; keep them in time order
+	v := a.recent[s.Target]
+	i := len(v)
+	for i > 0 && v[i-1].Time.After(s.Time) {
+		i--
+	}
+	v = slices.Insert(v, i, *s)
+
+	cut := v[len(v)-1].Time.Add(-a.window)
+	i = 0
+	for i < len(v) && v[i].Time.Before(cut) {
+		i++
+	}
+	a.recent[s.Target] = v[i:]
+
+	if s.Err == nil && len(s.Names) > 0 && s.Time.After(a.last[s.Target]) {
+		a.last[s.Target] = s.Time
+	}
+	if !s.NotAfter.IsZero() {
+		a.certs[s.Target] = s.NotAfter
+	}
+}
+
+// List returns the pending and firing alerts
+func (a *alerter) List() []AlertState {
+	a.Lock()
+	defer a.Unlock()
+
+	v := make([]AlertState, 0, len(a.states))
+	for _, st := range a.states {
+		v = append(v, *st)
+	}
+	slices.SortFunc(v, func(x, y AlertState) int {
+		if c := strings.Compare(x.Rule, y.Rule); c != 0 {
+			return c
+		}
+		return strings.Compare(x.Target, y.Target)
+	})
+	return v
+}
+
+func (a *alerter) run() {
+	defer a.wg.Done()
+
+	tick := time.NewTicker(_AlertEvery)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			a.eval(time.Now())
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// evaluate the rules for each target and notify the changes
+func (a *alerter) eval(now time.Time) {
+	targets := a.targets()
+
+	a.Lock()
+	var notes []Alert
+	for i := range a.al.Rules {
+		r := &a.al.Rules[i]
+		for _, t := range targets {
+			if len(r.Targets) == 0 || slices.Contains(r.Targets, t) {
+				if n, ok := a.step(r, t, now); ok {
+					notes = append(notes, n)
+				}
+			}
+		}
+	}
+
+	// forget the targets that are gone
+	for nm := range a.recent {
+		if !slices.Contains(targets, nm) {
+			delete(a.recent, nm)
+			delete(a.last, nm)
+			delete(a.certs, nm)
+		}
+	}
+	for k, st := range a.states {
+		if !slices.Contains(targets, st.Target) {
+			delete(a.states, k)
+		}
+	}
+	a.Unlock()
+
+	for i := range notes {
+		a.notify(&notes[i])
+	}
+}
+
+// move the state of rule 'r' for target 't' along; return the
+// notification to send (if any). This is called with the lock held.
+func (a *alerter) step(r *Rule, t string, now time.Time) (Alert, bool) {
+	// a new target hasn't been silent for long
+	if _, ok := a.last[t]; !ok {
+		a.last[t] = now
+	}
+
+	key := r.Name + "/" + t
+	st := a.states[key]
+	v, ok := a.value(r, t, now)
+	if !ok {
+		// no samples to judge by; keep the state
+		return Alert{}, false
+	}
+
+	switch {
+	case st == nil:
+		if !r.past(v, r.thr) {
+			return Alert{}, false
+		}
+		st = &AlertState{Rule: r.Name, Target: t, State: "pending", Since: now}
+		a.states[key] = st
+
+	case st.State == "pending":
+		if !r.past(v, r.thr) {
+			delete(a.states, key)
+			return Alert{}, false
+		}
+
+	default:
+		st.Value = r.format(v)
+		if !r.past(v, r.clr) {
+			delete(a.states, key)
+			return a.alert(r, st, "resolved", now), true
+		}
+		if r.Repeat > 0 && now.Sub(st.notified) >= r.Repeat {
+			st.notified = now
+			return a.alert(r, st, "firing", now), true
+		}
+		return Alert{}, false
+	}
+
+	st.Value = r.format(v)
+	if now.Sub(st.Since) >= r.For {
+		st.State = "firing"
+		st.notified = now
+		return a.alert(r, st, "firing", now), true
+	}
+	return Alert{}, false
+}
+
+// return the value of the metric of 'r' for target 't'; false if
+// there are no samples to compute it from. This is called with the
+// lock held.
+func (a *alerter) value(r *Rule, t string, now time.Time) (float64, bool) {
+	switch r.metric {
+	case "no-data":
+		return float64(now.Sub(a.last[t])), true
+
+	case "cert-expiry":
+		na, ok := a.certs[t]
+		return float64(na.Sub(now)), ok
+	}
+
+	cut := now.Add(-r.Window)
+	var vals []time.Duration
+	var good, bad, events int
+	for _, s := range a.recent[t] {
+		if s.Time.Before(cut) {
+			continue
+		}
+		for _, e := range s.Anomalies {
+			if r.matches(&e) {
+				events++
+			}
+		}
+		if s.Err != nil {
+			bad++
+			continue
+		}
+
+		good++
+		if x, ok := s.value(r.phase); ok {
+			vals = append(vals, x)
+		}
+	}
+
+	if r.counts() {
+		return float64(events), true
+	}
+
+	if r.metric == "availability" {
+		if good+bad == 0 {
+			return 0, false
+		}
+		return float64(good) / float64(good+bad), true
+	}
+
+	if len(vals) == 0 {
+		return 0, false
+	}
+
+	st := plot.Summarize(r.phase, vals)
+	var d time.Duration
+	switch r.metric {
+	case "min":
+		d = st.Min
+	case "mean":
+		d = st.Mean
+	case "max":
+		d = st.Max
+	case "p50":
+		d = st.P50
+	case "p90":
+		d = st.P90
+	case "p95":
+		d = st.P95
+	case "p99":
+		d = st.P99
+	case "p99.9":
+		d = st.P999
+	}
+	return float64(d), true
+}
+
+// return true if 'e' counts towards the metric of 'r'
+func (r *Rule) matches(e *Anomaly) bool {
+	if len(r.phase) > 0 && r.phase != e.Phase {
+		return false
+	}
+	if r.metric == "spikes" {
+		return e.Kind == "spike"
+	}
+	return e.Kind != "spike"
+}
+
+// make the notification of 'st' with 'status'
+func (a *alerter) alert(r *Rule, st *AlertState, status string, now time.Time) Alert {
+	return Alert{
+		Status:    status,
+		Rule:      r.Name,
+		Target:    st.Target,
+		When:      r.When,
+		Value:     st.Value,
+		Since:     st.Since,
+		Time:      now,
+		Summary:   fmt.Sprintf("%s: %s: %s is %s (%s)", st.Target, r.Name, r.When, status, st.Value),
+		receivers: r.Receivers,
+	}
+}
+
+// send 'n' to its receivers in the background
+func (a *alerter) notify(n *Alert) {
+	a.log.Info("alert: %s", n.Summary)
+
+	a.Lock()
+	var rcv []Receiver
+	for _, rc := range a.al.Receivers {
+		if slices.Contains(n.receivers, rc.Name) {
+			rcv = append(rcv, rc)
+		}
+	}
+	a.Unlock()
+
+	for i := range rcv {
+		rc := &rcv[i]
+		a.sends.Add(1)
+		go func() {
+			defer a.sends.Done()
+			if err := rc.Send(n); err != nil {
+				a.log.Warn("alert: %s: %s", rc.Name, err)
+			}
+		}()
+	}
+}
+
+// Send delivers the alert 'n' to the receiver
+func (rc *Receiver) Send(n *Alert) error {
+	// the conditions have < and >
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(n); err != nil {
+		return err
+	}
+	b := buf.Bytes()
+
+	ctx, cancel := context.WithTimeout(context.Background(), rc.Timeout)
+	defer cancel()
+
+	if len(rc.Webhook) > 0 {
+		req, err := http.NewRequestWithContext(ctx, "POST", rc.Webhook, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range rc.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook %s: %s", rc.Webhook, resp.Status)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, rc.Exec[0], rc.Exec[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(),
+		"LATMON_ALERT_STATUS="+n.Status,
+		"LATMON_ALERT_RULE="+n.Rule,
+		"LATMON_ALERT_TARGET="+n.Target,
+		"LATMON_ALERT_WHEN="+n.When,
+		"LATMON_ALERT_VALUE="+n.Value,
+		"LATMON_ALERT_SINCE="+n.Since.Format(time.RFC3339),
+		"LATMON_ALERT_TIME="+n.Time.Format(time.RFC3339),
+		"LATMON_ALERT_SUMMARY="+n.Summary,
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec %s: %w: %s", rc.Exec[0], err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// return the value of 'phase' in the sample; e2e is the end-to-end
+// latency of the probe.
+func (s *Sample) value(phase string) (time.Duration, bool) {
+	if phase == "e2e" {
+		if s.E2e > 0 {
+			return s.E2e, true
+		}
+		return s.e2e()
+	}
+	if i := slices.Index(s.Names, phase); i >= 0 {
+		return s.Vals[i], true
+	}
+	return 0, false
+}
+
+// return the end-to-end latency of a stored sample (which doesn't
+// have E2e) from its phases; as the workers work it out.
+func (s *Sample) e2e() (time.Duration, bool) {
+	for _, nm := range []string{"https", "streams", "rtt"} {
+		if i := slices.Index(s.Names, nm); i >= 0 {
+			return s.Vals[i], true
+		}
+	}
+
+	// tls: the handshake and all that goes before it
+	if slices.Contains(s.Names, "tls") {
+		var d time.Duration
+		for i, nm := range s.Names {
+			switch nm {
+			case "dns", "tcp", "starttls", "tls":
+				d += s.Vals[i]
+			}
+		}
+		return d, true
+	}
+
+	if i := slices.Index(s.Names, "tcp"); i >= 0 {
+		return s.Vals[i], true
+	}
+	return 0, false
+}
+
+// latmon test-alerts -c FILE [RECEIVER..]
+func testAlertsMain(args []string) {
+	var help bool
+	var cfgFile string
+
+	fs := pflag.NewFlagSet("test-alerts", pflag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help message and exit")
+	fs.StringVarP(&cfgFile, "config", "c", "", "Read the alert receivers from config file `F`")
+
+	err := fs.Parse(args)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	args = fs.Args()
+	if help || len(cfgFile) == 0 {
+		fmt.Printf(`%s test-alerts: send a test alert to the alert receivers
+
+Usage: %s test-alerts -c FILE [RECEIVER..]
+
+Sends a test alert to the named receivers of the config file (or all
+of them) and reports the result of each.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	base := defaultPingOpts()
+	c, err := ReadConfig(cfgFile, &base)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	for _, nm := range args {
+		if !slices.ContainsFunc(c.Alerts.Receivers, func(rc Receiver) bool { return rc.Name == nm }) {
+			Die("unknown receiver '%s'", nm)
+		}
+	}
+
+	now := time.Now().UTC()
+	n := Alert{
+		Status:  "test",
+		Rule:    "test",
+		Target:  "test",
+		When:    "test",
+		Since:   now,
+		Time:    now,
+		Summary: "latmon test alert",
+	}
+
+	rc := 0
+	for i := range c.Alerts.Receivers {
+		r := &c.Alerts.Receivers[i]
+		if len(args) > 0 && !slices.Contains(args, r.Name) {
+			continue
+		}
+
+		if err := r.Send(&n); err != nil {
+			Warn("%s: %s", r.Name, err)
+			rc = 1
+			continue
+		}
+		fmt.Printf("%s: OK\n", r.Name)
+	}
+	os.Exit(rc)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a webhook receiver that passes the body of each POST to the channel
+func startWebhook(t *testing.T) (*httptest.Server, chan []byte) {
+	ch := make(chan []byte, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			t.Errorf("webhook: %s request", r.Method)
+		}
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("webhook: content type '%s'", ct)
+		}
+		if tok := r.Header.Get("X-Token"); tok != "secret" {
+			t.Errorf("webhook: token '%s'", tok)
+		}
+
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("webhook: %s", err)
+		}
+		ch <- b
+	}))
+	t.Cleanup(srv.Close)
+	return srv, ch
+}
+
+// return an alerter for target "x" with rule 'r' that sends to
+// 'webhook'; the rules are only evaluated by the test
+func testAlerter(t *testing.T, r Rule, webhook string) *alerter {
+	rc := Receiver{
+		Name:    "hook",
+		Webhook: webhook,
+		Headers: map[string]string{"X-Token": "secret"},
+	}
+	if _, err := rc.Validate(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	r.Receivers = []string{"hook"}
+	if _, err := r.Validate(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	al := Alerts{
+		Rules:     []Rule{r},
+		Receivers: []Receiver{rc},
+	}
+	a := newAlerter(al, func() []string { return []string{"x"} }, testLogger(t))
+	t.Cleanup(a.Stop)
+	return a
+}
+
+// feed a tcp sample of 'v' every second in [from, to)
+func feed(a *alerter, from, to time.Time, v time.Duration) {
+	for t := from; t.Before(to); t = t.Add(time.Second) {
+		a.observe(&Sample{
+			Target: "x",
+			Time:   t,
+			Names:  []string{"tcp"},
+			Vals:   []time.Duration{v},
+		})
+	}
+}
+
+// return the alert posted to the webhook
+func recvAlert(t *testing.T, ch chan []byte) Alert {
+	t.Helper()
+
+	b := recvResult(t, ch)
+
+	// the payload has these fields and no others
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("payload: %s: %s", err, b)
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	want := []string{"rule", "since", "status", "summary", "target", "time", "value", "when"}
+	if !slices.Equal(keys, want) {
+		t.Fatalf("payload fields: exp %v, saw %v", want, keys)
+	}
+
+	var n Alert
+	if err := json.Unmarshal(b, &n); err != nil {
+		t.Fatalf("payload: %s: %s", err, b)
+	}
+	return n
+}
+
+// wait for the notifications in flight and make sure there were none
+func noAlert(t *testing.T, a *alerter, ch chan []byte) {
+	t.Helper()
+
+	a.sends.Wait()
+	select {
+	case b := <-ch:
+		t.Fatalf("unexpected alert: %s", b)
+	default:
+	}
+}
+
+func TestAlertWebhook(t *testing.T) {
+	srv, ch := startWebhook(t)
+	r := Rule{
+		Name:   "slow",
+		When:   "p50(tcp) > 100ms",
+		Clear:  "50ms",
+		Window: time.Minute,
+		For:    20 * time.Second,
+		Repeat: time.Minute,
+	}
+	a := testAlerter(t, r, srv.URL)
+
+	t0 := time.Now().UTC().Truncate(time.Second)
+	at := func(s int) time.Time {
+		return t0.Add(time.Duration(s) * time.Second)
+	}
+
+	// pending until it's been past the threshold for 20s
+	feed(a, at(-30), at(0), 200*time.Millisecond)
+	a.eval(at(0))
+	noAlert(t, a, ch)
+
+	st := a.List()
+	if len(st) != 1 || st[0].State != "pending" || !st[0].Since.Equal(at(0)) {
+		t.Fatalf("exp a pending alert since %s, saw %+v", at(0), st)
+	}
+
+	feed(a, at(0), at(20), 200*time.Millisecond)
+	a.eval(at(20))
+	n := recvAlert(t, ch)
+	switch {
+	case n.Status != "firing", n.Rule != "slow", n.Target != "x", n.When != r.When:
+		t.Fatalf("firing: saw %+v", n)
+	case n.Value != "200ms":
+		t.Fatalf("firing: exp value 200ms, saw %s", n.Value)
+	case !n.Since.Equal(at(0)), !n.Time.Equal(at(20)):
+		t.Fatalf("firing: exp since %s at %s, saw %s at %s", at(0), at(20), n.Since, n.Time)
+	}
+
+	// no repeat within the repeat interval
+	feed(a, at(20), at(50), 200*time.Millisecond)
+	a.eval(at(50))
+	noAlert(t, a, ch)
+
+	// and once it's passed
+	feed(a, at(50), at(80), 200*time.Millisecond)
+	a.eval(at(80))
+	n = recvAlert(t, ch)
+	if n.Status != "firing" || !n.Since.Equal(at(0)) || !n.Time.Equal(at(80)) {
+		t.Fatalf("repeat: saw %+v", n)
+	}
+
+	// below the threshold but not the clear value: still firing
+	feed(a, at(80), at(139), 80*time.Millisecond)
+	a.eval(at(139))
+	noAlert(t, a, ch)
+
+	feed(a, at(139), at(200), 10*time.Millisecond)
+	a.eval(at(200))
+	n = recvAlert(t, ch)
+	if n.Status != "resolved" || n.Value != "10ms" || !n.Time.Equal(at(200)) {
+		t.Fatalf("resolved: saw %+v", n)
+	}
+	if st := a.List(); len(st) != 0 {
+		t.Fatalf("exp no alerts, saw %+v", st)
+	}
+
+	a.eval(at(210))
+	noAlert(t, a, ch)
+}
+
+// the samples of concurrent probes come in the order the probes finish
+func TestAlertOutOfOrder(t *testing.T) {
+	r := Rule{
+		Name:   "silent",
+		When:   "no-data > 1m",
+		Window: time.Minute,
+	}
+	a := testAlerter(t, r, "http://127.0.0.1:1/")
+
+	t0 := time.Now().UTC().Truncate(time.Second)
+	for _, s := range []int{2, 1, 3, -120, 0} {
+		a.observe(&Sample{
+			Target: "x",
+			Time:   t0.Add(time.Duration(s) * time.Second),
+			Names:  []string{"tcp"},
+			Vals:   []time.Duration{time.Millisecond},
+		})
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	var saw []int
+	for _, s := range a.recent["x"] {
+		saw = append(saw, int(s.Time.Sub(t0)/time.Second))
+	}
+	if exp := []int{0, 1, 2, 3}; !slices.Equal(saw, exp) {
+		t.Fatalf("exp samples at %v, saw %v", exp, saw)
+	}
+	if last := a.last["x"]; !last.Equal(t0.Add(3 * time.Second)) {
+		t.Fatalf("exp the last sample at +3s, saw %s", last.Sub(t0))
+	}
+}
+
+// an exec receiver gets the alert in its environment and as json on
+// its stdin
+func TestAlertExec(t *testing.T) {
+	dir := t.TempDir()
+	rc := Receiver{
+		Name: "script",
+		Exec: []string{"/bin/sh", "-c", "env | grep ^LATMON_ALERT_ | sort > $0/env && cat > $0/stdin", dir},
+	}
+	if _, err := rc.Validate(); err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	t0 := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	n := Alert{
+		Status:  "firing",
+		Rule:    "slow",
+		Target:  "x",
+		When:    "p99(tcp) > 100ms",
+		Value:   "250ms",
+		Since:   t0,
+		Time:    t0.Add(time.Minute),
+		Summary: "x: p99(tcp) 250ms > 100ms",
+	}
+	if err := rc.Send(&n); err != nil {
+		t.Fatalf("send: %s", err)
+	}
+
+	env, err := os.ReadFile(filepath.Join(dir, "env"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	exp := []string{
+		"LATMON_ALERT_RULE=slow",
+		"LATMON_ALERT_SINCE=2024-05-01T10:00:00Z",
+		"LATMON_ALERT_STATUS=firing",
+		"LATMON_ALERT_SUMMARY=x: p99(tcp) 250ms > 100ms",
+		"LATMON_ALERT_TARGET=x",
+		"LATMON_ALERT_TIME=2024-05-01T10:01:00Z",
+		"LATMON_ALERT_VALUE=250ms",
+		"LATMON_ALERT_WHEN=p99(tcp) > 100ms",
+	}
+	if saw := strings.Split(strings.TrimSpace(string(env)), "\n"); !slices.Equal(saw, exp) {
+		t.Fatalf("env: exp %q, saw %q", exp, saw)
+	}
+
+	// the json isn't html escaped
+	b, err := os.ReadFile(filepath.Join(dir, "stdin"))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !bytes.Contains(b, []byte(`"p99(tcp) > 100ms"`)) {
+		t.Fatalf("stdin: escaped condition: %s", b)
+	}
+
+	var saw Alert
+	if err := json.Unmarshal(b, &saw); err != nil {
+		t.Fatalf("stdin: %s: %s", err, b)
+	}
+	switch {
+	case saw.Status != n.Status, saw.Rule != n.Rule, saw.Target != n.Target, saw.When != n.When,
+		saw.Value != n.Value, saw.Summary != n.Summary, !saw.Since.Equal(n.Since), !saw.Time.Equal(n.Time):
+		t.Fatalf("stdin: exp %+v, saw %+v", n, saw)
+	}
+
+	// a failed command is an error with its output
+	rc.Exec = []string{"/bin/sh", "-c", "echo no route >&2; exit 3"}
+	if err := rc.Send(&n); err == nil || !strings.Contains(err.Error(), "no route") {
+		t.Fatalf("exp an error with the output, saw %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+// anomaly.go - spike and level shift detection on the latency series
+//
+// Each phase of a target has a detector that keeps a robust baseline
+// of its log latency: an EWMA of the level and of the absolute
+// deviation from it (a stand-in for the MAD). A sample whose z-score
+// against the baseline is above 'spike' is a spike; only the first
+// sample of a run of them is reported and they barely move the
+// baseline. A two sided CUSUM of the (clipped) z-scores finds level
+// shifts: a sustained move up or down that is too small or too slow
+// to be a spike. After a shift, the baseline restarts at the new
+// level.
+//
+// The detectors learn the baseline from the first _AnomalyWarmup
+// samples of each phase and report nothing until then. They run in
+// the worker path; the events are marked on the charts, logged,
+// appended to <batch>-events.csv and passed on to the alerter.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+const (
+	// samples to learn the baseline from
+	_AnomalyWarmup = 30
+
+	// weight of a new sample in the baseline
+	_AnomalyAlpha = 0.02
+
+	// the smallest deviation of the log latency (~5%); a very steady
+	// target would otherwise flag every wobble
+	_AnomalyMinDev = 0.05
+
+	// slack and clip of the CUSUM (in z-scores); the clip keeps a
+	// single spike from passing for a shift
+	_CusumSlack = 0.5
+	_CusumClip  = 4.0
+
+	// the samples of a CUSUM run kept to find the new level
+	_CusumKeep = 256
+
+	// a smaller shift (~10%) moves the baseline but isn't reported
+	_AnomalyMinShift = 0.1
+)
+
+type AnomalyOpts struct {
+	// z-score of a spike; zero disables spike detection
+	Spike float64
+
+	// CUSUM threshold of a level shift; zero disables shift detection
+	Shift float64
+}
+
+func (o *AnomalyOpts) enabled() bool {
+	return o.Spike > 0 || o.Shift > 0
+}
+
+// Anomaly is a spike or a level shift in a phase of a target
+type Anomaly struct {
+	Phase string
+
+	// spike, shift-up or shift-down
+	Kind string
+
+	// the sample (spike) or the new level (shift) and the baseline
+	// before it
+	Value    time.Duration
+	Baseline time.Duration
+
+	// z-score of a spike or the CUSUM of a shift
+	Score float64
+}
+
+func (e *Anomaly) String() string {
+	if e.Kind == "spike" {
+		return fmt.Sprintf("spike in %s: %s (baseline %s, z %.1f)", e.Phase,
+			round(e.Value), round(e.Baseline), e.Score)
+	}
+	return fmt.Sprintf("%s in %s: %s -> %s (cusum %.1f)", e.Kind, e.Phase,
+		round(e.Baseline), round(e.Value), e.Score)
+}
+
+// the detectors of a target
+type anomalies struct {
+	opt AnomalyOpts
+	det map[string]*detector
+}
+
+func newAnomalies(o AnomalyOpts) *anomalies {
+	return &anomalies{
+		opt: o,
+		det: make(map[string]*detector),
+	}
+}
+
+// check the new values in 's' and return the anomalies in them
+func (a *anomalies) check(s *Sample) []Anomaly {
+	var v []Anomaly
+	for i, nm := range s.Names {
+		if plot.IsMeta(nm) {
+			continue
+		}
+
+		d, ok := a.det[nm]
+		if !ok {
+			d = &detector{}
+			a.det[nm] = d
+		}
+		v = d.add(nm, s.Vals[i], &a.opt, v)
+	}
+	return v
+}
+
+// the baseline and the CUSUMs of a phase; all in log nanoseconds
+type detector struct {
+	n     int
+	level float64
+	dev   float64
+
+	// was the last sample a spike
+	spiking bool
+
+	// the CUSUMs and the samples since each was last zero
+	hi, lo       float64
+	hiRun, loRun []float64
+}
+
+// add sample 'x' of phase 'nm' and append the anomalies it shows to
+// 'v'
+func (d *detector) add(nm string, x time.Duration, o *AnomalyOpts, v []Anomaly) []Anomaly {
+	y := math.Log(float64(max(x, time.Microsecond)))
+
+	d.n++
+	if d.n == 1 {
+		d.level = y
+		return v
+	}
+	if d.n <= _AnomalyWarmup {
+		// the mean and the mean absolute deviation so far
+		w := 1 / float64(d.n)
+		r := y - d.level
+		d.level += w * r
+		d.dev += w * (math.Abs(r) - d.dev)
+		return v
+	}
+
+	// sigma of a normal distribution is ~1.25 times its mean absolute
+	// deviation
+	sd := max(1.2533*d.dev, _AnomalyMinDev)
+	z := (y - d.level) / sd
+
+	if o.Spike > 0 {
+		spike := z > o.Spike
+		if spike && !d.spiking {
+			v = append(v, Anomaly{
+				Phase:    nm,
+				Kind:     "spike",
+				Value:    x,
+				Baseline: d.baseline(),
+				Score:    z,
+			})
+		}
+		d.spiking = spike
+	}
+
+	if o.Shift > 0 {
+		c := min(max(z, -_CusumClip), _CusumClip)
+		d.hi, d.hiRun = cusum(d.hi+c-_CusumSlack, d.hiRun, y)
+		d.lo, d.loRun = cusum(d.lo-c-_CusumSlack, d.loRun, y)
+
+		var kind string
+		var run []float64
+		var score float64
+		switch {
+		case d.hi > o.Shift:
+			kind, run, score = "shift-up", d.hiRun, d.hi
+		case d.lo > o.Shift:
+			kind, run, score = "shift-down", d.loRun, d.lo
+		}
+
+		if len(run) > 0 {
+			e := Anomaly{
+				Phase:    nm,
+				Kind:     kind,
+				Baseline: d.baseline(),
+				Score:    score,
+			}
+
+			// start afresh at the level since the shift began; the
+			// median leaves out the samples of the run from before it
+			slices.Sort(run)
+			prev := d.level
+			d.level = run[len(run)/2]
+			d.hi, d.hiRun = 0, d.hiRun[:0]
+			d.lo, d.loRun = 0, d.loRun[:0]
+			d.spiking = false
+
+			if math.Abs(d.level-prev) < _AnomalyMinShift {
+				return v
+			}
+			e.Value = d.baseline()
+			return append(v, e)
+		}
+	}
+
+	// clip the residual so that spikes barely move the baseline
+	r := min(max(y-d.level, -3*sd), 3*sd)
+	d.level += _AnomalyAlpha * r
+	d.dev += _AnomalyAlpha * (math.Abs(r) - d.dev)
+	return v
+}
+
+// return the updated CUSUM 's' and the samples since it was last
+// zero
+func cusum(s float64, run []float64, y float64) (float64, []float64) {
+	if s <= 0 {
+		return 0, run[:0]
+	}
+	if len(run) == _CusumKeep {
+		run = append(run[:0], run[1:]...)
+	}
+	return s, append(run, y)
+}
+
+func (d *detector) baseline() time.Duration {
+	return time.Duration(math.Exp(d.level))
+}
+
+// record the anomalies in 'v' found at 'now': mark them on the chart,
+// log them and append them to the events of the current batch. This
+// is called with the lock on hs held.
+func (m *Measurer) anomalous(hs *hostStats, now time.Time, v []Anomaly) {
+	idx := len(hs.times) - 1
+	if hs.agg != nil {
+		idx = len(hs.agg.batch.rows)
+	}
+
+	fname := hs.start.Format("2006-01-02-15.04.05")
+	fn := path.Join(hs.statsDir, fmt.Sprintf("%s-events.csv", fname))
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		m.log.Warn("create %s: %s", fn, err)
+	} else {
+		defer fd.Close()
+		if st, err := fd.Stat(); err == nil && st.Size() == 0 {
+			fmt.Fprintf(fd, "time,phase,kind,value,baseline,score\n")
+		}
+	}
+
+	for i := range v {
+		e := &v[i]
+		hs.marks = append(hs.marks, plot.Mark{Index: idx, Label: e.Kind + " " + e.Phase})
+		m.log.Warn("%s: %s", hs.name, e)
+		if fd != nil {
+			fmt.Fprintf(fd, "%s,%s,%s,%d,%d,%.2f\n", now.Format(time.RFC3339Nano),
+				e.Phase, e.Kind, e.Value, e.Baseline, e.Score)
+		}
+	}
+}
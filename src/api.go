@@ -0,0 +1,553 @@
+// api.go - read-only query API over the stored measurements
+//
+//	GET /api/v1/targets
+//	GET /api/v1/targets/{name}/samples?from=&to=&phase=&limit=
+//	GET /api/v1/targets/{name}/summary?from=&to=&phase=
+//	GET /api/v1/targets/{name}/slo
+//	GET /metrics
+//
+// 'from' and 'to' are RFC3339 times, unix seconds, "now" or a
+// duration relative to now (eg -2h); the default is the last hour.
+// 'phase' is a comma separated list of columns (eg dns,tcp). All
+// latencies are in milliseconds. /metrics has the state of the SLOs
+// of the running targets in the Prometheus text format.
+//
+// Aggregated targets keep histograms, not samples: their summary is
+// made from the histograms (of the buckets that start in the range)
+// and they have no samples.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencoff/latmon/internal/hdr"
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+// max samples returned by a query unless the caller asks for more
+const _DefaultQueryLimit = 100000
+
+type apiTarget struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+
+	Proto    string `json:"proto,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+	Interval string `json:"interval,omitempty"`
+}
+
+type apiSample struct {
+	T time.Time          `json:"t"`
+	V map[string]float64 `json:"v"`
+}
+
+type apiSamples struct {
+	Target    string      `json:"target"`
+	From      time.Time   `json:"from"`
+	To        time.Time   `json:"to"`
+	Samples   []apiSample `json:"samples"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+type apiPhase struct {
+	Name  string  `json:"name"`
+	Count int     `json:"count"`
+	Min   float64 `json:"min"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+type apiSummary struct {
+	Target string    `json:"target"`
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+
+	// successful and failed probes and the ratio of the two
+	Samples      int      `json:"samples"`
+	Errors       int      `json:"errors"`
+	Availability *float64 `json:"availability,omitempty"`
+
+	Phases []apiPhase `json:"phases"`
+}
+
+type apiSLO struct {
+	Name      string  `json:"name"`
+	Indicator string  `json:"indicator"`
+	Objective float64 `json:"objective"`
+	Window    string  `json:"window"`
+
+	Probes     uint64  `json:"probes"`
+	Bad        uint64  `json:"bad"`
+	Compliance float64 `json:"compliance"`
+	Budget     float64 `json:"error_budget_remaining"`
+	Met        bool    `json:"met"`
+
+	// window -> burn rate
+	Burn map[string]float64 `json:"burn_rates"`
+}
+
+type query struct {
+	from, to time.Time
+	phases   map[string]bool
+	limit    int
+}
+
+func (w *webServer) apiTargets(rw http.ResponseWriter, r *http.Request) {
+	ti, err := w.d.list("")
+	if err != nil {
+		apiError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	v := make([]apiTarget, 0, len(ti))
+	for i := range ti {
+		t := &ti[i]
+		seen[t.Name] = true
+		v = append(v, apiTarget{
+			Name:     t.Name,
+			Running:  true,
+			Proto:    t.Proto,
+			Host:     t.Host,
+			Port:     t.Port,
+			Interval: t.Interval,
+		})
+	}
+
+	// and the targets that only have stored data
+	de, _ := os.ReadDir(w.d.statsDir())
+	for _, e := range de {
+		if nm := e.Name(); e.IsDir() && !seen[nm] {
+			v = append(v, apiTarget{Name: nm})
+		}
+	}
+
+	slices.SortFunc(v, func(a, b apiTarget) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	apiReply(rw, v)
+}
+
+func (w *webServer) apiSamples(rw http.ResponseWriter, r *http.Request) {
+	nm := r.PathValue("name")
+	q, err := parseQuery(r)
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	if w.aggregated(nm) {
+		apiError(rw, http.StatusBadRequest, fmt.Errorf("%s: aggregated target: it keeps histograms, not samples; see its summary", nm))
+		return
+	}
+
+	v, err := w.query(nm, &q)
+	if err != nil {
+		apiError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	res := apiSamples{
+		Target:  nm,
+		From:    q.from,
+		To:      q.to,
+		Samples: make([]apiSample, 0, min(len(v), q.limit)),
+	}
+
+	for i := range v {
+		if len(res.Samples) == q.limit {
+			res.Truncated = true
+			break
+		}
+
+		s := &v[i]
+		x := apiSample{
+			T: s.Time,
+			V: make(map[string]float64, len(s.Names)),
+		}
+		for j, c := range s.Names {
+			x.V[c] = millis(s.Vals[j])
+		}
+		res.Samples = append(res.Samples, x)
+	}
+	apiReply(rw, &res)
+}
+
+func (w *webServer) apiSummary(rw http.ResponseWriter, r *http.Request) {
+	nm := r.PathValue("name")
+	q, err := parseQuery(r)
+	if err != nil {
+		apiError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	var n int
+	var cols []ColumnStats
+	if w.aggregated(nm) {
+		n, cols, err = w.histSummary(nm, &q)
+	} else {
+		n, cols, err = w.summary(nm, &q)
+	}
+	if err != nil {
+		apiError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	dir, _, _ := w.d.locate(nm)
+	errs, err := readErrors(dir, q.from, q.to)
+	if err != nil {
+		apiError(rw, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := apiSummary{
+		Target:  nm,
+		From:    q.from,
+		To:      q.to,
+		Samples: n,
+		Errors:  len(errs),
+		Phases:  []apiPhase{},
+	}
+
+	if n := res.Samples + res.Errors; n > 0 {
+		a := float64(res.Samples) / float64(n)
+		res.Availability = &a
+	}
+
+	for _, cs := range cols {
+		res.Phases = append(res.Phases, apiPhase{
+			Name:  cs.Name,
+			Count: cs.N,
+			Min:   millis(cs.Min),
+			Mean:  millis(cs.Avg),
+			P50:   millis(cs.P50),
+			P90:   millis(cs.P90),
+			P99:   millis(cs.P99),
+			Max:   millis(cs.Max),
+		})
+	}
+	apiReply(rw, &res)
+}
+
+func (w *webServer) apiSLOs(rw http.ResponseWriter, r *http.Request) {
+	nm := r.PathValue("name")
+	v, err := w.d.m.SLOs(nm)
+	if err != nil {
+		apiError(rw, http.StatusNotFound, err)
+		return
+	}
+
+	res := make([]apiSLO, 0, len(v))
+	for i := range v {
+		s := &v[i]
+		x := apiSLO{
+			Name:       s.Name,
+			Indicator:  s.Indicator,
+			Objective:  s.Objective,
+			Window:     plot.Window(s.Window),
+			Probes:     s.Total,
+			Bad:        s.Bad,
+			Compliance: s.Compliance,
+			Budget:     s.Budget,
+			Met:        s.Met(),
+			Burn:       make(map[string]float64, len(s.Burn)),
+		}
+		for _, b := range s.Burn {
+			x.Burn[plot.Window(b.Window)] = b.Rate
+		}
+		res = append(res, x)
+	}
+	apiReply(rw, res)
+}
+
+// the state of the SLOs of the running targets as Prometheus metrics
+func (w *webServer) metrics(rw http.ResponseWriter, r *http.Request) {
+	type metric struct {
+		name, help string
+		b          strings.Builder
+	}
+
+	ms := []*metric{
+		{name: "latmon_slo_objective", help: "Fraction of the probes that must be good"},
+		{name: "latmon_slo_probes", help: "Probes in the window of the SLO"},
+		{name: "latmon_slo_compliance", help: "Fraction of the probes in the window that are good"},
+		{name: "latmon_slo_error_budget_remaining", help: "Fraction of the error budget that is left"},
+		{name: "latmon_slo_burn_rate", help: "Rate at which the error budget is spent over the window"},
+	}
+
+	for _, nm := range w.d.m.Targets() {
+		v, err := w.d.m.SLOs(nm)
+		if err != nil {
+			continue
+		}
+
+		for i := range v {
+			s := &v[i]
+			lbl := fmt.Sprintf(`target="%s",slo="%s"`, promEscape(nm), promEscape(s.Name))
+			fmt.Fprintf(&ms[0].b, "%s{%s} %g\n", ms[0].name, lbl, s.Objective)
+			fmt.Fprintf(&ms[1].b, "%s{%s,result=\"good\"} %d\n", ms[1].name, lbl, s.Total-s.Bad)
+			fmt.Fprintf(&ms[1].b, "%s{%s,result=\"bad\"} %d\n", ms[1].name, lbl, s.Bad)
+			if s.Total > 0 {
+				fmt.Fprintf(&ms[2].b, "%s{%s} %g\n", ms[2].name, lbl, s.Compliance)
+			}
+			fmt.Fprintf(&ms[3].b, "%s{%s} %g\n", ms[3].name, lbl, s.Budget)
+			for _, b := range s.Burn {
+				if b.Total > 0 {
+					fmt.Fprintf(&ms[4].b, "%s{%s,window=\"%s\"} %g\n", ms[4].name, lbl, plot.Window(b.Window), b.Rate)
+				}
+			}
+		}
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range ms {
+		if m.b.Len() > 0 {
+			fmt.Fprintf(rw, "# HELP %s %s\n# TYPE %s gauge\n%s", m.name, m.help, m.name, m.b.String())
+		}
+	}
+}
+
+// escape a Prometheus label value
+func promEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// return true if target 'nm' is aggregated (see aggregate.go)
+func (w *webServer) aggregated(nm string) bool {
+	opt, ok := w.d.lookup(nm)
+	return ok && opt.Aggregate > 0
+}
+
+// return the number of samples of target 'nm' that match 'q' and the
+// stats of their phases, in the order we first see them
+func (w *webServer) summary(nm string, q *query) (int, []ColumnStats, error) {
+	v, err := w.query(nm, q)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var names []string
+	cols := make(map[string][]time.Duration)
+	for i := range v {
+		s := &v[i]
+		for j, c := range s.Names {
+			if _, ok := cols[c]; !ok {
+				names = append(names, c)
+			}
+			cols[c] = append(cols[c], s.Vals[j])
+		}
+	}
+
+	r := make([]ColumnStats, 0, len(names))
+	for _, c := range names {
+		r = append(r, columnStats(c, cols[c]))
+	}
+	return len(v), r, nil
+}
+
+// histSummary is summary for an aggregated target: from its stored
+// histograms and the samples of the current bucket. The samples of a
+// bucket are those of its busiest phase.
+func (w *webServer) histSummary(nm string, q *query) (int, []ColumnStats, error) {
+	dir, _, err := w.d.locate(nm)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var names []string
+	hists := make(map[string]*hdr.Histogram)
+	hist := func(c string) *hdr.Histogram {
+		h, ok := hists[c]
+		if !ok {
+			h = hdr.New()
+			hists[c] = h
+			names = append(names, c)
+		}
+		return h
+	}
+
+	var n, k uint64
+	var t0 time.Time
+	err = scanHists(dir, q.from, q.to, func(t time.Time, c string, h *hdr.Histogram) {
+		if len(q.phases) > 0 && !q.phases[c] {
+			return
+		}
+		if !t.Equal(t0) {
+			n, t0, k = n+k, t, 0
+		}
+		k = max(k, h.Count())
+		hist(c).Merge(h)
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	n += k
+
+	if cur, err := w.d.m.Samples(nm); err == nil {
+		for _, s := range cur {
+			if s.Time.Before(q.from) || !s.Time.Before(q.to) {
+				continue
+			}
+
+			var ok bool
+			for j, c := range s.Names {
+				if len(q.phases) == 0 || q.phases[c] {
+					hist(c).Record(s.Vals[j])
+					ok = true
+				}
+			}
+			if ok {
+				n++
+			}
+		}
+	}
+
+	r := make([]ColumnStats, 0, len(names))
+	for _, c := range names {
+		r = append(r, toColumnStats(histStats(c, hists[c])))
+	}
+	return int(n), r, nil
+}
+
+// return the stored and current samples of target 'nm' that match 'q'
+func (w *webServer) query(nm string, q *query) ([]Sample, error) {
+	dir, ii, err := w.d.locate(nm)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := readSamples(dir, nm, q.from, q.to, ii)
+	if err != nil {
+		return nil, err
+	}
+
+	// and the batch that isn't on disk yet
+	if cur, err := w.d.m.Samples(nm); err == nil {
+		for _, s := range cur {
+			if !s.Time.Before(q.from) && s.Time.Before(q.to) {
+				v = append(v, s)
+			}
+		}
+	}
+
+	if len(q.phases) == 0 {
+		return v, nil
+	}
+
+	// drop the phases we don't want; and the samples that have
+	// none of them
+	r := v[:0]
+	for _, s := range v {
+		var names []string
+		var vals []time.Duration
+		for j, c := range s.Names {
+			if q.phases[c] {
+				names = append(names, c)
+				vals = append(vals, s.Vals[j])
+			}
+		}
+
+		if len(names) > 0 {
+			s.Names, s.Vals = names, vals
+			r = append(r, s)
+		}
+	}
+	return r, nil
+}
+
+func parseQuery(r *http.Request) (query, error) {
+	now := time.Now().UTC()
+	q := query{
+		from:  now.Add(-time.Hour),
+		to:    now,
+		limit: _DefaultQueryLimit,
+	}
+
+	v := r.URL.Query()
+
+	var err error
+	if s := v.Get("from"); len(s) > 0 {
+		if q.from, err = parseTime(s, now); err != nil {
+			return q, fmt.Errorf("from: %w", err)
+		}
+	}
+	if s := v.Get("to"); len(s) > 0 {
+		if q.to, err = parseTime(s, now); err != nil {
+			return q, fmt.Errorf("to: %w", err)
+		}
+	}
+	if !q.from.Before(q.to) {
+		return q, fmt.Errorf("'from' must be before 'to'")
+	}
+
+	if s := v.Get("phase"); len(s) > 0 {
+		q.phases = make(map[string]bool)
+		for _, p := range strings.Split(s, ",") {
+			q.phases[strings.ToLower(strings.TrimSpace(p))] = true
+		}
+	}
+
+	if s := v.Get("limit"); len(s) > 0 {
+		if q.limit, err = strconv.Atoi(s); err != nil || q.limit <= 0 {
+			return q, fmt.Errorf("invalid limit '%s'", s)
+		}
+	}
+	return q, nil
+}
+
+// parse an absolute or relative (to 'now') time
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+
+	if s[0] == '-' {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return now, err
+		}
+		return now.Add(d), nil
+	}
+
+	if x, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(x, 0).UTC(), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return now, fmt.Errorf("invalid time '%s'", s)
+	}
+	return t, nil
+}
+
+// duration in millisec with microsec precision
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000.0
+}
+
+func apiReply(rw http.ResponseWriter, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	// the slo indicators have < and >
+	enc := json.NewEncoder(rw)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+}
+
+func apiError(rw http.ResponseWriter, code int, err error) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(map[string]string{"error": err.Error()})
+}
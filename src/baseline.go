@@ -0,0 +1,107 @@
+// baseline.go - compare a period of a target with a baseline period
+//
+// The baseline of a period is the same period 'baseline' earlier: 1d
+// is the same hours yesterday and 1w the same hours on the same
+// weekday last week. Its samples come from the stored batches or,
+// once those are gone, from the daily csv files. The daily reports
+// and the live charts show the change in each percentile and flag
+// the phases (and hours) that are significantly slower.
+// Aggregated targets don't store their samples; they have no
+// baseline.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+// readBaseline returns the samples of target 'name' in [from, to)
+// moved 'off' earlier; their times are moved forward by 'off' to
+// line up with the period. Returns nil if there are none.
+func readBaseline(dir, name string, from, to time.Time, off Age, ii time.Duration) (*plot.Columns, error) {
+	bf, bt := off.Before(from), off.Before(to)
+	v, err := readSamples(dir, name, bf, bt, ii)
+	if err != nil {
+		return nil, err
+	}
+	if len(v) == 0 {
+		return nil, nil
+	}
+
+	o, _ := toColumns(name, v, func(string) bool { return true })
+	for i, t := range o.Times {
+		o.Times[i] = off.After(t)
+	}
+	return o, nil
+}
+
+// return the label of the baseline 'off' before 'from'
+func baselineLabel(from time.Time, off Age) string {
+	return fmt.Sprintf("%s (%s earlier)", off.Before(from).Local().Format("2006-01-02 15:04"), off)
+}
+
+// compare the daily stats in 'ds' with their baseline: regressions
+// are logged and the comparison is shown in the daily chart and
+// written to 'fname'-baseline.csv.
+func (m *Measurer) compareBaseline(ds *plot.Columns, hs *hostStats, fname string) {
+	if hs.baseline.IsZero() || ds.Minlen == 0 || len(ds.Times) < ds.Minlen {
+		return
+	}
+
+	from, to := ds.Times[0], ds.Times[ds.Minlen-1].Add(1)
+	base, err := readBaseline(hs.statsDir, hs.name, from, to, hs.baseline, hs.interval)
+	if err != nil {
+		m.log.Warn("%s: baseline: %s", hs.name, err)
+		return
+	}
+	if base == nil {
+		m.log.Debug("%s: no baseline %s earlier", hs.name, hs.baseline)
+		return
+	}
+
+	b := plot.NewBaseline(baselineLabel(from, hs.baseline), ds, base)
+	ds.Baseline = b
+
+	for _, d := range b.Regressions() {
+		m.log.Warn("%s: %s is slower than %s: p50 %s -> %s, p99 %s -> %s (p-value %.2g)",
+			hs.name, d.Name, b.Label, round(d.Base.P50), round(d.Cur.P50),
+			round(d.Base.P99), round(d.Cur.P99), d.P)
+	}
+
+	if hs.outputs.Has(OutputCsv) {
+		fn := path.Join(hs.statsDir, fname+"-baseline.csv")
+		if err := writeBaselineCsv(b, fn); err != nil {
+			m.log.Warn("%s", err)
+		}
+	}
+}
+
+// write the comparison 'b' to 'fn': a row for each phase and then
+// for each hour of the headline phase. The latencies are in
+// nanoseconds.
+func writeBaselineCsv(b *plot.Baseline, fn string) error {
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", fn, err)
+	}
+	defer fd.Close()
+
+	fmt.Fprintf(fd, "phase,hour,count,base-count,p50,base-p50,p90,base-p90,p99,base-p99,mean,base-mean,p-value,regressed\n")
+	for _, v := range [][]plot.Delta{b.Phases, b.Hours} {
+		for _, d := range v {
+			var hour string
+			if !d.Hour.IsZero() {
+				hour = d.Hour.Format(time.RFC3339)
+			}
+			fmt.Fprintf(fd, "%s,%s,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%.3g,%t\n", d.Name, hour,
+				d.Cur.N, d.Base.N, d.Cur.P50, d.Base.P50, d.Cur.P90, d.Base.P90,
+				d.Cur.P99, d.Base.P99, d.Cur.Mean, d.Base.Mean, d.P, d.Regressed)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+// compare.go - comparison of a phase across targets
+//
+// A comparison overlays one phase of several targets on a shared time
+// axis and adds the CDF and the percentiles of each (plot.Compare).
+// Every hour the comparer makes the comparison of each configured
+// group over the UTC day so far from the stored samples:
+//
+//	compare/<group>/2006-01-02.html
+//	compare/<group>/2006-01-02-summary.csv
+//
+// 'latmon report --compare PHASE' makes one on demand.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+// interval between comparisons of the groups
+const _CompareEvery = time.Hour
+
+// Group is a set of targets whose 'Phase' is compared
+type Group struct {
+	Name    string
+	Phase   string
+	Targets []string
+}
+
+// Validate checks the group; on error, it also returns the name of
+// the setting at fault.
+func (g *Group) Validate() (string, error) {
+	if len(g.Name) == 0 || g.Name != filepath.Base(g.Name) || g.Name == "." || g.Name == ".." {
+		return "name", fmt.Errorf("invalid group name '%s'", g.Name)
+	}
+	if !isPhase(g.Phase) {
+		return "phase", fmt.Errorf("%s: unknown phase '%s'", g.Name, g.Phase)
+	}
+	if len(g.Targets) < 2 {
+		return "targets", fmt.Errorf("%s: need at least 2 targets", g.Name)
+	}
+
+	for i, nm := range g.Targets {
+		if slices.Contains(g.Targets[:i], nm) {
+			return "targets", fmt.Errorf("%s: duplicate target '%s'", g.Name, nm)
+		}
+	}
+	return "", nil
+}
+
+// return true if 'p' is a phase (column) of some pinger; the lag
+// isn't (see plot.IsMeta)
+func isPhase(p string) bool {
+	var hs hostStats
+	return !plot.IsMeta(p) && slices.ContainsFunc(hs.columns(), func(c column) bool {
+		return c.nm == p
+	})
+}
+
+type comparer struct {
+	sync.Mutex
+	groups []Group
+
+	// the stats dir and interval of a target; and the output dir
+	locate func(nm string) (string, time.Duration, error)
+	outdir func() string
+	log    logger.Logger
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newComparer(groups []Group, locate func(string) (string, time.Duration, error), outdir func() string, log logger.Logger) *comparer {
+	c := &comparer{
+		groups: groups,
+		locate: locate,
+		outdir: outdir,
+		log:    log,
+		done:   make(chan struct{}),
+	}
+
+	c.wg.Add(1)
+	go c.run()
+	return c
+}
+
+// Set changes the groups
+func (c *comparer) Set(groups []Group) {
+	c.Lock()
+	c.groups = groups
+	c.Unlock()
+}
+
+// Stop stops the comparer after a last comparison of the day so far;
+// call it after the targets are flushed.
+func (c *comparer) Stop() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+func (c *comparer) run() {
+	defer c.wg.Done()
+
+	tick := time.NewTicker(_CompareEvery)
+	defer tick.Stop()
+
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	for {
+		select {
+		case <-tick.C:
+		case <-c.done:
+			c.sweep(day, time.Now().UTC())
+			return
+		}
+
+		// finish the previous day first
+		now := time.Now().UTC()
+		if d := now.Truncate(24 * time.Hour); !d.Equal(day) {
+			c.sweep(day, d)
+			day = d
+		}
+		c.sweep(day, now)
+	}
+}
+
+// compare the groups over [day, to)
+func (c *comparer) sweep(day, to time.Time) {
+	c.Lock()
+	groups := c.groups
+	c.Unlock()
+
+	for i := range groups {
+		if err := c.compare(&groups[i], day, to); err != nil {
+			c.log.Warn("compare: %s: %s", groups[i].Name, err)
+		}
+	}
+}
+
+func (c *comparer) compare(g *Group, day, to time.Time) error {
+	var v []*plot.Columns
+	for _, nm := range g.Targets {
+		dir, ii, err := c.locate(nm)
+		if err != nil {
+			continue
+		}
+
+		o, err := loadColumns(dir, nm, g.Phase, day, to, ii)
+		if err != nil {
+			return err
+		}
+		if o.Minlen > 0 {
+			v = append(v, o)
+		}
+	}
+
+	if len(v) == 0 {
+		return nil
+	}
+
+	dir := filepath.Join(c.outdir(), "compare", g.Name)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	fname := day.Format("2006-01-02")
+	c.log.Info("compare: %s: [%s] %s of %d targets", g.Name, fname, g.Phase, len(v))
+
+	title := fmt.Sprintf("%s: %s", g.Name, fname)
+	return writeCompare(title, g.Phase, v, filepath.Join(dir, fname), _DefaultOutputs)
+}
+
+// return the columns of phase 'phase' of target 'nm' in [from, to)
+// from the batches in 'dir'
+func loadColumns(dir, nm, phase string, from, to time.Time, ii time.Duration) (*plot.Columns, error) {
+	v, err := readSamples(dir, nm, from, to, ii)
+	if err != nil {
+		return nil, err
+	}
+
+	errs, err := readErrors(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	o, _ := toColumns(nm, v, func(p string) bool { return p == phase })
+	o.Counters = []plot.Counter{{Name: "errors", Val: uint64(len(errs))}}
+	return o, nil
+}
+
+// write the comparison of 'phase' across 'v' to 'base'.html and the
+// percentiles of each target to 'base'-summary.csv
+func writeCompare(title, phase string, v []*plot.Columns, base string, out Outputs) error {
+	if out.Has(OutputCsv) {
+		fn := base + "-summary.csv"
+		fd, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+		if err != nil {
+			return fmt.Errorf("create %s: %s", fn, err)
+		}
+
+		fmt.Fprintf(fd, "target,phase,count,failures,min,mean,stddev,p50,p90,p95,p99,p99.9,max\n")
+		for _, s := range plot.CompareStats(phase, v) {
+			fmt.Fprintf(fd, "%s,%s,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n", s.Name, phase, s.N, s.Failures,
+				s.Min, s.Mean, s.Stddev, s.P50, s.P90, s.P95, s.P99, s.P999, s.Max)
+		}
+		if err := fd.Close(); err != nil {
+			return fmt.Errorf("write %s: %w", fn, err)
+		}
+	}
+
+	if out.Has(OutputHtml) {
+		fn := base + ".html"
+		if err := plot.Compare(title, phase, v, fn); err != nil {
+			return fmt.Errorf("create chart %s: %w", fn, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,729 @@
+// config.go - declarative config file for latmon
+//
+// The config file is YAML. It has a few global settings, defaults
+// for every target and a list of targets; each target can override
+// any of the defaults:
+//
+//	output-dir: /var/lib/latmon
+//	defaults:
+//	    interval: 2s
+//	    timeout: 2s
+//	targets:
+//	    - target: https:www.example.com
+//	      interval: 500ms
+//	      request:
+//	        method: GET
+//	        path: /healthz
+//	      labels:
+//	        team: edge
+//
+// The command line flags provide the defaults for the 'defaults'
+// section.
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencoff/latmon/internal/plot"
+	"github.com/opencoff/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a parsed and validated config file
+type Config struct {
+	File      string
+	OutputDir string
+	Retention retentionConf
+
+	// fully resolved settings for each target
+	Targets []PingOpts
+
+	// sets of targets to compare
+	Groups []Group
+
+	// alert rules and receivers
+	Alerts Alerts
+}
+
+// the on-disk representation
+type configFile struct {
+	OutputDir string        `yaml:"output-dir"`
+	Retention retentionConf `yaml:"retention"`
+	Defaults  targetConf    `yaml:"defaults"`
+	Targets   []targetConf  `yaml:"targets"`
+	Groups    []groupConf   `yaml:"groups"`
+	Alerts    alertsConf    `yaml:"alerts"`
+}
+
+type groupConf struct {
+	Name    string   `yaml:"name"`
+	Phase   string   `yaml:"phase"`
+	Targets []string `yaml:"targets"`
+}
+
+// alert rules and where they're sent; see alert.go
+type alertsConf struct {
+	Receivers []receiverConf `yaml:"receivers"`
+	Rules     []ruleConf     `yaml:"rules"`
+}
+
+type receiverConf struct {
+	Name    string            `yaml:"name"`
+	Webhook string            `yaml:"webhook"`
+	Headers map[string]string `yaml:"headers"`
+	Exec    []string          `yaml:"exec"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+type ruleConf struct {
+	Name      string        `yaml:"name"`
+	Targets   []string      `yaml:"targets"`
+	When      string        `yaml:"when"`
+	Clear     string        `yaml:"clear"`
+	Window    time.Duration `yaml:"window"`
+	For       time.Duration `yaml:"for"`
+	Repeat    time.Duration `yaml:"repeat"`
+	Receivers []string      `yaml:"receivers"`
+}
+
+// retention policy of the outputs; see retention.go
+type retentionConf struct {
+	Batch         string `yaml:"batch"`
+	Daily         string `yaml:"daily"`
+	Rollup        string `yaml:"rollup"`
+	Compress      string `yaml:"compress"`
+	CompressAfter string `yaml:"compress-after"`
+	MaxDisk       string `yaml:"max-disk"`
+}
+
+type targetConf struct {
+	Target string `yaml:"target"`
+	Name   string `yaml:"name"`
+
+	Interval  time.Duration `yaml:"interval"`
+	Timeout   time.Duration `yaml:"timeout"`
+	BatchSize int           `yaml:"batch-size"`
+	Aggregate time.Duration `yaml:"aggregate"`
+	Schedule  scheduleConf  `yaml:"schedule"`
+
+	OutputDir string            `yaml:"output-dir"`
+	Outputs   []string          `yaml:"outputs"`
+	Labels    map[string]string `yaml:"labels"`
+
+	Request requestConf `yaml:"request"`
+	TLS     tlsConf     `yaml:"tls"`
+
+	Banner      *bool  `yaml:"banner"`
+	BannerMatch string `yaml:"banner-match"`
+	StartTls    string `yaml:"starttls"`
+
+	Udp      udpConf     `yaml:"udp"`
+	H2       h2Conf      `yaml:"h2"`
+	Trace    traceConf   `yaml:"trace"`
+	Anomaly  anomalyConf `yaml:"anomaly"`
+	Baseline string      `yaml:"baseline"`
+	SLOs     []sloConf   `yaml:"slos"`
+}
+
+type requestConf struct {
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+type tlsConf struct {
+	Insecure   *bool  `yaml:"insecure"`
+	CaFile     string `yaml:"ca-file"`
+	ServerName string `yaml:"server-name"`
+}
+
+type udpConf struct {
+	Count int `yaml:"count"`
+	Rate  int `yaml:"rate"`
+}
+
+type h2Conf struct {
+	Streams   int   `yaml:"streams"`
+	KeepAlive *bool `yaml:"keepalive"`
+}
+
+type traceConf struct {
+	Proto     string        `yaml:"proto"`
+	Every     time.Duration `yaml:"every"`
+	Threshold time.Duration `yaml:"threshold"`
+}
+
+// when the probes are sent; see schedule.go
+type scheduleConf struct {
+	Mode        string        `yaml:"mode"`
+	Jitter      time.Duration `yaml:"jitter"`
+	Offset      string        `yaml:"offset"`
+	Concurrency int           `yaml:"concurrency"`
+}
+
+type anomalyConf struct {
+	Spike float64 `yaml:"spike"`
+	Shift float64 `yaml:"shift"`
+}
+
+// a service level objective; see slo.go
+type sloConf struct {
+	Name      string        `yaml:"name"`
+	Objective string        `yaml:"objective"`
+	Latency   time.Duration `yaml:"latency"`
+	Phase     string        `yaml:"phase"`
+	Window    string        `yaml:"window"`
+}
+
+// ReadConfig reads, validates and resolves the config file 'fn'.
+// Every target starts out with the settings in 'base'.
+func ReadConfig(fn string, base *PingOpts) (*Config, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// first the structure: unknown keys and bad types
+	var cf configFile
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err = dec.Decode(&cf); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	// and the yaml tree to find the line numbers for semantic errors
+	var root yaml.Node
+	if err = yaml.Unmarshal(b, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	doc := &root
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+
+	c := &Config{
+		File:      fn,
+		OutputDir: cf.OutputDir,
+		Retention: cf.Retention,
+		Targets:   make([]PingOpts, 0, len(cf.Targets)),
+	}
+
+	var errs []error
+	lerr := func(n *yaml.Node, key string, f string, v ...any) {
+		errs = append(errs, fmt.Errorf("%s:%d: %s", fn, lineOf(n, key), fmt.Sprintf(f, v...)))
+	}
+
+	if len(cf.Targets) == 0 {
+		lerr(doc, "targets", "no targets")
+	}
+
+	var ret Retention
+	if key, err := cf.Retention.apply(&ret); err != nil {
+		lerr(valueOf(doc, "retention"), key, "retention: %s", err)
+	}
+
+	defnode := valueOf(doc, "defaults")
+	tnodes := valueOf(doc, "targets")
+	seen := make(map[string]int)
+	for i := range cf.Targets {
+		t := &cf.Targets[i]
+		n := nth(tnodes, i)
+
+		if len(t.Target) == 0 {
+			lerr(n, "", "target %d: missing 'target'", i+1)
+			continue
+		}
+
+		t.inherit(&cf.Defaults)
+
+		o, key, err := t.pingOpts(base)
+		if err != nil {
+			// blame the target if it set the key; else the defaults
+			if valueOf(n, key) == nil && valueOf(defnode, key) != nil {
+				n = defnode
+			}
+			lerr(n, key, "%s: %s", t.Target, err)
+			continue
+		}
+
+		nm := o.Name()
+		if ln, ok := seen[nm]; ok {
+			lerr(n, "", "%s: duplicate target '%s' (first at line %d)", t.Target, nm, ln)
+			continue
+		}
+		seen[nm] = lineOf(n, "")
+
+		c.Targets = append(c.Targets, o)
+	}
+
+	gnodes := valueOf(doc, "groups")
+	for i := range cf.Groups {
+		gc := &cf.Groups[i]
+		n := nth(gnodes, i)
+
+		g := Group{
+			Name:    gc.Name,
+			Phase:   strings.ToLower(gc.Phase),
+			Targets: gc.Targets,
+		}
+		if key, err := g.Validate(); err != nil {
+			lerr(n, key, "group %d: %s", i+1, err)
+			continue
+		}
+
+		if slices.ContainsFunc(c.Groups, func(x Group) bool { return x.Name == g.Name }) {
+			lerr(n, "name", "duplicate group '%s'", g.Name)
+			continue
+		}
+
+		for _, nm := range g.Targets {
+			j := slices.IndexFunc(c.Targets, func(o PingOpts) bool { return o.Name() == nm })
+			switch {
+			case j < 0:
+				lerr(n, "targets", "%s: unknown target '%s'", g.Name, nm)
+			case c.Targets[j].Aggregate > 0:
+				lerr(n, "targets", "%s: target '%s' is aggregated; it has no samples to compare", g.Name, nm)
+			}
+		}
+		c.Groups = append(c.Groups, g)
+	}
+
+	anode := valueOf(doc, "alerts")
+	rnodes := valueOf(anode, "receivers")
+	for i := range cf.Alerts.Receivers {
+		rc := &cf.Alerts.Receivers[i]
+		n := nth(rnodes, i)
+
+		r := Receiver{
+			Name:    rc.Name,
+			Webhook: rc.Webhook,
+			Headers: rc.Headers,
+			Exec:    rc.Exec,
+			Timeout: rc.Timeout,
+		}
+		if key, err := r.Validate(); err != nil {
+			lerr(n, key, "receiver %d: %s", i+1, err)
+			continue
+		}
+
+		if slices.ContainsFunc(c.Alerts.Receivers, func(x Receiver) bool { return x.Name == r.Name }) {
+			lerr(n, "name", "duplicate receiver '%s'", r.Name)
+			continue
+		}
+		c.Alerts.Receivers = append(c.Alerts.Receivers, r)
+	}
+
+	rnodes = valueOf(anode, "rules")
+	for i := range cf.Alerts.Rules {
+		rc := &cf.Alerts.Rules[i]
+		n := nth(rnodes, i)
+
+		r := Rule{
+			Name:      rc.Name,
+			When:      rc.When,
+			Clear:     rc.Clear,
+			Window:    rc.Window,
+			For:       rc.For,
+			Repeat:    rc.Repeat,
+			Receivers: rc.Receivers,
+		}
+		if key, err := r.Validate(); err != nil {
+			lerr(n, key, "rule %d: %s", i+1, err)
+			continue
+		}
+
+		if slices.ContainsFunc(c.Alerts.Rules, func(x Rule) bool { return x.Name == r.Name }) {
+			lerr(n, "name", "duplicate rule '%s'", r.Name)
+			continue
+		}
+
+		for _, nm := range r.Receivers {
+			if !slices.ContainsFunc(c.Alerts.Receivers, func(x Receiver) bool { return x.Name == nm }) {
+				lerr(n, "receivers", "%s: unknown receiver '%s'", r.Name, nm)
+			}
+		}
+
+		// a group stands for its targets
+		for _, nm := range rc.Targets {
+			if gi := slices.IndexFunc(c.Groups, func(g Group) bool { return g.Name == nm }); gi >= 0 {
+				r.Targets = append(r.Targets, c.Groups[gi].Targets...)
+				continue
+			}
+			if _, ok := seen[nm]; !ok {
+				lerr(n, "targets", "%s: unknown target or group '%s'", r.Name, nm)
+			}
+			r.Targets = append(r.Targets, nm)
+		}
+		c.Alerts.Rules = append(c.Alerts.Rules, r)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+// fill the settings we don't have from 'd'
+func (t *targetConf) inherit(d *targetConf) {
+	set(&t.Interval, d.Interval)
+	set(&t.Timeout, d.Timeout)
+	set(&t.BatchSize, d.BatchSize)
+	set(&t.Aggregate, d.Aggregate)
+	set(&t.Schedule.Mode, d.Schedule.Mode)
+	set(&t.Schedule.Jitter, d.Schedule.Jitter)
+	set(&t.Schedule.Offset, d.Schedule.Offset)
+	set(&t.Schedule.Concurrency, d.Schedule.Concurrency)
+	set(&t.OutputDir, d.OutputDir)
+	set(&t.BannerMatch, d.BannerMatch)
+	set(&t.StartTls, d.StartTls)
+
+	if len(t.Outputs) == 0 {
+		t.Outputs = d.Outputs
+	}
+	if t.Banner == nil {
+		t.Banner = d.Banner
+	}
+
+	t.Labels = merge(d.Labels, t.Labels)
+
+	r, dr := &t.Request, &d.Request
+	set(&r.Method, dr.Method)
+	set(&r.Path, dr.Path)
+	r.Headers = merge(dr.Headers, r.Headers)
+
+	x, dx := &t.TLS, &d.TLS
+	set(&x.CaFile, dx.CaFile)
+	set(&x.ServerName, dx.ServerName)
+	if x.Insecure == nil {
+		x.Insecure = dx.Insecure
+	}
+
+	set(&t.Udp.Count, d.Udp.Count)
+	set(&t.Udp.Rate, d.Udp.Rate)
+	set(&t.H2.Streams, d.H2.Streams)
+	if t.H2.KeepAlive == nil {
+		t.H2.KeepAlive = d.H2.KeepAlive
+	}
+
+	set(&t.Trace.Proto, d.Trace.Proto)
+	set(&t.Trace.Every, d.Trace.Every)
+	set(&t.Trace.Threshold, d.Trace.Threshold)
+	set(&t.Anomaly.Spike, d.Anomaly.Spike)
+	set(&t.Anomaly.Shift, d.Anomaly.Shift)
+	set(&t.Baseline, d.Baseline)
+	if len(t.SLOs) == 0 {
+		t.SLOs = d.SLOs
+	}
+}
+
+// return the resolved settings for this target. On error, the
+// config key at fault is returned as well.
+func (t *targetConf) pingOpts(base *PingOpts) (PingOpts, string, error) {
+	o := *base
+
+	proto, host, port, err := parsePinger(t.Target)
+	if err != nil {
+		return o, "target", err
+	}
+
+	o.Proto = proto
+	o.Host = host
+	o.Port = port
+	o.Alias = t.Name
+	o.OutputDir = t.OutputDir
+	o.Labels = t.Labels
+
+	override(&o.Interval, t.Interval)
+	override(&o.Timeout, t.Timeout)
+	override(&o.Batchsize, t.BatchSize)
+	override(&o.Aggregate, t.Aggregate)
+	override(&o.Schedule.Mode, strings.ToLower(t.Schedule.Mode))
+	override(&o.Schedule.Jitter, t.Schedule.Jitter)
+	override(&o.Schedule.Concurrency, t.Schedule.Concurrency)
+	override(&o.StartTls, t.StartTls)
+	override(&o.Count, t.Udp.Count)
+	override(&o.Rate, t.Udp.Rate)
+	override(&o.Streams, t.H2.Streams)
+	override(&o.Trace.Proto, t.Trace.Proto)
+	override(&o.Trace.Every, t.Trace.Every)
+	override(&o.Trace.Threshold, t.Trace.Threshold)
+	override(&o.Anomaly.Spike, t.Anomaly.Spike)
+	override(&o.Anomaly.Shift, t.Anomaly.Shift)
+
+	if t.Banner != nil {
+		o.Banner = *t.Banner
+	}
+	if t.H2.KeepAlive != nil {
+		o.KeepAlive = *t.H2.KeepAlive
+	}
+
+	if len(t.Outputs) > 0 {
+		if o.Outputs, err = ParseOutputs(t.Outputs); err != nil {
+			return o, "outputs", err
+		}
+	}
+
+	if len(t.Schedule.Offset) > 0 {
+		if o.Schedule.Offset, err = parseOffset(t.Schedule.Offset); err != nil {
+			return o, "schedule", err
+		}
+	}
+
+	if len(t.Baseline) > 0 {
+		if o.Baseline, err = ParseAge(t.Baseline); err != nil {
+			return o, "baseline", err
+		}
+	}
+
+	for _, sc := range t.SLOs {
+		s := SLO{
+			Name:    sc.Name,
+			Latency: sc.Latency,
+			Phase:   strings.ToLower(sc.Phase),
+		}
+		if s.Objective, err = parseFraction(sc.Objective); err != nil {
+			return o, "slos", fmt.Errorf("slo %s: invalid objective '%s'", sc.Name, sc.Objective)
+		}
+		if s.Window, err = ParseDuration(sc.Window); err != nil {
+			return o, "slos", fmt.Errorf("slo %s: %w", sc.Name, err)
+		}
+		o.SLOs = append(o.SLOs, s)
+	}
+
+	if len(t.BannerMatch) > 0 {
+		if o.BannerMatch, err = regexp.Compile(t.BannerMatch); err != nil {
+			return o, "banner-match", fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+
+	r := &t.Request
+	if len(r.Path) > 0 && !strings.HasPrefix(r.Path, "/") {
+		return o, "request", fmt.Errorf("request path '%s' must start with '/'", r.Path)
+	}
+	o.Request = RequestOpts{
+		Method:  strings.ToUpper(r.Method),
+		Path:    r.Path,
+		Headers: r.Headers,
+	}
+
+	if o.TLS, err = t.TLS.config(base.TLS); err != nil {
+		return o, "tls", err
+	}
+
+	if key, err := o.Validate(); err != nil {
+		return o, key, err
+	}
+	return o, "", nil
+}
+
+// overlay the settings in 'c' on 'r'; on error, return the key at
+// fault as well.
+func (c *retentionConf) apply(r *Retention) (string, error) {
+	ages := []struct {
+		key string
+		s   string
+		a   *Age
+	}{
+		{"batch", c.Batch, &r.Batch},
+		{"daily", c.Daily, &r.Daily},
+		{"rollup", c.Rollup, &r.Rollup},
+		{"compress-after", c.CompressAfter, &r.CompressAfter},
+	}
+
+	for _, x := range ages {
+		if len(x.s) == 0 {
+			continue
+		}
+
+		a, err := ParseAge(x.s)
+		if err != nil {
+			return x.key, err
+		}
+		*x.a = a
+	}
+
+	if len(c.MaxDisk) > 0 {
+		n, err := ParseSize(c.MaxDisk)
+		if err != nil {
+			return "max-disk", err
+		}
+		r.MaxDisk = n
+	}
+
+	override(&r.Compress, strings.ToLower(c.Compress))
+	if _, err := compressSuffix(r.Compress); err != nil {
+		return "compress", err
+	}
+
+	// by default, compress what's no longer written to
+	if len(r.Compress) > 0 && r.CompressAfter.IsZero() {
+		r.CompressAfter = Age{Days: 1}
+	}
+	return "", nil
+}
+
+// make a tls config starting from 'base'
+func (c *tlsConf) config(base *tls.Config) (*tls.Config, error) {
+	if c.Insecure == nil && len(c.CaFile) == 0 && len(c.ServerName) == 0 {
+		return base, nil
+	}
+
+	cfg := &tls.Config{}
+	if base != nil {
+		cfg = base.Clone()
+	}
+
+	if c.Insecure != nil {
+		cfg.InsecureSkipVerify = *c.Insecure
+	}
+	override(&cfg.ServerName, c.ServerName)
+
+	if len(c.CaFile) > 0 {
+		pem, err := os.ReadFile(c.CaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", c.CaFile)
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// set 'a' to 'b' if 'a' is the zero value
+func set[T comparable](a *T, b T) {
+	var z T
+	if *a == z {
+		*a = b
+	}
+}
+
+// set 'a' to 'b' if 'b' isn't the zero value
+func override[T comparable](a *T, b T) {
+	var z T
+	if b != z {
+		*a = b
+	}
+}
+
+// return a new map with the entries of 'b' overlaid on 'a'
+func merge(a, b map[string]string) map[string]string {
+	if len(a) == 0 {
+		return b
+	}
+
+	m := maps.Clone(a)
+	maps.Copy(m, b)
+	return m
+}
+
+// return the value node for 'key' in mapping node 'n'
+func valueOf(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// return the 'i'th item of sequence node 'n'; or 'n' if it has none
+func nth(n *yaml.Node, i int) *yaml.Node {
+	if n != nil && i < len(n.Content) {
+		return n.Content[i]
+	}
+	return n
+}
+
+// return the line# of 'key' in mapping node 'n'; or the line# of 'n'
+// if it doesn't have that key.
+func lineOf(n *yaml.Node, key string) int {
+	if n == nil {
+		return 1
+	}
+
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if k := n.Content[i]; k.Value == key {
+				return k.Line
+			}
+		}
+	}
+	return n.Line
+}
+
+// latmon check-config FILE [FILE..]
+func checkConfigMain(args []string) {
+	var help bool
+
+	fs := pflag.NewFlagSet("check-config", pflag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help message and exit")
+
+	err := fs.Parse(args)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	args = fs.Args()
+	if help || len(args) == 0 {
+		fmt.Printf(`%s check-config: validate config files without starting probes
+
+Usage: %s check-config FILE [FILE..]
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	rc := 0
+	base := defaultPingOpts()
+	for _, fn := range args {
+		c, err := ReadConfig(fn, &base)
+		if err != nil {
+			Warn("%s", err)
+			rc = 1
+			continue
+		}
+
+		fmt.Printf("%s: OK, %d targets\n", fn, len(c.Targets))
+		for i := range c.Targets {
+			o := &c.Targets[i]
+			fmt.Printf("    %-24s %s:%s:%d every %s, timeout %s, batch %d\n",
+				o.Name(), o.Proto, o.Host, o.Port, o.Interval, o.Timeout, o.Batchsize)
+			for _, x := range o.SLOs {
+				fmt.Printf("        slo %-16s %g%% %s over %s\n", x.Name, 100*x.Objective, x.Indicator(), plot.Window(x.Window))
+			}
+		}
+		for _, g := range c.Groups {
+			fmt.Printf("    group %-18s %s of %s\n", g.Name, g.Phase, strings.Join(g.Targets, ", "))
+		}
+		for _, r := range c.Alerts.Rules {
+			on := "all targets"
+			if len(r.Targets) > 0 {
+				on = strings.Join(r.Targets, ", ")
+			}
+			fmt.Printf("    alert %-18s %s for %s on %s -> %s\n", r.Name, r.When, r.For, on, strings.Join(r.Receivers, ", "))
+		}
+	}
+	os.Exit(rc)
+}
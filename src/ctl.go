@@ -0,0 +1,470 @@
+// ctl.go - control socket and the 'ctl' sub-command
+//
+// The control socket is a unix domain socket; each request and
+// response is a single line of JSON:
+//
+//	{"cmd": "stats", "target": "example"}
+//	{"ok": true, "data": [...]}
+//
+// Access is controlled by the file mode of the socket.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/opencoff/pflag"
+)
+
+// max time for a request and its response
+const _CtlTimeout = 30 * time.Second
+
+type ctlRequest struct {
+	Cmd    string `json:"cmd"`
+	Target string `json:"target,omitempty"`
+	Arg    string `json:"arg,omitempty"`
+}
+
+type ctlResponse struct {
+	Ok    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type ctlServer struct {
+	d  *daemon
+	fn string
+	ln *net.UnixListener
+	wg sync.WaitGroup
+}
+
+// listen on the control socket 'fn' with file mode 'mode'
+func newCtlServer(d *daemon, fn string, mode os.FileMode) (*ctlServer, error) {
+	if err := removeStale(fn); err != nil {
+		return nil, err
+	}
+
+	// don't let anyone in before the mode is set: bind in a private
+	// dir and move the socket into place after
+	dir, err := os.MkdirTemp(filepath.Dir(fn), ".latmon-ctl")
+	if err != nil {
+		return nil, fmt.Errorf("ctl: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("ctl: %w", err)
+	}
+	ln.SetUnlinkOnClose(false)
+
+	if err = os.Chmod(tmp, mode); err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("ctl: %w", err)
+	}
+
+	s := &ctlServer{
+		d:  d,
+		fn: fn,
+		ln: ln,
+	}
+
+	d.log.Info("ctl: listening on %s (mode %#o)", fn, mode)
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+func (s *ctlServer) Stop() {
+	s.ln.Close()
+	os.Remove(s.fn)
+	s.wg.Wait()
+}
+
+// remove a control socket left behind by an earlier run; refuse to
+// clobber one that is in use or anything that isn't a socket.
+func removeStale(fn string) error {
+	fi, err := os.Lstat(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("ctl: %w", err)
+	}
+
+	if fi.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("ctl: %s exists and is not a socket", fn)
+	}
+
+	if c, err := net.Dial("unix", fn); err == nil {
+		c.Close()
+		return fmt.Errorf("ctl: %s is in use", fn)
+	}
+	return os.Remove(fn)
+}
+
+func (s *ctlServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.d.log.Warn("ctl: accept: %s", err)
+			}
+			return
+		}
+
+		s.wg.Add(1)
+		go func(c net.Conn) {
+			s.handle(c)
+			c.Close()
+			s.wg.Done()
+		}(conn)
+	}
+}
+
+// serve requests on 'c' until the client is done
+func (s *ctlServer) handle(c net.Conn) {
+	rd := bufio.NewReader(c)
+	enc := json.NewEncoder(c)
+	for {
+		c.SetDeadline(time.Now().Add(_CtlTimeout))
+		b, err := rd.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				s.d.log.Debug("ctl: read: %s", err)
+			}
+			return
+		}
+
+		var req ctlRequest
+		var resp ctlResponse
+
+		data, err := s.do(&req, b)
+		if err == nil && data != nil {
+			resp.Data, err = json.Marshal(data)
+		}
+
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Ok = true
+		}
+
+		if err = enc.Encode(&resp); err != nil {
+			s.d.log.Debug("ctl: write: %s", err)
+			return
+		}
+	}
+}
+
+// decode and run a single request
+func (s *ctlServer) do(req *ctlRequest, b []byte) (any, error) {
+	if err := json.Unmarshal(b, req); err != nil {
+		return nil, fmt.Errorf("malformed request: %w", err)
+	}
+
+	d := s.d
+	d.log.Debug("ctl: %s %s %s", req.Cmd, req.Target, req.Arg)
+
+	needTarget := func() error {
+		if len(req.Target) == 0 {
+			return fmt.Errorf("%s: missing target", req.Cmd)
+		}
+		return nil
+	}
+
+	switch req.Cmd {
+	case "list", "stats":
+		return d.list(req.Target)
+
+	case "flush":
+		return nil, d.flush(req.Target)
+
+	case "pause":
+		if err := needTarget(); err != nil {
+			return nil, err
+		}
+		return nil, d.pause(req.Target)
+
+	case "resume":
+		if err := needTarget(); err != nil {
+			return nil, err
+		}
+		return nil, d.resume(req.Target)
+
+	case "add":
+		if len(req.Arg) == 0 {
+			return nil, fmt.Errorf("add: missing target spec")
+		}
+		return d.add(req.Arg, req.Target)
+
+	case "remove":
+		if err := needTarget(); err != nil {
+			return nil, err
+		}
+		return nil, d.remove(req.Target)
+
+	case "reload":
+		return nil, d.reload()
+
+	case "log-level":
+		return nil, d.setLogLevel(strings.ToUpper(req.Arg))
+
+	case "alerts":
+		return d.alr.List(), nil
+
+	default:
+		return nil, fmt.Errorf("unknown command '%s'", req.Cmd)
+	}
+}
+
+// latmon ctl [options] CMD [ARGS]
+func ctlMain(args []string) {
+	var help, asJson bool
+	var sock string
+
+	fs := pflag.NewFlagSet("ctl", pflag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help message and exit")
+	fs.StringVarP(&sock, "socket", "s", "", "Use control socket `S`")
+	fs.BoolVarP(&asJson, "json", "j", false, "Print the raw JSON response")
+
+	err := fs.Parse(args)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	args = fs.Args()
+	if help || len(args) == 0 {
+		fmt.Printf(`%s ctl: manage a running latmon via its control socket
+
+Usage: %s ctl -s SOCKET CMD [ARGS]
+
+Where CMD is one of:
+
+	list                  list the targets and their state
+	stats TARGET          show the current batch stats for TARGET
+	flush [TARGET]        write the current batch of TARGET (or all) to disk
+	pause TARGET          stop probing TARGET; its stats are kept
+	resume TARGET         resume probing TARGET
+	add SPEC [NAME]       add a target (eg tcp:db.example.com:5432)
+	remove TARGET         stop TARGET and write its stats to disk
+	reload                reload the targets (same as SIGHUP)
+	log-level LEVEL       change the log level
+	alerts                list the pending and firing alerts
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	if len(sock) == 0 {
+		Die("ctl: missing control socket (-s)")
+	}
+
+	req, err := ctlParse(args)
+	if err != nil {
+		Die("ctl: %s", err)
+	}
+
+	resp, err := ctlDo(sock, req)
+	if err != nil {
+		Die("ctl: %s", err)
+	}
+
+	if asJson {
+		b, _ := json.Marshal(resp)
+		fmt.Printf("%s\n", b)
+		return
+	}
+
+	if !resp.Ok {
+		Die("%s", resp.Error)
+	}
+
+	switch req.Cmd {
+	case "list":
+		var ti []TargetInfo
+		if err := json.Unmarshal(resp.Data, &ti); err != nil {
+			Die("ctl: %s", err)
+		}
+		printList(ti)
+
+	case "stats":
+		var ti []TargetInfo
+		if err := json.Unmarshal(resp.Data, &ti); err != nil {
+			Die("ctl: %s", err)
+		}
+		for i := range ti {
+			printStats(&ti[i])
+		}
+
+	case "add":
+		var nm string
+		json.Unmarshal(resp.Data, &nm)
+		fmt.Printf("added %s\n", nm)
+
+	case "alerts":
+		var v []AlertState
+		if err := json.Unmarshal(resp.Data, &v); err != nil {
+			Die("ctl: %s", err)
+		}
+		printAlerts(v)
+
+	default:
+		fmt.Printf("ok\n")
+	}
+}
+
+// make a request from the command line args
+func ctlParse(args []string) (*ctlRequest, error) {
+	req := &ctlRequest{
+		Cmd: args[0],
+	}
+
+	args = args[1:]
+	nargs := func(lo, hi int) error {
+		if len(args) < lo || len(args) > hi {
+			return fmt.Errorf("%s: wrong number of args", req.Cmd)
+		}
+		return nil
+	}
+
+	var err error
+	switch req.Cmd {
+	case "list", "reload", "alerts":
+		err = nargs(0, 0)
+	case "flush":
+		err = nargs(0, 1)
+		if len(args) > 0 {
+			req.Target = args[0]
+		}
+	case "stats", "pause", "resume", "remove":
+		err = nargs(1, 1)
+		if err == nil {
+			req.Target = args[0]
+		}
+	case "add":
+		err = nargs(1, 2)
+		if err == nil {
+			req.Arg = args[0]
+			if len(args) > 1 {
+				req.Target = args[1]
+			}
+		}
+	case "log-level":
+		err = nargs(1, 1)
+		if err == nil {
+			req.Arg = args[0]
+		}
+	default:
+		err = fmt.Errorf("unknown command '%s'", req.Cmd)
+	}
+	return req, err
+}
+
+// send 'req' to the control socket 'sock' and return the response
+func ctlDo(sock string, req *ctlRequest) (*ctlResponse, error) {
+	c, err := net.DialTimeout("unix", sock, _CtlTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(_CtlTimeout))
+	if err = json.NewEncoder(c).Encode(req); err != nil {
+		return nil, err
+	}
+
+	var resp ctlResponse
+	if err = json.NewDecoder(c).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func printList(ti []TargetInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "NAME\tTARGET\tEVERY\tSTATE\tBATCH\tSINCE\n")
+	for i := range ti {
+		t := &ti[i]
+		state := "running"
+		if t.Paused {
+			state = "paused"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s:%s:%d\t%s\t%s\t%d/%d\t%s\n", t.Name, t.Proto, t.Host, t.Port,
+			t.Interval, state, t.Samples, t.Batchsize, t.Start.Local().Format(time.DateTime))
+	}
+	tw.Flush()
+}
+
+func printAlerts(v []AlertState) {
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "RULE\tTARGET\tSTATE\tVALUE\tSINCE\n")
+	for i := range v {
+		a := &v[i]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", a.Rule, a.Target, a.State, a.Value, a.Since.Local().Format(time.DateTime))
+	}
+	tw.Flush()
+}
+
+func printStats(t *TargetInfo) {
+	fmt.Printf("%s: %s:%s:%d; %d/%d samples since %s\n", t.Name, t.Proto, t.Host, t.Port,
+		t.Samples, t.Batchsize, t.Start.Local().Format(time.DateTime))
+
+	tw := tabwriter.NewWriter(os.Stdout, 2, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "\tn\tmin\tavg\tp50\tp90\tp95\tp99\tmax\t\n")
+	for _, c := range t.Columns {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", c.Name, c.N,
+			round(c.Min), round(c.Avg), round(c.P50), round(c.P90), round(c.P95), round(c.P99), round(c.Max))
+	}
+	tw.Flush()
+
+	for _, c := range t.Counters {
+		fmt.Printf("    %s: %d\n", c.Name, c.Val)
+	}
+	if len(t.Path) > 0 {
+		fmt.Printf("    path: %s\n", t.Path)
+	}
+}
+
+// round 'd' to a readable precision
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(time.Microsecond)
+	default:
+		return d
+	}
+}
+
+// parse an octal file mode
+func parseMode(s string) (os.FileMode, error) {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0777 {
+		return 0, fmt.Errorf("invalid file mode '%s'", s)
+	}
+	return os.FileMode(v), nil
+}
@@ -0,0 +1,350 @@
+// daemon.go - the set of running targets
+//
+// Targets are started at startup and changed at runtime via reload
+// (SIGHUP) and the control socket.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+)
+
+type daemon struct {
+	sync.Mutex
+
+	ctx context.Context
+	m   *Measurer
+	log *levelLog
+
+	// to rebuild the targets on reload
+	base    PingOpts
+	ret     Retention
+	args    []string
+	cfgFile string
+	cfgDir  bool
+
+	// output dir from the config file; for targets added at runtime
+	outdir string
+
+	running map[string]PingOpts
+
+	// applies the retention policy to the outputs
+	jan *janitor
+
+	// compares the groups of targets
+	cmp *comparer
+
+	// evaluates the alert rules
+	alr *alerter
+}
+
+// TargetInfo describes a running target
+type TargetInfo struct {
+	Proto    string `json:"proto"`
+	Host     string `json:"host"`
+	Port     uint16 `json:"port"`
+	Interval string `json:"interval"`
+
+	TargetStatus
+}
+
+// start target 'opt'
+func (d *daemon) start(opt *PingOpts) error {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.startLocked(opt)
+}
+
+func (d *daemon) startLocked(opt *PingOpts) error {
+	opt.Logger = d.log
+	if err := startTarget(d.ctx, d.m, opt); err != nil {
+		return err
+	}
+	d.running[opt.Name()] = *opt
+	return nil
+}
+
+// reload the targets and reconcile the running targets with them:
+// new targets are started, removed ones are stopped and flushed and
+// changed ones are restarted. Unchanged targets are left alone.
+func (d *daemon) reload() error {
+	targets, g, err := loadTargets(&d.base, &d.ret, d.args, d.cfgFile, d.cfgDir, d.log.Warn)
+	if err != nil {
+		return err
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.outdir = g.outdir
+	d.jan.Set(g.retention)
+	d.cmp.Set(g.groups)
+	d.alr.Set(g.alerts)
+
+	want := make(map[string]bool)
+	for i := range targets {
+		want[targets[i].Name()] = true
+	}
+
+	for nm := range d.running {
+		if !want[nm] {
+			d.log.Info("reload: %s: removed", nm)
+			d.removeLocked(nm)
+		}
+	}
+
+	var added, changed int
+	for i := range targets {
+		opt := &targets[i]
+		opt.Logger = d.log
+
+		nm := opt.Name()
+		old, restart := d.running[nm]
+		if restart {
+			if old.Equal(opt) {
+				continue
+			}
+
+			d.log.Info("reload: %s: changed; restarting ..", nm)
+			if err := d.m.Detach(nm); err != nil {
+				d.log.Warn("reload: %s", err)
+			}
+			delete(d.running, nm)
+			changed++
+		} else {
+			d.log.Info("reload: %s: added", nm)
+			added++
+		}
+
+		if err := d.startLocked(opt); err != nil {
+			d.log.Warn("reload: %s: %s", nm, err)
+
+			// write out the day of the old target
+			if restart {
+				d.m.Forget(nm)
+			}
+		}
+	}
+
+	d.log.Info("reload: %d targets; %d added, %d changed", len(d.running), added, changed)
+	return nil
+}
+
+// add a new target described by 'spec' (eg tcp:host:port) and an
+// optional name
+func (d *daemon) add(spec, name string) (string, error) {
+	targets, err := makeTargets(&d.base, []string{spec})
+	if err != nil {
+		return "", err
+	}
+
+	opt := &targets[0]
+	opt.Alias = name
+
+	d.Lock()
+	defer d.Unlock()
+
+	opt.OutputDir = d.outdir
+
+	nm := opt.Name()
+	if _, ok := d.running[nm]; ok {
+		return "", fmt.Errorf("%s: target exists", nm)
+	}
+
+	if err := d.startLocked(opt); err != nil {
+		return "", err
+	}
+	d.log.Info("ctl: %s: added", nm)
+	return nm, nil
+}
+
+// stop and flush target 'nm'
+func (d *daemon) remove(nm string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.running[nm]; !ok {
+		return fmt.Errorf("%s: unknown target", nm)
+	}
+	return d.removeLocked(nm)
+}
+
+func (d *daemon) removeLocked(nm string) error {
+	delete(d.running, nm)
+	return d.m.Remove(nm)
+}
+
+func (d *daemon) pause(nm string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, ok := d.running[nm]; !ok {
+		return fmt.Errorf("%s: unknown target", nm)
+	}
+	return d.m.Pause(nm)
+}
+
+func (d *daemon) resume(nm string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	opt, ok := d.running[nm]
+	if !ok {
+		return fmt.Errorf("%s: unknown target", nm)
+	}
+
+	st, err := d.m.Status(nm)
+	if err != nil {
+		return err
+	}
+	if !st.Paused {
+		return fmt.Errorf("%s: not paused", nm)
+	}
+
+	d.log.Info("%s: resuming ..", nm)
+	return d.startLocked(&opt)
+}
+
+// return the state of target 'nm' (or all the targets if empty)
+func (d *daemon) list(nm string) ([]TargetInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	names := []string{nm}
+	if len(nm) == 0 {
+		names = names[:0]
+		for k := range d.running {
+			names = append(names, k)
+		}
+		slices.Sort(names)
+	}
+
+	ti := make([]TargetInfo, 0, len(names))
+	for _, k := range names {
+		opt, ok := d.running[k]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown target", k)
+		}
+
+		st, err := d.m.Status(k)
+		if err != nil {
+			return nil, err
+		}
+
+		ti = append(ti, TargetInfo{
+			Proto:        opt.Proto,
+			Host:         opt.Host,
+			Port:         opt.Port,
+			Interval:     opt.Interval.String(),
+			TargetStatus: st,
+		})
+	}
+	return ti, nil
+}
+
+// return the options of running target 'nm'
+func (d *daemon) lookup(nm string) (PingOpts, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	opt, ok := d.running[nm]
+	return opt, ok
+}
+
+// return the stats dir and interval of target 'nm'; it needn't be
+// running.
+func (d *daemon) locate(nm string) (string, time.Duration, error) {
+	if opt, ok := d.lookup(nm); ok {
+		st, err := d.m.Status(nm)
+		if err == nil {
+			return st.StatsDir, opt.Interval, nil
+		}
+	}
+
+	if nm != filepath.Base(nm) || nm == "." || nm == ".." {
+		return "", 0, fmt.Errorf("%s: unknown target", nm)
+	}
+
+	dir := filepath.Join(d.statsDir(), nm)
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return "", 0, fmt.Errorf("%s: unknown target", nm)
+	}
+	return dir, d.m.interval, nil
+}
+
+// return the output dir of the targets without one of their own
+func (d *daemon) outputDir() string {
+	d.Lock()
+	defer d.Unlock()
+
+	if len(d.outdir) > 0 {
+		return d.outdir
+	}
+	return d.m.outdir
+}
+
+// return the dir with the stats of all the targets
+func (d *daemon) statsDir() string {
+	return filepath.Join(d.outputDir(), "stats")
+}
+
+// return the output dirs of all the targets
+func (d *daemon) outputDirs() []string {
+	v := []string{d.outputDir()}
+
+	d.Lock()
+	defer d.Unlock()
+
+	for _, o := range d.running {
+		if len(o.OutputDir) > 0 && !slices.Contains(v, o.OutputDir) {
+			v = append(v, o.OutputDir)
+		}
+	}
+	return v
+}
+
+// flush target 'nm' (or all the targets if empty)
+func (d *daemon) flush(nm string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if len(nm) > 0 {
+		return d.m.Flush(nm)
+	}
+
+	for k := range d.running {
+		if err := d.m.Flush(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *daemon) setLogLevel(lvl string) error {
+	p, ok := logger.ToPriority(lvl)
+	if !ok {
+		return fmt.Errorf("unknown log level '%s'", lvl)
+	}
+
+	d.log.SetPrio(p)
+	d.log.Info("log level set to %s", lvl)
+	return nil
+}
+
+// stop all the targets
+func (d *daemon) stop() {
+	d.Lock()
+	defer d.Unlock()
+
+	d.m.Stop()
+	clear(d.running)
+}
@@ -0,0 +1,144 @@
+// h2.go - http/2 pinger
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/http"
+)
+
+type h2ping struct {
+	PingOpts
+
+	log  logger.Logger
+	url  string
+	cl   *http.Client
+	ch   chan H2Result
+	conn *http.H2Conn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ Pinger = &h2ping{}
+
+func NewH2(cx context.Context, opts PingOpts) (*h2ping, chan H2Result, error) {
+	if opts.Streams <= 0 {
+		opts.Streams = 1
+	}
+
+	ctx, cancel := context.WithCancel(cx)
+	h := &h2ping{
+		PingOpts: opts,
+		log:      opts.Logger.New("h2", 0),
+		url:      fmt.Sprintf("https://%s:%d", opts.Host, opts.Port),
+		cl:       opts.newClient(),
+		ch:       make(chan H2Result, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	h.log.Info("starting h2 pinger: %s, every %s, timeout %s, %d streams, keepalive %v",
+		h.url, h.Interval, h.Timeout, h.Streams, h.KeepAlive)
+
+	h.wg.Add(1)
+	go h.run()
+
+	return h, h.ch, nil
+}
+
+func (h *h2ping) Stop() {
+	h.cancel()
+	h.wg.Wait()
+	close(h.ch)
+	h.log.Info("stopped h2 pinger: %s", h.url)
+}
+
+func (h *h2ping) run() {
+	sch := newSchedule(h.Interval, h.Schedule)
+	defer func() {
+		sch.Stop()
+		if h.conn != nil {
+			h.conn.Close()
+		}
+		h.wg.Done()
+	}()
+
+	var errs failures
+	sch.run(h.ctx.Done(), h.Schedule.Concurrency, func(tk Tick) {
+		h.log.Debug("ping %s ..", h.url)
+		r, err := h.ping()
+		if err != nil {
+			errs.failed(h.log, h.url, err)
+			h.ch <- H2Result{Tick: tk, Err: err}
+			return
+		}
+		errs.ok(h.log, h.url)
+		r.Tick = tk
+		h.ch <- r
+	})
+}
+
+func (h *h2ping) ping() (H2Result, error) {
+	var r H2Result
+
+	conn := h.conn
+	if conn == nil {
+		var err error
+
+		conn, err = h.cl.DialH2(h.ctx, h.Host, int(h.Port))
+		if err != nil {
+			return r, err
+		}
+
+		r.NewConn = true
+		r.DnsRtt = conn.Tcp.Dns
+		r.ConnRtt = conn.Tcp.Tcp
+		r.TlsRtt = conn.Tls
+		r.SettingsRtt = conn.Settings
+
+		if h.KeepAlive {
+			h.log.Info("%s: new connection: %s", h.url, r)
+			h.conn = conn
+		}
+	}
+
+	reqs := make([]*http.Request, h.Streams)
+	for i := range reqs {
+		reqs[i] = h.newRequest(h.url)
+	}
+
+	streams, err := conn.Do(reqs)
+	if err != nil || !h.KeepAlive {
+		conn.Close()
+	}
+	if err != nil && h.KeepAlive {
+		h.conn = nil
+	}
+	if err != nil {
+		return r, err
+	}
+
+	var tot time.Duration
+	for i := range streams {
+		s := &streams[i]
+		if s.Err != nil {
+			return r, s.Err
+		}
+
+		tot += s.Ttfb
+		r.TtfbMax = max(r.TtfbMax, s.Ttfb)
+		r.StreamsRtt = max(r.StreamsRtt, s.Done)
+	}
+	r.Ttfb = tot / time.Duration(len(streams))
+
+	// setup times are only a part of the sample when every tick
+	// makes a new connection
+	r.Setup = !h.KeepAlive
+	return r, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const _H2Delay = 20 * time.Millisecond
+
+// start a local h2 server whose responses take _H2Delay; return it
+// and the settings for an h2 target on it
+func startH2(t *testing.T, streams int, keepalive bool) (*httptest.Server, PingOpts) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("request over %s", r.Proto)
+		}
+		time.Sleep(_H2Delay)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	pn, _ := strconv.Atoi(port)
+
+	o := testPingOpts(t, "h2", pn)
+	o.Interval = 100 * time.Millisecond
+	o.Streams = streams
+	o.KeepAlive = keepalive
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	o.TLS = &tls.Config{RootCAs: pool}
+	return srv, o
+}
+
+// return the next successful result on 'ch'; fail after 'n' errors
+func h2Result(t *testing.T, ch chan H2Result, n int) H2Result {
+	t.Helper()
+	for i := 0; ; i++ {
+		r := recvResult(t, ch)
+		if r.Err == nil {
+			return r
+		}
+		if i == n {
+			t.Fatalf("h2: %s", r.Err)
+		}
+	}
+}
+
+func TestH2Streams(t *testing.T) {
+	_, o := startH2(t, 3, false)
+	h, ch, err := NewH2(context.Background(), o)
+	if err != nil {
+		t.Fatalf("h2: %s", err)
+	}
+	defer discard(h, ch)
+
+	for i := 0; i < 2; i++ {
+		r := h2Result(t, ch, 0)
+		if !r.NewConn || !r.Setup {
+			t.Fatalf("probe %d: new conn %v, setup %v; want a new conn per probe", i, r.NewConn, r.Setup)
+		}
+		if r.Ttfb < _H2Delay || r.TtfbMax < r.Ttfb || r.StreamsRtt < r.TtfbMax {
+			t.Fatalf("probe %d: bad stream timings: %s", i, r)
+		}
+		if r.TlsRtt <= 0 || r.SettingsRtt <= 0 {
+			t.Fatalf("probe %d: no setup timings: %s", i, r)
+		}
+	}
+}
+
+func TestH2KeepAlive(t *testing.T) {
+	srv, o := startH2(t, 2, true)
+	h, ch, err := NewH2(context.Background(), o)
+	if err != nil {
+		t.Fatalf("h2: %s", err)
+	}
+	defer discard(h, ch)
+
+	r := h2Result(t, ch, 0)
+	if !r.NewConn || r.Setup {
+		t.Fatalf("first probe: new conn %v, setup %v; want a new conn without setup", r.NewConn, r.Setup)
+	}
+	if r.Ttfb < _H2Delay {
+		t.Fatalf("first probe: ttfb %s < %s", r.Ttfb, _H2Delay)
+	}
+
+	r = h2Result(t, ch, 0)
+	if r.NewConn || r.Setup {
+		t.Fatalf("second probe: new conn %v, setup %v; want the kept connection", r.NewConn, r.Setup)
+	}
+
+	// the probe on the closed connection may fail; the one after it
+	// reconnects
+	srv.CloseClientConnections()
+	r = h2Result(t, ch, 1)
+	if !r.NewConn {
+		r = h2Result(t, ch, 1)
+	}
+	if !r.NewConn || r.Setup {
+		t.Fatalf("after close: new conn %v, setup %v; want a new conn", r.NewConn, r.Setup)
+	}
+
+	// its setup times make up the reconnect column
+	if r.ConnRtt <= 0 || r.TlsRtt <= 0 || r.SettingsRtt <= 0 {
+		t.Fatalf("after close: no setup times: tcp %s, tls %s, settings %s", r.ConnRtt, r.TlsRtt, r.SettingsRtt)
+	}
+}
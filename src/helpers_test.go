@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+)
+
+func testLogger(t *testing.T) logger.Logger {
+	log, err := logger.NewLogger("STDERR", logger.LOG_WARNING, "latmon-test", 0)
+	if err != nil {
+		t.Fatalf("logger: %s", err)
+	}
+	return log
+}
+
+// return the settings for a target on loopback that probes right away
+func testPingOpts(t *testing.T, proto string, port int) PingOpts {
+	o := defaultPingOpts()
+	o.Host = "127.0.0.1"
+	o.Port = uint16(port)
+	o.Proto = proto
+	o.Interval = time.Second
+	o.Timeout = time.Second
+	o.Schedule.Offset = 0
+	o.Logger = testLogger(t)
+	if _, err := o.Validate(); err != nil {
+		t.Fatalf("%s: %s", proto, err)
+	}
+	return o
+}
+
+// return the next result on 'ch' or fail after 5s
+func recvResult[T any](t *testing.T, ch chan T) T {
+	t.Helper()
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no result")
+	}
+	panic("unreachable")
+}
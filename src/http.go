@@ -5,7 +5,6 @@ import (
 	"context"
 	"fmt"
 	"sync"
-	"time"
 
 	logger "github.com/opencoff/go-logger"
 	"github.com/opencoff/latmon/internal/http"
@@ -32,7 +31,7 @@ func NewHttps(cx context.Context, opts PingOpts) (*hping, chan HttpsResult, erro
 		PingOpts: opts,
 		log:      opts.Logger.New("https", 0),
 		url:      fmt.Sprintf("https://%s:%d", opts.Host, opts.Port),
-		cl:       http.NewClient(opts.Timeout),
+		cl:       opts.newClient(),
 		ch:       make(chan HttpsResult, 1),
 		ctx:      ctx,
 		cancel:   cancel,
@@ -54,49 +53,39 @@ func (h *hping) Stop() {
 }
 
 func (h *hping) run() {
-	tick := time.NewTicker(h.Interval)
+	sch := newSchedule(h.Interval, h.Schedule)
 	defer func() {
-		tick.Stop()
+		sch.Stop()
 		h.wg.Done()
 	}()
 
-	done := h.ctx.Done()
-	errs := 0
-	for {
-		select {
-		case <-tick.C:
-			h.log.Debug("ping %s ..", h.url)
-			resp, err := h.ping()
-			if err != nil {
-				errs += 1
-				if errs > 3 {
-					h.log.Warn("%s\nToo many errors. Bailing ..", err)
-					Die("http: %s; too many errors. Exiting!", h.url)
-				}
-				h.log.Warn("%s", err)
-				continue
-			}
-			errs = 0
-			resp.Body.Close()
-
-			// send out measurements
-			h.ch <- HttpsResult{
-				DnsRtt:   resp.Dns,
-				ConnRtt:  resp.Tcp,
-				TlsRtt:   resp.Tls,
-				HttpRtt:  resp.Http,
-				HttpsRtt: resp.E2e,
-			}
-
-		case <-done:
+	var errs failures
+	sch.run(h.ctx.Done(), h.Schedule.Concurrency, func(tk Tick) {
+		h.log.Debug("ping %s ..", h.url)
+		resp, err := h.ping()
+		if err != nil {
+			errs.failed(h.log, h.url, err)
+			h.ch <- HttpsResult{Tick: tk, Err: err}
 			return
 		}
-	}
+		errs.ok(h.log, h.url)
+		resp.Body.Close()
+
+		// send out measurements
+		h.ch <- HttpsResult{
+			DnsRtt:   resp.Dns,
+			ConnRtt:  resp.Tcp,
+			TlsRtt:   resp.Tls,
+			HttpRtt:  resp.Http,
+			HttpsRtt: resp.E2e,
+			Tick:     tk,
+		}
+	})
 }
 
 func (h *hping) ping() (*http.Response, error) {
-	req := http.NewRequest("HEAD", h.url)
-	req.Headers.Add("Connection", "close")
+	req := h.newRequest(h.url)
+	req.Headers.Set("Connection", "close")
 
 	return h.cl.Do(req, h.ctx)
 }
@@ -0,0 +1,460 @@
+// index.go - index pages of the outputs
+//
+// After each flush the Measurer regenerates the index of the target
+// and the index of its output dir:
+//
+//	index.html                  every target with the availability and
+//	                            p99 of its latest batch; comparisons
+//	charts/<target>/index.html  the reports of the target by date with
+//	                            links to their charts and csv files
+//
+// Both are made from what's on disk: a target that's gone is still
+// listed. Each is written to a temp file and renamed so that a reader
+// never sees a partial page.
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+// the files of a report: a base name, an optional kind and the type
+var indexFileRe = regexp.MustCompile(`^(.+?)(-summary|-errors|-hist|-worst|-spark|-path|-events|-baseline|-slo)?\.(html|svg|png|csv)(\.gz|\.zst)?$`)
+
+// availability below this is flagged
+const _IndexAvailWarn = 0.99
+
+// the files of a batch, day, rollup or report
+type indexReport struct {
+	Name  string
+	Kind  string
+	Time  time.Time
+	Spark string
+
+	// links to the charts and to the csv files
+	Charts []indexLink
+	Data   []indexLink
+}
+
+type indexLink struct {
+	Name string
+	Href string
+}
+
+// the reports of a day
+type indexDay struct {
+	Day     string
+	Reports []*indexReport
+}
+
+// a target in the index of its output dir
+type indexTarget struct {
+	Name    string
+	Phase   string
+	Avail   string
+	P99     string
+	Updated string
+	Warn    bool
+
+	// the latest daily chart (if any)
+	Daily string
+}
+
+// a comparison group and its days
+type indexGroup struct {
+	Name  string
+	Pages []indexLink
+}
+
+// regenerate the index of 'hs' and of its output dir
+func (m *Measurer) updateIndex(hs *hostStats) {
+	m.indexing.Lock()
+	defer m.indexing.Unlock()
+
+	outdir := filepath.Dir(filepath.Dir(hs.chartDir))
+	if err := writeIndexes(outdir, hs.name); err != nil {
+		m.log.Warn("index: %s: %s", hs.name, err)
+	}
+}
+
+// write the index of target 'nm' and of 'outdir'
+func writeIndexes(outdir, nm string) error {
+	if err := writeHostIndex(outdir, nm); err != nil {
+		return err
+	}
+	return writeRootIndex(outdir)
+}
+
+// write charts/<nm>/index.html
+func writeHostIndex(outdir, nm string) error {
+	chdir := filepath.Join(outdir, "charts", nm)
+	stdir := filepath.Join(outdir, "stats", nm)
+	if err := os.MkdirAll(chdir, 0750); err != nil {
+		return err
+	}
+
+	reps := make(map[string]*indexReport)
+	add := func(dir, rel string, charts bool) {
+		de, _ := os.ReadDir(dir)
+		for _, e := range de {
+			m := indexFileRe.FindStringSubmatch(e.Name())
+			if m == nil || !e.Type().IsRegular() || e.Name() == "index.html" {
+				continue
+			}
+
+			r, ok := reps[m[1]]
+			if !ok {
+				r = &indexReport{Name: m[1]}
+				r.Kind, r.Time = reportKind(m[1])
+				reps[m[1]] = r
+			}
+
+			href := rel + e.Name()
+			switch {
+			case m[2] == "-spark":
+				r.Spark = href
+			case charts:
+				r.Charts = append(r.Charts, indexLink{m[3], href})
+			case len(m[2]) > 0:
+				r.Data = append(r.Data, indexLink{m[2][1:], href})
+			default:
+				r.Data = append(r.Data, indexLink{"csv", href})
+			}
+		}
+	}
+	add(chdir, "", true)
+	add(stdir, "../../stats/"+nm+"/", false)
+
+	// days newest first with the daily report on top; then the longer
+	// rollups and the reports
+	var days []indexDay
+	var rollups, others []*indexReport
+	for _, r := range reps {
+		switch r.Kind {
+		case "week", "month":
+			rollups = append(rollups, r)
+		case "report":
+			others = append(others, r)
+		default:
+			day := r.Time.Format("2006-01-02")
+			i := slices.IndexFunc(days, func(d indexDay) bool { return d.Day == day })
+			if i < 0 {
+				days = append(days, indexDay{Day: day})
+				i = len(days) - 1
+			}
+			days[i].Reports = append(days[i].Reports, r)
+		}
+	}
+
+	slices.SortFunc(days, func(a, b indexDay) int { return strings.Compare(b.Day, a.Day) })
+	for i := range days {
+		slices.SortFunc(days[i].Reports, func(a, b *indexReport) int {
+			if x, y := a.Kind == "daily", b.Kind == "daily"; x != y {
+				if x {
+					return -1
+				}
+				return 1
+			}
+			return cmp.Or(b.Time.Compare(a.Time), strings.Compare(a.Name, b.Name))
+		})
+	}
+	slices.SortFunc(rollups, func(a, b *indexReport) int { return b.Time.Compare(a.Time) })
+	slices.SortFunc(others, func(a, b *indexReport) int { return strings.Compare(a.Name, b.Name) })
+
+	t := indexTarget{Name: nm}
+	indexBadges(&t, stdir, chdir)
+
+	return writeAtomic(filepath.Join(chdir, "index.html"), hostIndexTmpl, struct {
+		Target  indexTarget
+		Days    []indexDay
+		Rollups []*indexReport
+		Reports []*indexReport
+		Now     string
+	}{t, days, rollups, others, time.Now().Format(time.RFC1123)})
+}
+
+// write the index.html of 'outdir'
+func writeRootIndex(outdir string) error {
+	var targets []indexTarget
+	de, _ := os.ReadDir(filepath.Join(outdir, "charts"))
+	for _, e := range de {
+		if !e.IsDir() {
+			continue
+		}
+
+		nm := e.Name()
+		t := indexTarget{Name: nm}
+		indexBadges(&t, filepath.Join(outdir, "stats", nm), filepath.Join(outdir, "charts", nm))
+		targets = append(targets, t)
+	}
+
+	// the comparisons of each group (newest first) and the ad hoc ones
+	var groups []indexGroup
+	var compares []indexLink
+	de, _ = os.ReadDir(filepath.Join(outdir, "compare"))
+	for _, e := range de {
+		nm := e.Name()
+		if !e.IsDir() {
+			if strings.HasSuffix(nm, ".html") {
+				compares = append(compares, indexLink{strings.TrimSuffix(nm, ".html"), "compare/" + nm})
+			}
+			continue
+		}
+
+		g := indexGroup{Name: nm}
+		pages, _ := filepath.Glob(filepath.Join(outdir, "compare", nm, "*.html"))
+		slices.Sort(pages)
+		slices.Reverse(pages)
+		for _, fn := range pages {
+			b := filepath.Base(fn)
+			g.Pages = append(g.Pages, indexLink{strings.TrimSuffix(b, ".html"), "compare/" + nm + "/" + b})
+		}
+		if len(g.Pages) > 0 {
+			groups = append(groups, g)
+		}
+	}
+
+	return writeAtomic(filepath.Join(outdir, "index.html"), rootIndexTmpl, struct {
+		Targets  []indexTarget
+		Groups   []indexGroup
+		Compares []indexLink
+		Now      string
+	}{targets, groups, compares, time.Now().Format(time.RFC1123)})
+}
+
+// return the kind and time of the report 'base'
+func reportKind(base string) (string, time.Time) {
+	kind, t, ok := classify(base + ".")
+	if !ok {
+		return "report", time.Time{}
+	}
+
+	switch kind {
+	case fileDaily:
+		return "daily", t
+	case fileRollup:
+		if rollWeekRe.MatchString(base + ".") {
+			return "week", t
+		}
+		return "month", t
+	}
+
+	if rollHourRe.MatchString(base + ".") {
+		return "hour", t
+	}
+	return "batch", t
+}
+
+// fill the badges of 't' from its latest batch summary and find its
+// latest daily chart
+func indexBadges(t *indexTarget, stdir, chdir string) {
+	var latest string
+	de, _ := os.ReadDir(stdir)
+	for _, e := range de {
+		nm := e.Name()
+		if batchNameRe.MatchString(nm) && strings.HasSuffix(nm, "-summary.csv") {
+			latest = max(latest, nm)
+		}
+	}
+
+	if len(latest) > 0 {
+		if s, err := readSummaryHeadline(filepath.Join(stdir, latest)); err == nil && len(s.Name) > 0 {
+			t.Phase = s.Name
+			t.P99 = fmt.Sprintf("%.3f ms", float64(s.P99.Microseconds())/1000)
+			if n := uint64(s.N) + s.Failures; n > 0 {
+				a := float64(s.N) / float64(n)
+				t.Avail = fmt.Sprintf("%.2f%%", 100*a)
+				t.Warn = a < _IndexAvailWarn
+			}
+		}
+
+		if bt, err := time.Parse(_BatchFmt, strings.TrimSuffix(latest, "-summary.csv")); err == nil {
+			t.Updated = bt.Local().Format("2006-01-02 15:04")
+		}
+	}
+
+	de, _ = os.ReadDir(chdir)
+	for _, e := range de {
+		nm := e.Name()
+		if dailyNameRe.MatchString(nm) && !batchNameRe.MatchString(nm) && filepath.Ext(nm) == ".html" {
+			t.Daily = max(t.Daily, nm)
+		}
+	}
+}
+
+// return the stats of the phase in summary 'fn' that best represents
+// the target: the end-to-end latency if there's one; else the one with
+// the largest mean (like the charts).
+func readSummaryHeadline(fn string) (plot.Stats, error) {
+	var best plot.Stats
+
+	fd, err := openCsv(fn)
+	if err != nil {
+		return best, err
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	if !sc.Scan() {
+		return best, fmt.Errorf("%s: empty summary", fn)
+	}
+
+	hdr := strings.Split(sc.Text(), ",")
+	col := func(nm string) int { return slices.Index(hdr, nm) }
+	iN, iF, iM, iP := col("count"), col("failures"), col("mean"), col("p99")
+	if col("phase") != 0 || iN < 0 || iF < 0 || iM < 0 || iP < 0 {
+		return best, fmt.Errorf("%s: not a summary", fn)
+	}
+
+	for sc.Scan() {
+		f := strings.Split(sc.Text(), ",")
+		if len(f) != len(hdr) {
+			continue
+		}
+
+		var s plot.Stats
+		var v [4]int64
+		for i, k := range []int{iN, iF, iM, iP} {
+			v[i], _ = strconv.ParseInt(f[k], 10, 64)
+		}
+		s.Name, s.N, s.Failures, s.Mean, s.P99 = f[0], int(v[0]), uint64(v[1]), time.Duration(v[2]), time.Duration(v[3])
+
+		switch {
+		case best.Name == "https", plot.IsMeta(s.Name):
+		case s.Name == "https", len(best.Name) == 0, s.Mean > best.Mean:
+			best = s
+		}
+	}
+	return best, sc.Err()
+}
+
+// write 'tmpl' with 'data' to 'fn' via a temp file in the same dir
+func writeAtomic(fn string, tmpl *template.Template, data any) error {
+	fd, err := os.CreateTemp(filepath.Dir(fn), ".index-*")
+	if err != nil {
+		return err
+	}
+
+	tmp := fd.Name()
+	err = tmpl.Execute(fd, data)
+	if err == nil {
+		err = fd.Chmod(0640)
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, fn)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("write %s: %w", fn, err)
+	}
+	return nil
+}
+
+const _IndexStyle = `<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 4px 12px; text-align: left; border-bottom: 1px solid #ddd; }
+.badge { display: inline-block; padding: 2px 8px; border-radius: 8px; background: #e8f4e8; }
+.badge.warn { background: #fbe3e3; }
+.muted { color: #888; }
+img { vertical-align: middle; }
+</style>`
+
+var rootIndexTmpl = template.Must(template.New("root").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>latmon reports</title>
+` + _IndexStyle + `
+</head>
+<body>
+<h2>latmon reports</h2>
+<table>
+<tr><th>Target</th><th>Availability</th><th>P99</th><th>Latest batch</th><th>Latest day</th></tr>
+{{- range .Targets}}
+<tr>
+<td><a href="charts/{{.Name}}/index.html">{{.Name}}</a></td>
+<td>{{if .Avail}}<span class="badge{{if .Warn}} warn{{end}}">{{.Avail}}</span>{{else}}<span class="muted">-</span>{{end}}</td>
+<td>{{if .P99}}<span class="badge">{{.Phase}} {{.P99}}</span>{{else}}<span class="muted">-</span>{{end}}</td>
+<td>{{.Updated}}</td>
+<td>{{if .Daily}}<a href="charts/{{.Name}}/{{.Daily}}">{{.Daily}}</a>{{end}}</td>
+</tr>
+{{- else}}
+<tr><td colspan="5">no targets yet</td></tr>
+{{- end}}
+</table>
+{{- if or .Groups .Compares}}
+<h3>Comparisons</h3>
+<ul>
+{{- range .Groups}}
+<li>{{.Name}}: {{range $i, $p := .Pages}}{{if $i}} &middot; {{end}}<a href="{{$p.Href}}">{{$p.Name}}</a>{{end}}</li>
+{{- end}}
+{{- range .Compares}}
+<li><a href="{{.Href}}">{{.Name}}</a></li>
+{{- end}}
+</ul>
+{{- end}}
+<p class="muted">Updated {{.Now}}</p>
+</body>
+</html>
+`))
+
+var hostIndexTmpl = template.Must(template.New("host").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Target.Name}} reports</title>
+` + _IndexStyle + `
+</head>
+<body>
+<h2>{{.Target.Name}}</h2>
+<p><a href="../../index.html">all targets</a>
+{{- with .Target}}{{if .Avail}} &middot; <span class="badge{{if .Warn}} warn{{end}}">availability {{.Avail}}</span>{{end}}
+{{- if .P99}} &middot; <span class="badge">{{.Phase}} p99 {{.P99}}</span>{{end}}
+{{- if .Updated}} <span class="muted">(batch of {{.Updated}})</span>{{end}}{{end}}</p>
+{{define "report"}}<tr>
+<td>{{.Name}}</td><td>{{.Kind}}</td>
+<td>{{range $i, $l := .Charts}}{{if $i}} &middot; {{end}}<a href="{{$l.Href}}">{{$l.Name}}</a>{{end}}</td>
+<td>{{if .Spark}}<img src="{{.Spark}}" alt="">{{end}}</td>
+<td>{{range $i, $l := .Data}}{{if $i}} &middot; {{end}}<a href="{{$l.Href}}">{{$l.Name}}</a>{{end}}</td>
+</tr>
+{{end}}
+{{- range .Days}}
+<h3>{{.Day}}</h3>
+<table>
+{{range .Reports}}{{template "report" .}}{{end -}}
+</table>
+{{- else}}
+<p>no reports yet</p>
+{{- end}}
+{{- if .Rollups}}
+<h3>Rollups</h3>
+<table>
+{{range .Rollups}}{{template "report" .}}{{end -}}
+</table>
+{{- end}}
+{{- if .Reports}}
+<h3>Reports</h3>
+<table>
+{{range .Reports}}{{template "report" .}}{{end -}}
+</table>
+{{- end}}
+<p class="muted">Updated {{.Now}}</p>
+</body>
+</html>
+`))
@@ -0,0 +1,114 @@
+// live.go - recent samples of every target for the dashboard
+
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// max samples queued for a slow subscriber; the rest are dropped
+const _LiveQueue = 64
+
+// liveFeed keeps the samples of the last 'window' for each target
+// and fans out new samples to subscribers.
+type liveFeed struct {
+	sync.Mutex
+
+	window time.Duration
+	recent map[string][]Sample
+	subs   map[*liveSub]bool
+}
+
+type liveSub struct {
+	target string
+	ch     chan Sample
+}
+
+func newLiveFeed(window time.Duration) *liveFeed {
+	l := &liveFeed{
+		window: window,
+		recent: make(map[string][]Sample),
+		subs:   make(map[*liveSub]bool),
+	}
+	return l
+}
+
+// publish is the Measurer sample hook; it must not block
+func (l *liveFeed) publish(s *Sample) {
+	if len(s.Names) == 0 {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// with concurrent probes, the samples come in the order the
+	// probes finish; keep them in time order
+	v := l.recent[s.Target]
+	i := len(v)
+	for i > 0 && v[i-1].Time.After(s.Time) {
+		i--
+	}
+	v = slices.Insert(v, i, *s)
+	l.recent[s.Target] = l.trim(v, v[len(v)-1].Time)
+
+	for sub := range l.subs {
+		if sub.target != s.Target {
+			continue
+		}
+
+		select {
+		case sub.ch <- *s:
+		default:
+		}
+	}
+}
+
+// return a copy of the recent samples of 'target'
+func (l *liveFeed) samples(target string) []Sample {
+	l.Lock()
+	defer l.Unlock()
+
+	v := l.trim(l.recent[target], time.Now())
+	l.recent[target] = v
+	if len(v) == 0 {
+		delete(l.recent, target)
+	}
+	return append([]Sample(nil), v...)
+}
+
+// drop the samples older than the window
+func (l *liveFeed) trim(v []Sample, now time.Time) []Sample {
+	old := now.Add(-l.window)
+	i := 0
+	for i < len(v) && v[i].Time.Before(old) {
+		i++
+	}
+	if i == 0 {
+		return v
+	}
+
+	// don't let the backing array grow without bounds
+	return append(v[:0], v[i:]...)
+}
+
+// subscribe to new samples of 'target'
+func (l *liveFeed) subscribe(target string) *liveSub {
+	sub := &liveSub{
+		target: target,
+		ch:     make(chan Sample, _LiveQueue),
+	}
+
+	l.Lock()
+	l.subs[sub] = true
+	l.Unlock()
+	return sub
+}
+
+func (l *liveFeed) unsubscribe(sub *liveSub) {
+	l.Lock()
+	delete(l.subs, sub)
+	l.Unlock()
+}
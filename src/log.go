@@ -0,0 +1,99 @@
+// log.go - logger whose level can be changed at runtime
+
+package main
+
+import (
+	"sync/atomic"
+
+	logger "github.com/opencoff/go-logger"
+)
+
+// levelLog filters the messages to an underlying logger (which
+// logs everything) by a priority that can be changed at runtime.
+// Loggers made with New() share the priority of their parent.
+type levelLog struct {
+	logger.Logger
+
+	prio *atomic.Int32
+}
+
+var _ logger.Logger = &levelLog{}
+
+func newLevelLog(l logger.Logger, p logger.Priority) *levelLog {
+	ll := &levelLog{
+		Logger: l,
+		prio:   &atomic.Int32{},
+	}
+	ll.SetPrio(p)
+	return ll
+}
+
+// SetPrio changes the priority of this logger and all its children
+func (l *levelLog) SetPrio(p logger.Priority) {
+	l.prio.Store(int32(p))
+}
+
+func (l *levelLog) Prio() logger.Priority {
+	return logger.Priority(l.prio.Load())
+}
+
+func (l *levelLog) New(prefix string, flag int) logger.Logger {
+	return &levelLog{
+		Logger: l.Logger.New(prefix, flag),
+		prio:   l.prio,
+	}
+}
+
+func (l *levelLog) Debug(f string, v ...interface{}) {
+	if l.on(logger.LOG_DEBUG) {
+		l.Logger.Debug(f, v...)
+	}
+}
+
+func (l *levelLog) Info(f string, v ...interface{}) {
+	if l.on(logger.LOG_INFO) {
+		l.Logger.Info(f, v...)
+	}
+}
+
+func (l *levelLog) Warn(f string, v ...interface{}) {
+	if l.on(logger.LOG_WARNING) {
+		l.Logger.Warn(f, v...)
+	}
+}
+
+func (l *levelLog) Error(f string, v ...interface{}) {
+	if l.on(logger.LOG_ERR) {
+		l.Logger.Error(f, v...)
+	}
+}
+
+// critical messages are never filtered
+func (l *levelLog) Crit(f string, v ...interface{}) {
+	l.Logger.Crit(f, v...)
+}
+
+// return true if messages at 'p' should be logged
+func (l *levelLog) on(p logger.Priority) bool {
+	cur := l.Prio()
+	if cur == logger.LOG_NONE {
+		return false
+	}
+	return rank(p) >= rank(cur)
+}
+
+// order the priorities from least to most severe
+func rank(p logger.Priority) int {
+	switch p {
+	case logger.LOG_DEBUG:
+		return 0
+	case logger.LOG_INFO:
+		return 1
+	case logger.LOG_WARNING:
+		return 2
+	case logger.LOG_ERR:
+		return 3
+	default:
+		return 4
+	}
+}
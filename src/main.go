@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
@@ -18,23 +19,85 @@ import (
 
 const (
 	_DefaultBatchSize int = 3600
+
+	// samples shown in the dashboard live charts
+	_DefaultLiveWindow = 15 * time.Minute
 )
 
 func main() {
-	var interval, timeout time.Duration
+	// sub-commands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reflect":
+			reflectMain(os.Args[2:])
+			return
+		case "check-config":
+			checkConfigMain(os.Args[2:])
+			return
+		case "ctl":
+			ctlMain(os.Args[2:])
+			return
+		case "report":
+			reportMain(os.Args[2:])
+			return
+		case "test-alerts":
+			testAlertsMain(os.Args[2:])
+			return
+		}
+	}
+
 	var help, ver bool
 	var dir, logdest, lvl string
-	var bsz int
+	var bannerRe string
+	var baseline string
+	var offset string
+	var cfgFile string
+	var ctlSock, ctlMode string
+	var httpAddr string
+	var httpWindow time.Duration
+	var rflags retentionConf
+
+	// the flags are the defaults for every target
+	base := defaultPingOpts()
 
 	fs := pflag.NewFlagSet(Z, pflag.ExitOnError)
-	fs.DurationVarP(&interval, "every", "i", 2*time.Second, "Send pings every `I` interval apart")
-	fs.IntVarP(&bsz, "batch-size", "b", _DefaultBatchSize, "Collect 'B' samples per measurement run")
-	fs.DurationVarP(&timeout, "timeout", "t", 2*time.Second, "Set rx deadline to `T` seconds")
+	fs.DurationVarP(&base.Interval, "every", "i", base.Interval, "Send pings every `I` interval apart")
+	fs.IntVarP(&base.Batchsize, "batch-size", "b", base.Batchsize, "Collect 'B' samples per measurement run")
+	fs.DurationVarP(&base.Timeout, "timeout", "t", base.Timeout, "Set rx deadline to `T` seconds")
+	fs.DurationVarP(&base.Aggregate, "aggregate", "", 0, "Keep histograms per `D` bucket instead of raw samples (eg 1m)")
+	fs.StringVarP(&base.Schedule.Mode, "schedule", "", base.Schedule.Mode, "Send probes on a `M` schedule (fixed, poisson)")
+	fs.DurationVarP(&base.Schedule.Jitter, "jitter", "", 0, "Move each probe by up to +/- `D` on a fixed schedule")
+	fs.IntVarP(&base.Schedule.Concurrency, "concurrency", "", base.Schedule.Concurrency, "Run up to `N` probes of a target at once")
+	fs.StringVarP(&offset, "offset", "", "random", "Send the first probe of each target `D` after it starts (random: within an interval)")
 	fs.BoolVarP(&help, "help", "h", false, "Show this help message and exit")
 	fs.BoolVarP(&ver, "version", "", false, "Show program version and exit")
+	fs.StringVarP(&cfgFile, "config", "c", "", "Read targets and settings from config file `F`")
 	fs.StringVarP(&dir, "output-dir", "d", ".", "Put charts in directory `D`")
 	fs.StringVarP(&logdest, "log", "L", "SYSLOG", "Send logs to destination `L`")
 	fs.StringVarP(&lvl, "log-level", "", "INFO", "Log at priority `P`")
+	fs.StringVarP(&ctlSock, "control", "", "", "Listen for control commands on unix socket `S`")
+	fs.StringVarP(&ctlMode, "control-mode", "", "0600", "Set the file mode of the control socket to `M`")
+	fs.StringVarP(&httpAddr, "http", "", "", "Serve the dashboard and query API on `A` (eg 127.0.0.1:8080)")
+	fs.DurationVarP(&httpWindow, "http-window", "", _DefaultLiveWindow, "Show the last `D` of samples in the live charts")
+	fs.BoolVarP(&base.Banner, "banner", "", false, "Read the server banner on tcp targets")
+	fs.StringVarP(&bannerRe, "banner-match", "", "", "Match tcp server banners against regex `R` (implies --banner)")
+	fs.IntVarP(&base.Count, "udp-count", "", base.Count, "Send `N` packets per probe to udp targets")
+	fs.IntVarP(&base.Rate, "udp-rate", "", base.Rate, "Send packets to udp targets at `R` packets/sec")
+	fs.IntVarP(&base.Streams, "h2-streams", "", base.Streams, "Send `N` concurrent requests per probe to h2 targets")
+	fs.BoolVarP(&base.KeepAlive, "h2-keepalive", "", false, "Reuse the connection to h2 targets across probes")
+	fs.StringVarP(&base.Trace.Proto, "trace", "", "", "Trace the path to each target with proto `P` (udp, tcp)")
+	fs.DurationVarP(&base.Trace.Every, "trace-every", "", 0, "Trace the path every `D` interval")
+	fs.DurationVarP(&base.Trace.Threshold, "trace-threshold", "", 0, "Trace the path when a sample exceeds `D`")
+	fs.Float64VarP(&base.Anomaly.Spike, "anomaly-spike", "", 0, "Flag latency spikes with a robust z-score above `Z` (eg 6)")
+	fs.Float64VarP(&base.Anomaly.Shift, "anomaly-shift", "", 0, "Flag level shifts when the CUSUM of z-scores passes `H` (eg 12)")
+	fs.StringVarP(&baseline, "baseline", "", "1d", "Compare the daily reports and live charts with `A` earlier (0 disables)")
+	fs.StringVarP(&base.StartTls, "starttls", "", "", "Upgrade tls targets via STARTTLS for proto `P` (smtp, imap, postgres)")
+	fs.StringVarP(&rflags.Batch, "keep-batch", "", "", "Remove batch files (and hourly rollups) older than `A` (eg 14d)")
+	fs.StringVarP(&rflags.Daily, "keep-daily", "", "", "Remove daily files older than `A` (eg 6mo)")
+	fs.StringVarP(&rflags.Rollup, "keep-rollup", "", "", "Remove weekly and monthly rollups older than `A` (eg 2y)")
+	fs.StringVarP(&rflags.Compress, "compress", "", "", "Compress aged csv files with `C` (gzip, zstd)")
+	fs.StringVarP(&rflags.CompressAfter, "compress-after", "", "", "Compress csv files older than `A` [1d]")
+	fs.StringVarP(&rflags.MaxDisk, "max-disk", "", "", "Remove the oldest outputs when they use more than `S` (eg 10G)")
 
 	err := fs.Parse(os.Args[1:])
 	if err != nil {
@@ -50,63 +113,116 @@ func main() {
 		os.Exit(0)
 	}
 
-	// samples per day can't be smaller than batchsize
-	perDay := int((86400 * time.Second) / interval)
-	if bsz >= perDay {
-		Die("batch-size is greater than total samples per day (%d)", perDay)
-	}
-
 	args := fs.Args()
-	if len(args) < 0 {
+	if len(args) == 0 && len(cfgFile) == 0 {
 		usage(fs, "insufficient args")
 	}
 
+	if len(bannerRe) > 0 {
+		base.BannerMatch, err = regexp.Compile(bannerRe)
+		if err != nil {
+			Die("invalid banner regex '%s': %s", bannerRe, err)
+		}
+	}
+
+	if base.Baseline, err = ParseAge(baseline); err != nil {
+		Die("baseline: %s", err)
+	}
+	if base.Schedule.Offset, err = parseOffset(offset); err != nil {
+		Die("offset: %s", err)
+	}
+	base.Schedule.Mode = strings.ToLower(base.Schedule.Mode)
+
+	var ret Retention
+	if key, err := rflags.apply(&ret); err != nil {
+		Die("%s: %s", key, err)
+	}
+
+	// an explicit flag wins over the config file
+	cfgDir := !fs.Changed("output-dir")
+	targets, g, err := loadTargets(&base, &ret, args, cfgFile, cfgDir, Warn)
+	if err != nil {
+		Die("%s", err)
+	}
+	if len(g.outdir) > 0 {
+		dir = g.outdir
+	}
+
 	prio, ok := logger.ToPriority(lvl)
 	if !ok {
 		Die("Unknown log level '%s'", lvl)
 	}
 
-	log, err := logger.NewLogger(logdest, prio, Z, logger.Ldate|logger.Ltime|logger.Lmicroseconds|logger.Lfileloc)
+	mode, err := parseMode(ctlMode)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	// the log level is applied by levelLog; so it can be changed
+	// at runtime
+	ll, err := logger.NewLogger(logdest, logger.LOG_DEBUG, Z, logger.Ldate|logger.Ltime|logger.Lmicroseconds|logger.Lfileloc)
 	if err != nil {
 		Die("can't create logger: %s", err)
 	}
+	log := newLevelLog(ll, prio)
 
-	log.Info("Starting latency monitor [%s, %s]; batchsize=%d interval=%s timeout=%s",
-		ProductVersion, RepoVersion, bsz, interval, timeout)
+	log.Info("Starting latency monitor [%s, %s]; batchsize=%d interval=%s timeout=%s, %d targets",
+		ProductVersion, RepoVersion, base.Batchsize, base.Interval, base.Timeout, len(targets))
 
-	m := NewMeasurer(WithOutputDir(dir), WithBatchSize(bsz), WithLogger(log))
-	ctx := context.Background()
-	seen := make(map[string]bool)
-	for _, a := range args {
-		proto, host, port, err := parsePinger(a)
-		if err != nil {
-			Die(err.Error())
+	mopt := []MeasureOpt{WithOutputDir(dir), WithBatchSize(base.Batchsize), WithInterval(base.Interval), WithLogger(log)}
+
+	var feed *liveFeed
+	if len(httpAddr) > 0 {
+		if httpWindow <= 0 {
+			Die("http-window must be positive")
 		}
+		feed = newLiveFeed(httpWindow)
+		mopt = append(mopt, WithSampleHook(feed.publish))
+	}
 
-		k := fmt.Sprintf("%s:%s:%d", proto, host, port)
-		if saw := seen[k]; saw {
-			Warn("%s: %s:%d - duplicate; skipping ..", proto, host, port)
-			continue
+	// the alerter is made before the targets start
+	var alr *alerter
+	mopt = append(mopt, WithSampleHook(func(s *Sample) { alr.observe(s) }))
+
+	m := NewMeasurer(mopt...)
+	d := &daemon{
+		ctx:     context.Background(),
+		m:       m,
+		log:     log,
+		base:    base,
+		ret:     ret,
+		args:    args,
+		cfgFile: cfgFile,
+		cfgDir:  cfgDir,
+		outdir:  g.outdir,
+		running: make(map[string]PingOpts),
+	}
+
+	alr = newAlerter(g.alerts, m.Targets, log)
+	d.alr = alr
+
+	for i := range targets {
+		if err := d.start(&targets[i]); err != nil {
+			Die("%s", err)
 		}
+	}
+
+	d.jan = newJanitor(g.retention, d.outputDirs, log)
+	d.cmp = newComparer(g.groups, d.locate, d.outputDir, log)
 
-		opt := PingOpts{
-			Host:     host,
-			Port:     port,
-			Proto:    proto,
-			Interval: interval,
-			Timeout:  timeout,
-			Logger:   log,
+	var ctl *ctlServer
+	if len(ctlSock) > 0 {
+		ctl, err = newCtlServer(d, ctlSock, mode)
+		if err != nil {
+			Die("%s", err)
 		}
+	}
 
-		switch proto {
-		case "https":
-			h, hch, err := NewHttps(ctx, opt)
-			if err != nil {
-				Die("%s", err)
-			}
-			m.AddHttps(host, h, hch)
-		default:
-			Warn("proto %s: TBD", proto)
+	var web *webServer
+	if feed != nil {
+		web, err = newWebServer(d, feed, httpAddr)
+		if err != nil {
+			Die("%s", err)
 		}
 	}
 
@@ -121,11 +237,187 @@ func main() {
 		s := <-sigchan
 		t := s.(syscall.Signal)
 
+		if t == syscall.SIGHUP {
+			log.Info("Caught SIGHUP; reloading targets ..")
+			if err := d.reload(); err != nil {
+				log.Warn("reload: %s; keeping the current targets", err)
+			}
+			continue
+		}
+
 		log.Info("Caught signal %d; Terminating ..\n", int(t))
 		break
 	}
 
-	m.Stop()
+	if web != nil {
+		web.Stop()
+	}
+	if ctl != nil {
+		ctl.Stop()
+	}
+	d.jan.Stop()
+	d.alr.Stop()
+	d.stop()
+	d.cmp.Stop()
+}
+
+// settings from the config file that aren't per target
+type globals struct {
+	outdir    string
+	retention Retention
+	groups    []Group
+	alerts    Alerts
+}
+
+// make the targets from the command line args and the config file
+// (if any). Targets with duplicate names are skipped. If 'cfgDir' is
+// true, the output dir from the config file is returned as well. The
+// retention policy in the config file is overlaid on 'ret'.
+func loadTargets(base *PingOpts, ret *Retention, args []string, cfgFile string, cfgDir bool, warn func(string, ...any)) ([]PingOpts, globals, error) {
+	g := globals{
+		retention: *ret,
+	}
+
+	targets, err := makeTargets(base, args)
+	if err != nil {
+		return nil, g, err
+	}
+
+	if len(cfgFile) > 0 {
+		cfg, err := ReadConfig(cfgFile, base)
+		if err != nil {
+			return nil, g, err
+		}
+
+		if cfgDir {
+			g.outdir = cfg.OutputDir
+		}
+
+		// ReadConfig has validated it
+		cfg.Retention.apply(&g.retention)
+		g.groups = cfg.Groups
+		g.alerts = cfg.Alerts
+
+		for _, o := range cfg.Targets {
+			set(&o.OutputDir, g.outdir)
+			targets = append(targets, o)
+		}
+	}
+
+	seen := make(map[string]bool)
+	uniq := targets[:0]
+	for _, o := range targets {
+		nm := o.Name()
+		if seen[nm] {
+			warn("%s: duplicate; skipping ..", nm)
+			continue
+		}
+		seen[nm] = true
+		uniq = append(uniq, o)
+	}
+	return uniq, g, nil
+}
+
+// make targets from the command line args
+func makeTargets(base *PingOpts, args []string) ([]PingOpts, error) {
+	targets := make([]PingOpts, 0, len(args))
+	for _, a := range args {
+		proto, host, port, err := parsePinger(a)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a, err)
+		}
+
+		opt := *base
+		opt.Proto = proto
+		opt.Host = host
+		opt.Port = port
+		if _, err := opt.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", a, err)
+		}
+		targets = append(targets, opt)
+	}
+	return targets, nil
+}
+
+// start the pinger (and tracer) for a target and hand them to the
+// measurer. If the measurer can't take them, they are stopped.
+func startTarget(ctx context.Context, m *Measurer, opt *PingOpts) error {
+	switch opt.Proto {
+	case "https":
+		h, hch, err := NewHttps(ctx, *opt)
+		if err != nil {
+			return err
+		}
+		if err = m.AddHttps(opt, h, hch); err != nil {
+			discard(h, hch)
+			return fmt.Errorf("%s: %w", opt.Name(), err)
+		}
+	case "h2":
+		h, hch, err := NewH2(ctx, *opt)
+		if err != nil {
+			return err
+		}
+		if err = m.AddH2(opt, h, hch); err != nil {
+			discard(h, hch)
+			return fmt.Errorf("%s: %w", opt.Name(), err)
+		}
+	case "tcp":
+		t, tch, err := NewTcp(ctx, *opt)
+		if err != nil {
+			return err
+		}
+		if err = m.AddTcp(opt, t, tch); err != nil {
+			discard(t, tch)
+			return fmt.Errorf("%s: %w", opt.Name(), err)
+		}
+	case "tls":
+		t, tch, err := NewTls(ctx, *opt)
+		if err != nil {
+			return err
+		}
+		if err = m.AddTls(opt, t, tch); err != nil {
+			discard(t, tch)
+			return fmt.Errorf("%s: %w", opt.Name(), err)
+		}
+	case "udp":
+		u, uch, err := NewUdp(ctx, *opt)
+		if err != nil {
+			return err
+		}
+		if err = m.AddUdp(opt, u, uch); err != nil {
+			discard(u, uch)
+			return fmt.Errorf("%s: %w", opt.Name(), err)
+		}
+	default:
+		Warn("proto %s: TBD", opt.Proto)
+		return nil
+	}
+
+	if len(opt.Trace.Proto) > 0 {
+		t, pch, err := NewTracer(ctx, *opt)
+		if err == nil {
+			if err = m.AddTracer(opt, t, pch); err != nil {
+				discard(t, pch)
+			}
+		}
+
+		// don't leave the target running without its tracer
+		if err != nil {
+			m.Remove(opt.Name())
+			return fmt.Errorf("%s: %w", opt.Name(), err)
+		}
+	}
+	return nil
+}
+
+// stop pinger 'p' whose results no worker reads; a probe in flight
+// can't finish otherwise
+func discard[T any](p Pinger, ch chan T) {
+	go func() {
+		for range ch {
+		}
+	}()
+	p.Stop()
 }
 
 func parsePinger(s string) (proto, host string, port uint16, err error) {
@@ -142,8 +434,13 @@ func parsePinger(s string) (proto, host string, port uint16, err error) {
 	switch proto {
 	case "http":
 		port = 80
-	case "https":
+	case "https", "h2":
 		port = 443
+	case "tcp", "tls", "udp":
+		if len(v) < 3 {
+			err = fmt.Errorf("%s needs an explicit port", proto)
+			return
+		}
 	//case "quic":
 
 	default:
@@ -174,15 +471,27 @@ func usage(fs *pflag.FlagSet, errstr string) {
 	x := fmt.Sprintf(`%s: ping latency plotter
 
 Usage: %s [options] HOST [HOST..]
+       %s [options] -c CONFIG [HOST..]
+       %s check-config CONFIG [CONFIG..]
+       %s ctl -s SOCKET CMD [ARGS]
+       %s report [options] FILE|DIR [FILE|DIR..]
+       %s test-alerts -c CONFIG [RECEIVER..]
+       %s reflect [options]
 
 Where HOST is of the form:
 
 	https:hostname[:port]
+	h2:hostname[:port]
+	tcp:hostname:port
+	tls:hostname:port
+	udp:hostname:port
 
 hostname - can be either an IP address or hostname.
 
+udp targets need an echo responder; run '%s reflect' on the far end.
+
 Options:
-`, Z, Z)
+`, Z, Z, Z, Z, Z, Z, Z, Z, Z)
 	os.Stdout.Write([]byte(x))
 	fs.PrintDefaults()
 	os.Exit(rc)
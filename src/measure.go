@@ -9,12 +9,14 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"sync"
 	"time"
 
 	logger "github.com/opencoff/go-logger"
 	"github.com/opencoff/latmon/internal/plot"
+	"github.com/opencoff/latmon/internal/trace"
 )
 
 type MeasureOpt func(o *measureOpt)
@@ -45,20 +47,86 @@ func WithInterval(ii time.Duration) MeasureOpt {
 	}
 }
 
+// WithSampleHook calls 'fp' for every sample and failed probe of
+// every target. 'fp' is called in the measurement path and must not
+// block.
+func WithSampleHook(fp func(s *Sample)) MeasureOpt {
+	return func(o *measureOpt) {
+		o.hooks = append(o.hooks, fp)
+	}
+}
+
+// Outputs is the set of files written for each batch and day
+type Outputs uint
+
+const (
+	OutputCsv Outputs = 1 << iota
+	OutputHtml
+	OutputSvg
+	OutputPng
+)
+
+const _DefaultOutputs = OutputCsv | OutputHtml
+
+// the outputs that are charts
+const _ChartOutputs = OutputHtml | OutputSvg | OutputPng
+
+var outputNames = map[string]Outputs{
+	"csv":  OutputCsv,
+	"html": OutputHtml,
+	"svg":  OutputSvg,
+	"png":  OutputPng,
+}
+
+// ParseOutputs returns the set of outputs named in 'v'
+func ParseOutputs(v []string) (Outputs, error) {
+	var o Outputs
+	for _, nm := range v {
+		x, ok := outputNames[strings.ToLower(nm)]
+		if !ok {
+			return 0, fmt.Errorf("unknown output '%s'", nm)
+		}
+		o |= x
+	}
+	return o, nil
+}
+
+func (o Outputs) Has(x Outputs) bool {
+	return o&x == x
+}
+
+// Any returns true if 'o' has any of the outputs in 'x'
+func (o Outputs) Any(x Outputs) bool {
+	return o&x != 0
+}
+
 type measureOpt struct {
 	outdir    string
 	batchsize int
 	interval  time.Duration
 	log       logger.Logger
+
+	// called for every sample
+	hooks []func(s *Sample)
 }
 
 type Measurer struct {
 	measureOpt
 
-	wg           sync.WaitGroup
+	// protects the maps below; targets come and go on reload
+	sync.Mutex
 	perHost      map[string]*hostStats
 	perHostDaily map[string]*plot.Columns
-	pingers      []Pinger
+	perHostAgg   map[string]*aggSet
+
+	// detached targets that may be added again (see Forget)
+	detached map[string]*hostStats
+
+	// pending async flushes
+	flushing sync.WaitGroup
+
+	// serializes the index updates
+	indexing sync.Mutex
 }
 
 func NewMeasurer(opts ...MeasureOpt) *Measurer {
@@ -70,7 +138,8 @@ func NewMeasurer(opts ...MeasureOpt) *Measurer {
 		},
 		perHost:      make(map[string]*hostStats),
 		perHostDaily: make(map[string]*plot.Columns),
-		pingers:      make([]Pinger, 0, 8),
+		perHostAgg:   make(map[string]*aggSet),
+		detached:     make(map[string]*hostStats),
 	}
 
 	opt := &m.measureOpt
@@ -89,44 +158,378 @@ func NewMeasurer(opts ...MeasureOpt) *Measurer {
 	return m
 }
 
-func (m *Measurer) AddHttps(host string, p Pinger, hch chan HttpsResult) error {
-	stdir := path.Join(m.outdir, "stats", host)
-	chdir := path.Join(m.outdir, "charts", host)
+func (m *Measurer) AddHttps(o *PingOpts, p Pinger, hch chan HttpsResult) error {
+	hst, err := m.setupHost(o)
+	if err != nil {
+		return fmt.Errorf("https: %w", err)
+	}
+
+	m.log.Debug("%s: added https pinger ..", hst.name)
+
+	// start a runner to harvest results
+	hst.addPinger(p)
+	go m.httpsWorker(hst, p, hch)
+
+	return nil
+}
+
+func (m *Measurer) AddTcp(o *PingOpts, p Pinger, tch chan TcpResult) error {
+	hst, err := m.setupHost(o)
+	if err != nil {
+		return fmt.Errorf("tcp: %w", err)
+	}
+
+	m.log.Debug("%s: added tcp pinger ..", hst.name)
+
+	hst.addPinger(p)
+	go m.tcpWorker(hst, p, tch)
+
+	return nil
+}
+
+func (m *Measurer) AddTls(o *PingOpts, p Pinger, tch chan TlsResult) error {
+	hst, err := m.setupHost(o)
+	if err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+
+	m.log.Debug("%s: added tls pinger ..", hst.name)
+
+	hst.addPinger(p)
+	go m.tlsWorker(hst, p, tch)
+
+	return nil
+}
+
+func (m *Measurer) AddUdp(o *PingOpts, p Pinger, uch chan UdpResult) error {
+	hst, err := m.setupHost(o)
+	if err != nil {
+		return fmt.Errorf("udp: %w", err)
+	}
+
+	m.log.Debug("%s: added udp pinger ..", hst.name)
+
+	hst.addPinger(p)
+	go m.udpWorker(hst, p, uch)
+
+	return nil
+}
+
+func (m *Measurer) AddH2(o *PingOpts, p Pinger, hch chan H2Result) error {
+	hst, err := m.setupHost(o)
+	if err != nil {
+		return fmt.Errorf("h2: %w", err)
+	}
+
+	m.log.Debug("%s: added h2 pinger ..", hst.name)
+
+	hst.addPinger(p)
+	go m.h2Worker(hst, p, hch)
+
+	return nil
+}
+
+func (m *Measurer) AddTracer(o *PingOpts, t *tracer, pch chan PathResult) error {
+	hst, err := m.setupHost(o)
+	if err != nil {
+		return fmt.Errorf("trace: %w", err)
+	}
+
+	hst.Lock()
+	hst.tracer = t
+	hst.Unlock()
+
+	m.log.Debug("%s: added tracer ..", hst.name)
+
+	hst.addPinger(t)
+	go m.pathWorker(hst, pch)
+
+	return nil
+}
+
+// make the output dirs for the target in 'o' and return its stats
+// accumulator
+func (m *Measurer) setupHost(o *PingOpts) (*hostStats, error) {
+	name := o.Name()
+	outdir := m.outdir
+	if len(o.OutputDir) > 0 {
+		outdir = o.OutputDir
+	}
+
+	stdir := path.Join(outdir, "stats", name)
+	chdir := path.Join(outdir, "charts", name)
 	err := os.MkdirAll(stdir, 0750)
 	if err != nil {
-		return fmt.Errorf("https: mkdir: %s: %w", stdir, err)
+		return nil, fmt.Errorf("mkdir: %s: %w", stdir, err)
 	}
 
 	err = os.MkdirAll(chdir, 0750)
 	if err != nil {
-		return fmt.Errorf("https: mkdir: %s: %w", chdir, err)
+		return nil, fmt.Errorf("mkdir: %s: %w", chdir, err)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	hst, ok := m.perHost[name]
+	if !ok {
+		hst = m.newHost(o, stdir, chdir)
 	}
+	return hst, nil
+}
+
+// Targets returns the names of the targets being measured
+func (m *Measurer) Targets() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	names := make([]string, 0, len(m.perHost))
+	for nm := range m.perHost {
+		names = append(names, nm)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Detach stops the pingers for target 'name' and flushes its current
+// batch. The daily stats are kept for when the target is added
+// again (eg with new settings).
+func (m *Measurer) Detach(name string) error {
+	m.Lock()
+	hs, ok := m.perHost[name]
+	delete(m.perHost, name)
+	if ok {
+		m.detached[name] = hs
+	}
+	m.Unlock()
 
-	hst, ok := m.perHost[host]
 	if !ok {
-		hst = m.newHost(host, stdir, chdir)
+		return fmt.Errorf("%s: unknown target", name)
 	}
 
-	m.log.Debug("%s: added https pinger ..", host)
+	hs.stop()
 
-	// start a runner to harvest results
-	m.pingers = append(m.pingers, p)
-	m.wg.Add(1)
-	go m.httpsWorker(hst, p, hch)
+	hs.Lock()
+	if hs.agg != nil {
+		if hs.pending() > 0 {
+			m.flushAgg(hs)
+		}
+		hs.Unlock()
+	} else {
+		o := hs.makeOutput()
+		hs.Unlock()
 
+		if len(o.Names) > 0 {
+			m.flushing.Add(1)
+			m.asyncFlush(&o, hs)
+		}
+	}
+
+	// the last batch of an earlier flush may still be in flight
+	m.flushing.Wait()
+	m.log.Debug("%s: detached ..", name)
 	return nil
 }
 
+// Remove stops the pingers for target 'name' and flushes its batch
+// and daily stats.
+func (m *Measurer) Remove(name string) error {
+	if err := m.Detach(name); err != nil {
+		return err
+	}
+	return m.Forget(name)
+}
+
+// Forget flushes the daily stats of target 'name' after it's been
+// detached; eg if it fails to start again with new settings.
+func (m *Measurer) Forget(name string) error {
+	m.Lock()
+	hs, ok := m.detached[name]
+	ds := m.perHostDaily[name]
+	as := m.perHostAgg[name]
+	delete(m.detached, name)
+	delete(m.perHostDaily, name)
+	delete(m.perHostAgg, name)
+	m.Unlock()
+
+	if !ok {
+		return fmt.Errorf("%s: not detached", name)
+	}
+
+	if ds != nil && ds.Minlen > 0 {
+		m.flushDaily(ds, hs)
+	}
+	if as != nil && as.n > 0 {
+		m.flushDailyAgg(as, hs)
+	}
+
+	m.log.Debug("%s: removed ..", name)
+	return nil
+}
+
+// Pause stops the pingers for target 'name' and keeps its stats. The
+// target is resumed by adding its pingers again.
+func (m *Measurer) Pause(name string) error {
+	hs, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	if hs.stop() {
+		m.log.Info("%s: paused ..", name)
+	}
+	return nil
+}
+
+// Flush writes the current batch of target 'name' to disk
+func (m *Measurer) Flush(name string) error {
+	hs, err := m.lookup(name)
+	if err != nil {
+		return err
+	}
+
+	hs.Lock()
+	if hs.pending() > 0 {
+		m.flush(hs)
+	}
+	hs.Unlock()
+	return nil
+}
+
+// TargetStatus is a snapshot of a target's current batch
+type TargetStatus struct {
+	Name      string         `json:"name"`
+	Paused    bool           `json:"paused"`
+	Start     time.Time      `json:"start"`
+	Samples   int            `json:"samples"`
+	Batchsize int            `json:"batchsize"`
+	Columns   []ColumnStats  `json:"columns,omitempty"`
+	Counters  []plot.Counter `json:"counters,omitempty"`
+	Path      string         `json:"path,omitempty"`
+
+	// where the batch and daily stats and charts are
+	StatsDir string `json:"-"`
+	ChartDir string `json:"-"`
+}
+
+// ColumnStats summarizes one column of a batch
+type ColumnStats struct {
+	Name string        `json:"name"`
+	N    int           `json:"n"`
+	Min  time.Duration `json:"min"`
+	Avg  time.Duration `json:"avg"`
+	P50  time.Duration `json:"p50"`
+	P90  time.Duration `json:"p90"`
+	P95  time.Duration `json:"p95"`
+	P99  time.Duration `json:"p99"`
+	Max  time.Duration `json:"max"`
+}
+
+// Status returns a snapshot of target 'name'
+func (m *Measurer) Status(name string) (TargetStatus, error) {
+	hs, err := m.lookup(name)
+	if err != nil {
+		return TargetStatus{}, err
+	}
+
+	hs.Lock()
+	defer hs.Unlock()
+
+	st := TargetStatus{
+		Name:      hs.name,
+		Paused:    hs.paused,
+		Start:     hs.start,
+		Samples:   hs.pending(),
+		Batchsize: hs.batchsize,
+		Counters:  slices.Clone(hs.counters),
+		StatsDir:  hs.statsDir,
+		ChartDir:  hs.chartDir,
+	}
+
+	if hs.path != nil {
+		st.Path = hs.path.String()
+	}
+
+	if hs.agg != nil {
+		st.Columns = hs.agg.status(hs)
+		return st, nil
+	}
+
+	hs.each(func(nm string, v []time.Duration) {
+		st.Columns = append(st.Columns, columnStats(nm, v))
+	})
+	return st, nil
+}
+
+// Samples returns the samples in the current batch of target 'name';
+// in time order.
+func (m *Measurer) Samples(name string) ([]Sample, error) {
+	hs, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	hs.Lock()
+	defer hs.Unlock()
+
+	cols := hs.columns()
+	v := make([]Sample, len(hs.times))
+	for i, t := range hs.times {
+		s := &v[i]
+		s.Target = hs.name
+		s.Time = t
+		for _, c := range cols {
+			if x := *c.v; len(x) == len(hs.times) {
+				s.Names = append(s.Names, c.nm)
+				s.Vals = append(s.Vals, x[i])
+			}
+		}
+	}
+
+	// in time order; see sortTimes
+	slices.SortStableFunc(v, func(a, b Sample) int {
+		return a.Time.Compare(b.Time)
+	})
+	return v, nil
+}
+
+func (m *Measurer) lookup(name string) (*hostStats, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	hs, ok := m.perHost[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown target", name)
+	}
+	return hs, nil
+}
+
+// summarize the samples in 'v'
+func columnStats(nm string, v []time.Duration) ColumnStats {
+	return toColumnStats(plot.Summarize(nm, v))
+}
+
+func toColumnStats(s plot.Stats) ColumnStats {
+	return ColumnStats{
+		Name: s.Name,
+		N:    s.N,
+		Min:  s.Min,
+		Avg:  s.Mean,
+		P50:  s.P50,
+		P90:  s.P90,
+		P95:  s.P95,
+		P99:  s.P99,
+		Max:  s.Max,
+	}
+}
+
+// Stop stops all the targets and flushes their stats
 func (m *Measurer) Stop() {
 	m.log.Info("stopping measurements ..")
 
-	// first stop all the individual pingers
-	for _, p := range m.pingers {
-		p.Stop()
+	for _, nm := range m.Targets() {
+		m.Remove(nm)
 	}
-
-	// now wait for workers to complete
-	m.wg.Wait()
 }
 
 // captures all proto rtt for a given host
@@ -139,183 +542,648 @@ type hostStats struct {
 	statsDir string
 	chartDir string
 
-	dns   []time.Duration
-	tcp   []time.Duration
-	tls   []time.Duration
-	http  []time.Duration
-	https []time.Duration
+	// per target settings
+	batchsize int
+	interval  time.Duration
+	perDay    int
+	outputs   Outputs
+	labels    map[string]string
+
+	dns    []time.Duration
+	tcp    []time.Duration
+	tls    []time.Duration
+	http   []time.Duration
+	https  []time.Duration
+	banner []time.Duration
+
+	starttls []time.Duration
+
+	// the target has a banner or starttls column; each of its
+	// columns has a value for every sample
+	hasBanner   bool
+	hasStartTls bool
+
+	// udp rtt and jitter
+	rtt    []time.Duration
+	jitter []time.Duration
+
+	// h2 settings exchange and stream timings
+	settings []time.Duration
+	ttfb     []time.Duration
+	ttfbMax  []time.Duration
+	streams  []time.Duration
+
+	// with keep-alive, the setup time of the h2 connection made by
+	// each probe; 0 if it reused one
+	reconnect []time.Duration
+
+	// how late each probe was sent (see schedule.go)
+	lag []time.Duration
+
+	// event counts for this batch
+	counters []plot.Counter
+
+	// notable events in this batch
+	marks []plot.Mark
+
+	// expiry of the leaf cert of tls targets
+	notAfter time.Time
+
+	// spike and level shift detectors (if any)
+	detect *anomalies
+
+	// the daily stats are compared with this much earlier
+	baseline Age
+
+	// the probes counted towards the SLOs (if any)
+	slo *sloSet
+
+	// path tracer (if any) and the last path it found
+	tracer *tracer
+	path   *trace.Path
+
+	// pingers for this target and their workers
+	pingers []Pinger
+	wg      sync.WaitGroup
+	paused  bool
+
+	// length of each column when the last sample was taken
+	seen []int
+
+	// time of each sample in this batch
+	times []time.Time
+
+	// histograms of the batch in aggregate mode
+	agg *aggregator
+
+	// one batch flush at a time: they merge into the same daily stats
+	flushMu sync.Mutex
 }
 
-func (m *Measurer) newHost(nm, stats, charts string) *hostStats {
+// Sample is a single measurement of a target
+type Sample struct {
+	Target string
+	Time   time.Time
+
+	// columns that have a new value and their values
+	Names []string
+	Vals  []time.Duration
+
+	// end-to-end latency of the probe and the expiry of the leaf cert
+	// (tls); only in the samples of the Measurer hooks
+	E2e      time.Duration
+	NotAfter time.Time
+
+	// set for a failed probe; it has no values
+	Err error
+
+	// spikes and level shifts in the values (if detected)
+	Anomalies []Anomaly
+}
+
+func (m *Measurer) newHost(o *PingOpts, stats, charts string) *hostStats {
 	bsz := m.batchsize
+	if o.Batchsize > 0 {
+		bsz = o.Batchsize
+	}
+
+	ii := m.interval
+	if o.Interval > 0 {
+		ii = o.Interval
+	}
+
+	outputs := o.Outputs
+	if outputs == 0 {
+		outputs = _DefaultOutputs
+	}
+
+	// the raw samples of an aggregated target are only those of a
+	// bucket (see aggregator.due)
+	n := bsz
+	if o.Aggregate > 0 {
+		n = min(bsz, int(o.Aggregate/ii)+1)
+	}
+
+	nm := o.Name()
 	h := &hostStats{
-		name:     nm,
-		start:    time.Now().UTC(),
-		statsDir: stats,
-		chartDir: charts,
-		dns:      make([]time.Duration, 0, bsz),
-		tcp:      make([]time.Duration, 0, bsz),
-		tls:      make([]time.Duration, 0, bsz),
-		http:     make([]time.Duration, 0, bsz),
-		https:    make([]time.Duration, 0, bsz),
+		name:        nm,
+		start:       time.Now().UTC(),
+		statsDir:    stats,
+		chartDir:    charts,
+		batchsize:   bsz,
+		interval:    ii,
+		perDay:      int((86400 * time.Second) / ii),
+		outputs:     outputs,
+		labels:      o.Labels,
+		baseline:    o.Baseline,
+		hasBanner:   o.Banner || o.BannerMatch != nil,
+		hasStartTls: len(o.StartTls) > 0,
+		dns:         make([]time.Duration, 0, n),
+		tcp:         make([]time.Duration, 0, n),
+		tls:         make([]time.Duration, 0, n),
+		http:        make([]time.Duration, 0, n),
+		https:       make([]time.Duration, 0, n),
+		banner:      make([]time.Duration, 0, n),
+		starttls:    make([]time.Duration, 0, n),
+		rtt:         make([]time.Duration, 0, n),
+		jitter:      make([]time.Duration, 0, n),
+		settings:    make([]time.Duration, 0, n),
+		ttfb:        make([]time.Duration, 0, n),
+		ttfbMax:     make([]time.Duration, 0, n),
+		streams:     make([]time.Duration, 0, n),
+		reconnect:   make([]time.Duration, 0, n),
+		lag:         make([]time.Duration, 0, n),
+		times:       make([]time.Time, 0, n),
+	}
+
+	if o.Aggregate > 0 {
+		h.agg = newAggregator(o.Aggregate, nm, h.start)
+	}
+	if o.Anomaly.enabled() {
+		h.detect = newAnomalies(o.Anomaly)
+	}
+	if len(o.SLOs) > 0 {
+		h.slo = newSloSet(o.SLOs)
+		go m.seedSLOs(h, h.start)
 	}
 
 	m.perHost[nm] = h
+	delete(m.detached, nm)
 	return h
 }
 
+// add a pinger whose results are harvested by a new worker
+func (h *hostStats) addPinger(p Pinger) {
+	h.Lock()
+	h.pingers = append(h.pingers, p)
+	h.paused = false
+	h.Unlock()
+	h.wg.Add(1)
+}
+
+// stop the pingers and wait for the workers to drain them. Returns
+// true if there were pingers to stop.
+func (h *hostStats) stop() bool {
+	h.Lock()
+	pingers := h.pingers
+	h.pingers = nil
+	h.tracer = nil
+	h.paused = true
+	h.Unlock()
+
+	for _, p := range pingers {
+		p.Stop()
+	}
+	h.wg.Wait()
+	return len(pingers) > 0
+}
+
+type column struct {
+	nm string
+	v  *[]time.Duration
+}
+
+// return all the columns in the order they are charted
+func (h *hostStats) columns() []column {
+	return []column{
+		{"dns", &h.dns},
+		{"tcp", &h.tcp},
+		{"starttls", &h.starttls},
+		{"tls", &h.tls},
+		{"http", &h.http},
+		{"https", &h.https},
+		{"banner", &h.banner},
+		{"rtt", &h.rtt},
+		{"jitter", &h.jitter},
+		{"settings", &h.settings},
+		{"ttfb", &h.ttfb},
+		{"ttfb-max", &h.ttfbMax},
+		{"streams", &h.streams},
+		{plot.ReconnectColumn, &h.reconnect},
+		{plot.LagColumn, &h.lag},
+	}
+}
+
+// call 'fp' for each non-empty column
+func (h *hostStats) each(fp func(nm string, v []time.Duration)) {
+	for _, c := range h.columns() {
+		if v := *c.v; len(v) > 0 {
+			fp(c.nm, v)
+		}
+	}
+}
+
+// return the values added to each column since the last call
+func (h *hostStats) sample() Sample {
+	s := Sample{
+		Target:   h.name,
+		Time:     time.Now(),
+		NotAfter: h.notAfter,
+	}
+
+	cols := h.columns()
+	if len(h.seen) != len(cols) {
+		h.seen = make([]int, len(cols))
+	}
+
+	for i, c := range cols {
+		v := *c.v
+		if len(v) > h.seen[i] {
+			s.Names = append(s.Names, c.nm)
+			s.Vals = append(s.Vals, v[len(v)-1])
+		}
+		h.seen[i] = len(v)
+	}
+	return s
+}
+
+// return the number of raw samples in the current batch
+func (h *hostStats) samples() int {
+	n := 0
+	h.each(func(_ string, v []time.Duration) {
+		n = max(n, len(v))
+	})
+	return n
+}
+
+// return the number of samples in the current batch including the
+// ones already folded into histograms
+func (h *hostStats) pending() int {
+	n := h.samples()
+	if h.agg != nil {
+		n += h.agg.batch.n
+	}
+	return n
+}
+
 // asynchronously flush data and generate charts
 func (m *Measurer) asyncFlush(o *plot.Columns, hs *hostStats) {
+	hs.flushMu.Lock()
+	defer hs.flushMu.Unlock()
+
 	fname := o.Start.Format("2006-01-02-15.04.05")
 	stname := path.Join(hs.statsDir, fmt.Sprintf("%s.csv", fname))
 	chname := path.Join(hs.chartDir, fmt.Sprintf("%s.html", fname))
 
-	m.log.Info("batch-flush: %s: [%s] %d samples [cols: %s]", o.Name, fname, o.Minlen, strings.Join(o.Names, ","))
+	m.log.Info("batch-flush: %s: [%s] %d samples [cols: %s] %s", o.Name, fname, o.Minlen, strings.Join(o.Names, ","), o.CounterString())
 	m.log.Debug("batch-flush: %s: raw data: %s, chart: %s", o.Name, stname, chname)
 
-	if err := writeCharts(o, stname, chname); err != nil {
+	if err := writeCharts(o, hs.outputs, stname, chname); err != nil {
 		m.log.Warn("%s", err)
 	}
 
 	// now update the daily stats and see if we need to flush it as well
 	m.updateDailyStats(o, hs)
-	return
+
+	end := time.Now().UTC()
+	if n := len(o.Times); n > 0 {
+		end = o.Times[n-1]
+	}
+	m.rollups(hs, o.Start, end)
+	m.updateIndex(hs)
+	m.flushing.Done()
 }
 
 // write telemetry and charts for 'o'
-func writeCharts(o *plot.Columns, stname, chname string) error {
-	// first write the telemetry/stats
+func writeCharts(o *plot.Columns, out Outputs, stname, chname string) error {
+	if out.Has(OutputCsv) {
+		if err := writeCsv(o, stname); err != nil {
+			return err
+		}
+
+		smname := strings.TrimSuffix(stname, ".csv") + "-summary.csv"
+		if err := writeSummary(o.Summary(), smname); err != nil {
+			return err
+		}
+	}
+
+	// now plot and save the chart
+	return writeChart(o, out, chname)
+}
+
+// write the charts of 'o' in the formats in 'out'; 'chname' is the
+// html chart and the static ones are next to it. The svg output also
+// has a sparkline of the headline column for summaries.
+func writeChart(o *plot.Columns, out Outputs, chname string) error {
+	if out.Has(OutputHtml) {
+		if err := plot.Chart(o, chname); err != nil {
+			return fmt.Errorf("create chart %s: %w", chname, err)
+		}
+	}
+
+	base := strings.TrimSuffix(chname, ".html")
+	static := []struct {
+		out Outputs
+		sfx string
+	}{
+		{OutputSvg, ".svg"},
+		{OutputPng, ".png"},
+	}
+	for _, x := range static {
+		if !out.Has(x.out) {
+			continue
+		}
+
+		fn := base + x.sfx
+		if err := plot.Static(o, fn); err != nil {
+			return fmt.Errorf("create chart %s: %w", fn, err)
+		}
+	}
+
+	if out.Has(OutputSvg) && o.Minlen > 0 {
+		fn := base + "-spark.svg"
+		s := plot.Sparkline(o.Column(o.Headline()), plot.SparkW, plot.SparkH)
+		if err := os.WriteFile(fn, []byte(s), 0640); err != nil {
+			return fmt.Errorf("create chart %s: %w", fn, err)
+		}
+	}
+	return nil
+}
+
+// write the raw measurements in 'o' to 'stname'. The first column
+// is the time of the sample (if we know it).
+func writeCsv(o *plot.Columns, stname string) error {
 	fd, err := os.OpenFile(stname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_EXCL, 0640)
 	if err != nil {
 		return fmt.Errorf("create %s: %s", stname, err)
 	}
+	defer fd.Close()
 
-	fmt.Fprintf(fd, "%s\n", strings.Join(o.Names, ","))
+	names := o.Names
+	times := len(o.Times) >= o.Minlen
+	if times {
+		names = append([]string{"time"}, names...)
+	}
+	fmt.Fprintf(fd, "%s\n", strings.Join(names, ","))
 
 	// iterate over all rows and write the raw nanosecond-granularity measurement
-	z := make([]string, len(o.Names))
+	z := make([]string, len(names))
 	for i := 0; i < o.Minlen; i++ {
+		v := z
+		if times {
+			z[0] = o.Times[i].Format(time.RFC3339Nano)
+			v = z[1:]
+		}
 		for j, col := range o.Colref {
-			z[j] = fmt.Sprintf("%d", col[i])
+			v[j] = fmt.Sprintf("%d", col[i])
 		}
 		fmt.Fprintf(fd, "%s\n", strings.Join(z, ","))
 	}
-	fd.Close()
+	return nil
+}
 
-	// now plot and save the chart
-	if err = plot.Chart(o, chname); err != nil {
-		return fmt.Errorf("create chart %s: %w", chname, err)
+// write the summary stats of each column to 'smname'; the latencies
+// are in nanoseconds like the raw measurements.
+func writeSummary(v []plot.Stats, smname string) error {
+	fd, err := os.OpenFile(smname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_EXCL, 0640)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", smname, err)
+	}
+	defer fd.Close()
+
+	fmt.Fprintf(fd, "phase,count,failures,skipped,min,mean,stddev,p50,p90,p95,p99,p99.9,max\n")
+	for _, s := range v {
+		fmt.Fprintf(fd, "%s,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d\n", s.Name, s.N, s.Failures, s.Skipped,
+			s.Min, s.Mean, s.Stddev, s.P50, s.P90, s.P95, s.P99, s.P999, s.Max)
 	}
 	return nil
 }
 
 func (m *Measurer) updateDailyStats(o *plot.Columns, hs *hostStats) {
+	m.Lock()
 	ds, ok := m.perHostDaily[hs.name]
 	if !ok {
-		ds = &plot.Columns{
-			Name:   o.Name,
-			Start:  o.Start,
-			Names:  o.Names,
-			Colref: make([][]time.Duration, len(o.Names)),
-		}
+		ds = &plot.Columns{Name: o.Name}
 		m.perHostDaily[hs.name] = ds
 	}
+	m.Unlock()
+
+	// a target that was re-added with a different proto has
+	// different columns; flush what we have and start afresh
+	if !slices.Equal(ds.Names, o.Names) {
+		if ds.Minlen > 0 {
+			m.flushDaily(ds, hs)
+		}
+		ds.Names = o.Names
+		ds.Colref = make([][]time.Duration, len(o.Names))
+		ds.Times = ds.Times[:0]
+	}
 
-	perDay := int((86400 * time.Second) / m.interval)
+	if ds.Start.IsZero() {
+		ds.Start = o.Start
+	}
+	ds.Labels = o.Labels
+
+	perDay := hs.perDay
 	minlen := perDay * 10000
 	for i := range o.Names {
 		col := ds.Colref[i]
 		if cap(col) < perDay {
-			col = make([]time.Duration, 0, perDay)
+			col = slices.Grow(col, perDay-len(col))
 		}
 		col = append(col, o.Colref[i]...)
 		minlen = min(minlen, len(col))
 		ds.Colref[i] = col
 	}
 
+	ds.Times = append(ds.Times, o.Times...)
+
+	for _, k := range o.Marks {
+		k.Index += ds.Minlen
+		ds.Marks = append(ds.Marks, k)
+	}
+
 	ds.Minlen = minlen
+	ds.Counters = addCounters(ds.Counters, o.Counters)
 	if len(ds.Colref[0]) < perDay {
 		return
 	}
 
 	// time to flush this daily accumulator
+	m.flushDaily(ds, hs)
+}
 
-	fname := ds.Start.Format("2006-01-02")
+// write the daily stats in 'ds' and reset it
+func (m *Measurer) flushDaily(ds *plot.Columns, hs *hostStats) {
+	fname := dailyName(hs, ds.Start)
 	stname := path.Join(hs.statsDir, fmt.Sprintf("%s.csv", fname))
 	chname := path.Join(hs.chartDir, fmt.Sprintf("%s.html", fname))
 
-	m.log.Info("daily-flush: %s: [%s] %d samples [cols: %s]", ds.Name, fname, ds.Minlen, strings.Join(ds.Names, ","))
+	m.log.Info("daily-flush: %s: [%s] %d samples [cols: %s] %s", ds.Name, fname, ds.Minlen, strings.Join(ds.Names, ","), ds.CounterString())
 	m.log.Debug("daily-flush: %s: raw data: %s, chart: %s", ds.Name, stname, chname)
 
-	if err := writeCharts(ds, stname, chname); err != nil {
+	m.compareBaseline(ds, hs, fname)
+	ds.SLOs = m.reportSLOs(hs, fname)
+	if err := writeCharts(ds, hs.outputs, stname, chname); err != nil {
 		m.log.Warn("%s", err)
 	}
+	if n := len(ds.Times); n > 0 && hs.outputs.Has(OutputCsv) {
+		fn := path.Join(hs.statsDir, fname+"-errors.csv")
+		if err := writeDailyErrors(hs.statsDir, ds.Start, ds.Times[n-1], fn); err != nil {
+			m.log.Warn("%s", err)
+		}
+	}
 
 	// reset the daily counters
-	for i := range o.Names {
+	for i := range ds.Colref {
 		ds.Colref[i] = ds.Colref[i][:0]
 	}
+	ds.Times = ds.Times[:0]
+	ds.Start = time.Time{}
+	ds.Minlen = 0
+	ds.Counters = nil
+	ds.Marks = nil
+	ds.Baseline = nil
+	ds.SLOs = nil
+	m.updateIndex(hs)
+}
+
+// return the name for the daily stats starting at 't'. A restart or
+// a reload flushes a partial day; the next flush on the same day
+// gets a new name.
+func dailyName(hs *hostStats, t time.Time) string {
+	day := t.Format("2006-01-02")
+	nm := day
+	for i := 1; ; i++ {
+		_, err1 := os.Stat(path.Join(hs.statsDir, nm+".csv"))
+		_, err2 := os.Stat(path.Join(hs.chartDir, nm+".html"))
+		_, err3 := os.Stat(path.Join(hs.statsDir, nm+"-summary.csv"))
+		if os.IsNotExist(err1) && os.IsNotExist(err2) && os.IsNotExist(err3) {
+			return nm
+		}
+		nm = fmt.Sprintf("%s.%d", day, i)
+	}
+}
+
+// add the counters in 'b' to 'a' and return the result
+func addCounters(a, b []plot.Counter) []plot.Counter {
+	for _, c := range b {
+		i := slices.IndexFunc(a, func(x plot.Counter) bool { return x.Name == c.Name })
+		if i < 0 {
+			a = append(a, c)
+		} else {
+			a[i].Val += c.Val
+		}
+	}
+	return a
+}
+
+// add 'n' to the counter 'nm'
+func (h *hostStats) count(nm string, n int) {
+	for i := range h.counters {
+		c := &h.counters[i]
+		if c.Name == nm {
+			c.Val += uint64(n)
+			return
+		}
+	}
+	h.counters = append(h.counters, plot.Counter{Name: nm, Val: uint64(n)})
 }
 
 func (h *hostStats) makeOutput() plot.Columns {
 	o := plot.Columns{
 		Name:   h.name,
 		Start:  h.start,
+		Labels: h.labels,
 		Minlen: 10000000000,
 	}
 
 	// we store a ref to each of the slices and create new slices.
 	// This way, we can do the flush in an async goroutine and unblock the calling
 	// workers
-	if len(h.dns) > 0 {
-		o.Names = append(o.Names, "dns")
-		o.Colref = append(o.Colref, h.dns)
-		o.Minlen = min(o.Minlen, len(h.dns))
-		h.dns = make([]time.Duration, 0, cap(h.dns))
-	}
-	if len(h.tcp) > 0 {
-		o.Names = append(o.Names, "tcp")
-		o.Colref = append(o.Colref, h.tcp)
-		o.Minlen = min(o.Minlen, len(h.tcp))
-		h.tcp = make([]time.Duration, 0, cap(h.tcp))
-	}
-	if len(h.tls) > 0 {
-		o.Names = append(o.Names, "tls")
-		o.Colref = append(o.Colref, h.tls)
-		o.Minlen = min(o.Minlen, len(h.tls))
-		h.tls = make([]time.Duration, 0, cap(h.tls))
-	}
-	if len(h.http) > 0 {
-		o.Names = append(o.Names, "http")
-		o.Colref = append(o.Colref, h.http)
-		o.Minlen = min(o.Minlen, len(h.http))
-		h.http = make([]time.Duration, 0, cap(h.http))
-	}
-	if len(h.https) > 0 {
-		o.Names = append(o.Names, "https")
-		o.Colref = append(o.Colref, h.https)
-		o.Minlen = min(o.Minlen, len(h.https))
-		h.https = make([]time.Duration, 0, cap(h.https))
+	for _, c := range h.columns() {
+		if v := *c.v; len(v) > 0 {
+			o.Names = append(o.Names, c.nm)
+			o.Colref = append(o.Colref, v)
+			o.Minlen = min(o.Minlen, len(v))
+			*c.v = make([]time.Duration, 0, cap(v))
+		}
 	}
+	clear(h.seen)
+
+	o.Times = h.times
+	h.times = make([]time.Time, 0, cap(h.times))
+
+	o.Counters = h.counters
+	h.counters = nil
+	o.Marks = h.marks
+	h.marks = nil
 
 	// reset the counter
 	h.start = time.Now().UTC()
 
+	sortTimes(&o)
 	return o
 }
 
+// put the samples of 'o' in time order; with concurrent probes, they
+// come in the order the probes finish. Columns that don't have a value
+// for every sample (eg the setup of an h2 connection) are left alone.
+func sortTimes(o *plot.Columns) {
+	if slices.IsSortedFunc(o.Times, time.Time.Compare) {
+		return
+	}
+
+	idx := make([]int, len(o.Times))
+	for i := range idx {
+		idx[i] = i
+	}
+	slices.SortStableFunc(idx, func(a, b int) int {
+		return o.Times[a].Compare(o.Times[b])
+	})
+
+	times := make([]time.Time, len(idx))
+	for i, j := range idx {
+		times[i] = o.Times[j]
+	}
+	for k, v := range o.Colref {
+		if len(v) != len(idx) {
+			continue
+		}
+
+		c := make([]time.Duration, len(v))
+		for i, j := range idx {
+			c[i] = v[j]
+		}
+		o.Colref[k] = c
+	}
+	o.Times = times
+
+	// the marks move with their samples
+	pos := make([]int, len(idx))
+	for i, j := range idx {
+		pos[j] = i
+	}
+	for i := range o.Marks {
+		if k := &o.Marks[i]; k.Index < len(pos) {
+			k.Index = pos[k.Index]
+		}
+	}
+}
+
 // flush this batch to disk and generate the charts
 // This is called with the lock (on hs) held. Thus, we need to
 // do this part quickly
 func (m *Measurer) flush(hs *hostStats) {
+	if hs.agg != nil {
+		m.flushAgg(hs)
+		return
+	}
+
 	o := hs.makeOutput()
+	m.flushing.Add(1)
 	go m.asyncFlush(&o, hs)
 }
 
 func (m *Measurer) httpsWorker(hs *hostStats, p Pinger, hch chan HttpsResult) {
 	for r := range hch {
+		if r.Err != nil {
+			m.failed(hs, r.Err, r.Tick)
+			continue
+		}
+
 		hs.Lock()
-		if len(hs.https) == m.batchsize {
+		if len(hs.https) == hs.batchsize {
 			m.flush(hs)
 		}
 		hs.dns = append(hs.dns, r.DnsRtt)
@@ -323,7 +1191,281 @@ func (m *Measurer) httpsWorker(hs *hostStats, p Pinger, hch chan HttpsResult) {
 		hs.tls = append(hs.tls, r.TlsRtt)
 		hs.http = append(hs.http, r.HttpRtt)
 		hs.https = append(hs.https, r.HttpsRtt)
+		m.observe(hs, r.HttpsRtt, r.Tick)
 		hs.Unlock()
 	}
-	m.wg.Done()
+	hs.wg.Done()
+}
+
+func (m *Measurer) tcpWorker(hs *hostStats, p Pinger, tch chan TcpResult) {
+	for r := range tch {
+		if r.Err != nil {
+			m.failed(hs, r.Err, r.Tick)
+			continue
+		}
+
+		hs.Lock()
+		if len(hs.tcp) == hs.batchsize {
+			m.flush(hs)
+		}
+		hs.dns = append(hs.dns, r.DnsRtt)
+		hs.tcp = append(hs.tcp, r.ConnRtt)
+		if hs.hasBanner {
+			hs.banner = append(hs.banner, r.BannerRtt)
+		}
+		m.observe(hs, r.ConnRtt, r.Tick)
+		hs.Unlock()
+	}
+	hs.wg.Done()
+}
+
+func (m *Measurer) tlsWorker(hs *hostStats, p Pinger, tch chan TlsResult) {
+	for r := range tch {
+		if r.Err != nil {
+			m.failed(hs, r.Err, r.Tick)
+			continue
+		}
+
+		hs.Lock()
+		if len(hs.tls) == hs.batchsize {
+			m.flush(hs)
+		}
+		hs.dns = append(hs.dns, r.DnsRtt)
+		hs.tcp = append(hs.tcp, r.ConnRtt)
+		if hs.hasStartTls {
+			hs.starttls = append(hs.starttls, r.StartTlsRtt)
+		}
+		hs.tls = append(hs.tls, r.TlsRtt)
+		hs.notAfter = r.NotAfter
+		m.observe(hs, r.DnsRtt+r.ConnRtt+r.StartTlsRtt+r.TlsRtt, r.Tick)
+		hs.Unlock()
+	}
+	hs.wg.Done()
+}
+
+func (m *Measurer) udpWorker(hs *hostStats, p Pinger, uch chan UdpResult) {
+	for r := range uch {
+		if r.Err != nil {
+			m.failed(hs, r.Err, r.Tick)
+			continue
+		}
+
+		hs.Lock()
+		if len(hs.rtt) == hs.batchsize {
+			m.flush(hs)
+		}
+
+		if r.Recv > 0 {
+			hs.dns = append(hs.dns, r.DnsRtt)
+			hs.rtt = append(hs.rtt, r.Rtt)
+			hs.jitter = append(hs.jitter, r.Jitter)
+			m.observe(hs, r.Rtt, r.Tick)
+		}
+		hs.count("sent", r.Sent)
+		hs.count("lost", r.Lost)
+		hs.count("reordered", r.Reordered)
+		hs.count("dups", r.Dups)
+		hs.Unlock()
+
+		// a train that is entirely lost has no latencies: the probe
+		// failed
+		if r.Recv == 0 {
+			m.failed(hs, errAllLost, r.Tick)
+		}
+	}
+	hs.wg.Done()
+}
+
+func (m *Measurer) h2Worker(hs *hostStats, p Pinger, hch chan H2Result) {
+	for r := range hch {
+		if r.Err != nil {
+			m.failed(hs, r.Err, r.Tick)
+			continue
+		}
+
+		hs.Lock()
+		if len(hs.ttfb) == hs.batchsize {
+			m.flush(hs)
+		}
+		// the same for every probe of a target (see h2ping)
+		if r.Setup {
+			hs.dns = append(hs.dns, r.DnsRtt)
+			hs.tcp = append(hs.tcp, r.ConnRtt)
+			hs.tls = append(hs.tls, r.TlsRtt)
+			hs.settings = append(hs.settings, r.SettingsRtt)
+		} else {
+			var v time.Duration
+			if r.NewConn {
+				v = r.DnsRtt + r.ConnRtt + r.TlsRtt + r.SettingsRtt
+			}
+			hs.reconnect = append(hs.reconnect, v)
+		}
+		if r.NewConn {
+			hs.count("connections", 1)
+		}
+		hs.ttfb = append(hs.ttfb, r.Ttfb)
+		hs.ttfbMax = append(hs.ttfbMax, r.TtfbMax)
+		hs.streams = append(hs.streams, r.StreamsRtt)
+		m.observe(hs, r.StreamsRtt, r.Tick)
+		hs.Unlock()
+	}
+	hs.wg.Done()
+}
+
+// observe is called with the end-to-end latency of every sample
+// after it is recorded; it records the time of the sample (when its
+// probe was sent), how late the probe was and the probes skipped
+// before it, and looks for anomalies in it. This is called with the
+// lock on hs held.
+func (m *Measurer) observe(hs *hostStats, v time.Duration, tk Tick) {
+	now := time.Now().UTC()
+	at := sentAt(tk.At, now)
+	hs.times = append(hs.times, at)
+	hs.lag = append(hs.lag, tk.Lag)
+	if tk.Skipped > 0 {
+		hs.count("skipped", tk.Skipped)
+	}
+	if hs.tracer != nil {
+		hs.tracer.Trigger(v)
+	}
+
+	if hs.detect != nil || hs.slo != nil || len(m.hooks) > 0 {
+		s := hs.sample()
+		s.Time = at
+		s.E2e = v
+		if hs.detect != nil {
+			if s.Anomalies = hs.detect.check(&s); len(s.Anomalies) > 0 {
+				m.anomalous(hs, at, s.Anomalies)
+			}
+		}
+		if hs.slo != nil {
+			hs.slo.observe(&s)
+		}
+		for _, fp := range m.hooks {
+			fp(&s)
+		}
+	}
+
+	if a := hs.agg; a != nil && a.due(hs, now) {
+		m.fold(hs)
+		if a.batch.n >= hs.batchsize {
+			m.flushAgg(hs)
+		}
+	}
+}
+
+// record a failed probe 'tk'; the errors are appended to a csv file
+// alongside the current batch.
+func (m *Measurer) failed(hs *hostStats, err error, tk Tick) {
+	now := sentAt(tk.At, time.Now().UTC())
+
+	hs.Lock()
+	hs.count("errors", 1)
+	if tk.Skipped > 0 {
+		hs.count("skipped", tk.Skipped)
+	}
+	if hs.slo != nil {
+		hs.slo.failed(now)
+	}
+	fname := hs.start.Format("2006-01-02-15.04.05")
+	hs.Unlock()
+
+	if len(m.hooks) > 0 {
+		s := Sample{Target: hs.name, Time: now, Err: err}
+		for _, fp := range m.hooks {
+			fp(&s)
+		}
+	}
+
+	fn := path.Join(hs.statsDir, fmt.Sprintf("%s-errors.csv", fname))
+	fd, err2 := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err2 != nil {
+		m.log.Warn("create %s: %s", fn, err2)
+		return
+	}
+	defer fd.Close()
+
+	if st, err := fd.Stat(); err == nil && st.Size() == 0 {
+		fmt.Fprintf(fd, "time,error\n")
+	}
+
+	// keep the message on one line and out of the csv syntax
+	msg := strings.Map(func(r rune) rune {
+		switch r {
+		case ',', '\n', '\r':
+			return ' '
+		}
+		return r
+	}, err.Error())
+	fmt.Fprintf(fd, "%s,%s\n", now.Format(time.RFC3339Nano), msg)
+}
+
+// return the time a probe was sent in UTC; 'now' if it isn't known
+func sentAt(at, now time.Time) time.Time {
+	if at.IsZero() {
+		return now
+	}
+	return at.UTC()
+}
+
+func (m *Measurer) pathWorker(hs *hostStats, pch chan PathResult) {
+	for r := range pch {
+		hs.Lock()
+		prev := hs.path
+		hs.path = r.Path
+		fname := hs.start.Format("2006-01-02-15.04.05")
+
+		var diff []string
+		if prev != nil {
+			diff = prev.Diff(r.Path)
+		}
+
+		if len(diff) > 0 {
+			idx := len(hs.dns)
+			if hs.agg != nil {
+				idx = len(hs.agg.batch.rows)
+			}
+			hs.marks = append(hs.marks, plot.Mark{Index: idx, Label: "path change"})
+		}
+		hs.Unlock()
+
+		if prev == nil {
+			m.log.Info("%s: path: %s", hs.name, r.Path)
+		} else if len(diff) > 0 {
+			m.log.Warn("%s: path change (%s): %s", hs.name, r.Why, strings.Join(diff, "; "))
+		}
+
+		// store the trace alongside the current batch
+		stname := path.Join(hs.statsDir, fmt.Sprintf("%s-path.csv", fname))
+		if err := writePath(&r, stname); err != nil {
+			m.log.Warn("%s", err)
+		}
+	}
+	hs.wg.Done()
+}
+
+// append the hops of a trace to 'fn'
+func writePath(r *PathResult, fn string) error {
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", fn, err)
+	}
+	defer fd.Close()
+
+	if st, err := fd.Stat(); err == nil && st.Size() == 0 {
+		fmt.Fprintf(fd, "time,trigger,proto,ttl,addr,sent,recv,loss,rtt\n")
+	}
+
+	p := r.Path
+	ts := p.Start.Format(time.RFC3339)
+	for i := range p.Hops {
+		h := &p.Hops[i]
+		addr := "*"
+		if h.Addr != nil {
+			addr = h.Addr.String()
+		}
+		fmt.Fprintf(fd, "%s,%s,%s,%d,%s,%d,%d,%.2f,%d\n", ts, r.Why, p.Proto, h.TTL,
+			addr, h.Sent, len(h.Rtt), h.Loss(), h.Avg())
+	}
+	return nil
 }
@@ -0,0 +1,162 @@
+// pathmon.go - trace the network path to a target
+//
+// The path is traced periodically or when a sample exceeds a
+// threshold. Each trace is sent to the Measurer which stores it
+// alongside the batch csv and flags route changes.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/trace"
+)
+
+// min time between two threshold triggered traces
+const _TraceHoldoff = 1 * time.Minute
+
+type TraceOpts struct {
+	// "udp" or "tcp"; empty disables tracing
+	Proto string
+
+	// trace every 'Every'; zero disables periodic traces
+	Every time.Duration
+
+	// trace when a sample is larger than this; zero disables it
+	Threshold time.Duration
+}
+
+// PathResult is a completed trace and the reason for it
+type PathResult struct {
+	Path *trace.Path
+	Why  string
+}
+
+type tracer struct {
+	PingOpts
+
+	log  logger.Logger
+	addr string
+	opt  trace.Opts
+	trig chan time.Duration
+	ch   chan PathResult
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ Pinger = &tracer{}
+
+func NewTracer(cx context.Context, opts PingOpts) (*tracer, chan PathResult, error) {
+	to := &opts.Trace
+	switch to.Proto {
+	case "udp", "tcp":
+	default:
+		return nil, nil, fmt.Errorf("trace: %s: unknown proto '%s'", opts.Host, to.Proto)
+	}
+
+	if to.Every <= 0 && to.Threshold <= 0 {
+		return nil, nil, fmt.Errorf("trace: %s: needs an interval or a threshold", opts.Host)
+	}
+
+	ctx, cancel := context.WithCancel(cx)
+	t := &tracer{
+		PingOpts: opts,
+		log:      opts.Logger.New("trace", 0),
+		addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
+		opt: trace.Opts{
+			Proto: to.Proto,
+			Port:  int(opts.Port),
+		},
+		trig:   make(chan time.Duration, 1),
+		ch:     make(chan PathResult, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	t.log.Info("starting %s tracer: %s, every %s, threshold %s",
+		to.Proto, t.addr, to.Every, to.Threshold)
+
+	t.wg.Add(1)
+	go t.run()
+
+	return t, t.ch, nil
+}
+
+func (t *tracer) Stop() {
+	t.cancel()
+	t.wg.Wait()
+	close(t.ch)
+	t.log.Info("stopped tracer: %s", t.addr)
+}
+
+// Trigger queues a trace if 'v' is over the threshold. It never blocks.
+func (t *tracer) Trigger(v time.Duration) {
+	if t.Trace.Threshold <= 0 || v <= t.Trace.Threshold {
+		return
+	}
+
+	select {
+	case t.trig <- v:
+	default:
+	}
+}
+
+func (t *tracer) run() {
+	var tickch <-chan time.Time
+	if t.Trace.Every > 0 {
+		tick := time.NewTicker(t.Trace.Every)
+		defer tick.Stop()
+		tickch = tick.C
+	}
+	defer t.wg.Done()
+
+	var last time.Time
+	done := t.ctx.Done()
+	for {
+		var why string
+
+		select {
+		case <-tickch:
+			why = "periodic"
+
+		case v := <-t.trig:
+			if time.Since(last) < _TraceHoldoff {
+				continue
+			}
+			why = fmt.Sprintf("threshold %s > %s", v, t.Trace.Threshold)
+
+		case <-done:
+			return
+		}
+
+		last = time.Now()
+		p, err := t.trace()
+		if err != nil {
+			t.log.Warn("%s: %s", t.addr, err)
+			continue
+		}
+
+		t.log.Debug("%s: %s: %s", t.addr, why, p)
+		t.ch <- PathResult{p, why}
+	}
+}
+
+func (t *tracer) trace() (*trace.Path, error) {
+	ip := net.ParseIP(t.Host)
+	if ip == nil {
+		ips, err := net.DefaultResolver.LookupIP(t.ctx, "ip4", t.Host)
+		if err != nil {
+			return nil, fmt.Errorf("trace: dns: %w", err)
+		}
+		ip = ips[rand.IntN(len(ips))]
+	}
+	return trace.Run(t.ctx, ip, t.opt)
+}
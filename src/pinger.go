@@ -3,10 +3,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/http"
 )
 
 type Pinger interface {
@@ -18,13 +24,263 @@ type PingOpts struct {
 	Port  uint16
 	Proto string
 
+	// optional name for the target; see Name()
+	Alias string
+
 	Batchsize int
 	Interval  time.Duration
 	Timeout   time.Duration
 
+	// when the probes are sent
+	Schedule ScheduleOpts
+
+	// keep histograms per bucket of this width instead of the raw
+	// samples
+	Aggregate time.Duration
+
+	// tcp: read the server banner and optionally match it
+	Banner      bool
+	BannerMatch *regexp.Regexp
+
+	// tls: protocol to negotiate STARTTLS with (smtp, imap, postgres)
+	StartTls string
+
+	// udp: packets per probe and the rate (pkts/sec) to send them at
+	Count int
+	Rate  int
+
+	// h2: concurrent streams per probe and whether to reuse the
+	// connection across probes
+	Streams   int
+	KeepAlive bool
+
+	// trace the path to the target
+	Trace TraceOpts
+
+	// look for spikes and level shifts in the latencies
+	Anomaly AnomalyOpts
+
+	// compare the daily reports with this much earlier (eg 1d, 1w)
+	Baseline Age
+
+	// service level objectives
+	SLOs []SLO
+
+	// https, h2: the request to send
+	Request RequestOpts
+
+	// optional tls settings for https, h2 and tls targets
+	TLS *tls.Config
+
+	// per target output location, files and labels; the Measurer
+	// defaults are used if these are empty.
+	OutputDir string
+	Outputs   Outputs
+	Labels    map[string]string
+
 	Logger logger.Logger
 }
 
+// failed probes in a row after which a target is logged as down;
+// the failures after that are only logged at debug
+const _DownAfter = 3
+
+// failures counts the failed probes of a target in a row. A target
+// that is down keeps being probed on schedule (so that its
+// availability is measured) without flooding the logs.
+type failures struct {
+	n atomic.Int32
+}
+
+// log the failed probe 'err' to 'addr'
+func (f *failures) failed(log logger.Logger, addr string, err error) {
+	switch n := f.n.Add(1); {
+	case n < _DownAfter:
+		log.Warn("%s", err)
+	case n == _DownAfter:
+		log.Warn("%s: down after %d failed probes: %s", addr, n, err)
+	default:
+		log.Debug("%s", err)
+	}
+}
+
+// note a probe to 'addr' that worked
+func (f *failures) ok(log logger.Logger, addr string) {
+	if n := f.n.Swap(0); n >= _DownAfter {
+		log.Info("%s: target is up after %d failed probes", addr, n)
+	}
+}
+
+// return the built-in defaults for a target
+func defaultPingOpts() PingOpts {
+	return PingOpts{
+		Batchsize: _DefaultBatchSize,
+		Interval:  2 * time.Second,
+		Timeout:   2 * time.Second,
+		Count:     _DefaultUdpCount,
+		Rate:      _DefaultUdpRate,
+		Streams:   1,
+		Schedule: ScheduleOpts{
+			Mode:        "fixed",
+			Offset:      -1,
+			Concurrency: 1,
+		},
+	}
+}
+
+// Validate checks the settings for consistency. On error, it also
+// returns the name of the setting at fault (as named in the config
+// file).
+func (p *PingOpts) Validate() (string, error) {
+	if p.Interval <= 0 {
+		return "interval", fmt.Errorf("interval must be positive")
+	}
+	if p.Timeout <= 0 {
+		return "timeout", fmt.Errorf("timeout must be positive")
+	}
+	if err := p.Schedule.Validate(p.Interval); err != nil {
+		return "schedule", err
+	}
+	if p.Schedule.Concurrency > 1 {
+		// udp jitter is tracked across trains and h2 keepalive
+		// probes share a connection
+		switch {
+		case p.Proto == "udp":
+			return "schedule", fmt.Errorf("udp probes can't overlap")
+		case p.Proto == "h2" && p.KeepAlive:
+			return "schedule", fmt.Errorf("h2 keepalive probes can't overlap")
+		}
+	}
+	if p.Aggregate < 0 {
+		return "aggregate", fmt.Errorf("aggregate must be positive")
+	}
+	if p.Aggregate > 0 && p.Aggregate < p.Interval {
+		return "aggregate", fmt.Errorf("aggregate (%s) is shorter than the interval (%s)", p.Aggregate, p.Interval)
+	}
+
+	// samples per day can't be smaller than batchsize
+	perDay := int((86400 * time.Second) / p.Interval)
+	if p.Batchsize >= perDay {
+		return "batch-size", fmt.Errorf("batch-size is greater than total samples per day (%d)", perDay)
+	}
+
+	if _, err := starttls(p.StartTls); err != nil {
+		return "starttls", err
+	}
+
+	if p.Proto == "udp" {
+		if p.Count <= 0 || p.Rate <= 0 {
+			return "udp", fmt.Errorf("udp count and rate must be positive")
+		}
+
+		train := time.Duration(p.Count) * (time.Second / time.Duration(p.Rate))
+		if train >= p.Interval {
+			return "udp", fmt.Errorf("%d packets at %d pps won't fit in %s", p.Count, p.Rate, p.Interval)
+		}
+	}
+
+	if t := &p.Trace; len(t.Proto) > 0 {
+		if t.Proto != "udp" && t.Proto != "tcp" {
+			return "trace", fmt.Errorf("unknown trace proto '%s'", t.Proto)
+		}
+		if t.Every <= 0 && t.Threshold <= 0 {
+			return "trace", fmt.Errorf("trace needs an interval or a threshold")
+		}
+	}
+	if p.Anomaly.Spike < 0 || p.Anomaly.Shift < 0 {
+		return "anomaly", fmt.Errorf("anomaly thresholds can't be negative")
+	}
+
+	for i := range p.SLOs {
+		s := &p.SLOs[i]
+		if err := s.Validate(); err != nil {
+			return "slos", err
+		}
+		if slices.ContainsFunc(p.SLOs[:i], func(x SLO) bool { return x.Name == s.Name }) {
+			return "slos", fmt.Errorf("duplicate slo '%s'", s.Name)
+		}
+	}
+	return "", nil
+}
+
+// Equal returns true if 'p' and 'q' describe the same measurement
+func (p *PingOpts) Equal(q *PingOpts) bool {
+	return p.Host == q.Host && p.Port == q.Port && p.Proto == q.Proto &&
+		p.Alias == q.Alias &&
+		p.Batchsize == q.Batchsize && p.Interval == q.Interval && p.Timeout == q.Timeout &&
+		p.Schedule == q.Schedule &&
+		p.Aggregate == q.Aggregate &&
+		p.Banner == q.Banner && sameRegexp(p.BannerMatch, q.BannerMatch) &&
+		p.StartTls == q.StartTls &&
+		p.Count == q.Count && p.Rate == q.Rate &&
+		p.Streams == q.Streams && p.KeepAlive == q.KeepAlive &&
+		p.Trace == q.Trace && p.Anomaly == q.Anomaly && p.Baseline == q.Baseline &&
+		slices.Equal(p.SLOs, q.SLOs) &&
+		p.Request.Method == q.Request.Method && p.Request.Path == q.Request.Path &&
+		maps.Equal(p.Request.Headers, q.Request.Headers) &&
+		sameTLS(p.TLS, q.TLS) &&
+		p.OutputDir == q.OutputDir && p.Outputs == q.Outputs &&
+		maps.Equal(p.Labels, q.Labels)
+}
+
+func sameRegexp(a, b *regexp.Regexp) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.String() == b.String()
+}
+
+// we only compare the tls settings that are configurable
+func sameTLS(a, b *tls.Config) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.InsecureSkipVerify == b.InsecureSkipVerify &&
+		a.ServerName == b.ServerName &&
+		a.RootCAs.Equal(b.RootCAs)
+}
+
+type RequestOpts struct {
+	Method  string
+	Path    string
+	Headers map[string]string
+}
+
+// return a new http request to 'url' for the target
+func (p *PingOpts) newRequest(url string) *http.Request {
+	r := &p.Request
+	meth := r.Method
+	if len(meth) == 0 {
+		meth = "HEAD"
+	}
+
+	req := http.NewRequest(meth, url+r.Path)
+	for k, v := range r.Headers {
+		req.Headers.Set(k, v)
+	}
+	return req
+}
+
+// return a new client for the target
+func (p *PingOpts) newClient() *http.Client {
+	cl := http.NewClient(p.Timeout)
+	cl.TLS = p.TLS
+	return cl
+}
+
+// Name returns the name under which the measurements of this target
+// are stored. Unless the user named it, https targets are named after
+// the host; all others carry the proto and port as well.
+func (p *PingOpts) Name() string {
+	if len(p.Alias) > 0 {
+		return p.Alias
+	}
+	if p.Proto == "https" {
+		return p.Host
+	}
+	return fmt.Sprintf("%s-%s-%d", p.Proto, p.Host, p.Port)
+}
+
 type IcmpResult struct {
 	Rtt time.Duration
 }
@@ -35,9 +291,120 @@ type HttpsResult struct {
 	TlsRtt   time.Duration
 	HttpRtt  time.Duration
 	HttpsRtt time.Duration
+
+	// when the probe was sent and how late
+	Tick
+
+	// set if the probe failed; the other fields are not valid
+	Err error
 }
 
 func (h HttpsResult) String() string {
 	return fmt.Sprintf("dns: %s, tcp: %s, tls: %s, http: %s, e2e: %s",
 		h.DnsRtt, h.ConnRtt, h.TlsRtt, h.HttpRtt, h.HttpsRtt)
 }
+
+type TcpResult struct {
+	DnsRtt    time.Duration
+	ConnRtt   time.Duration
+	BannerRtt time.Duration
+	Banner    string
+
+	// when the probe was sent and how late
+	Tick
+
+	// set if the probe failed; the other fields are not valid
+	Err error
+}
+
+func (t TcpResult) String() string {
+	return fmt.Sprintf("dns: %s, tcp: %s, banner: %s", t.DnsRtt, t.ConnRtt, t.BannerRtt)
+}
+
+type TlsResult struct {
+	DnsRtt      time.Duration
+	ConnRtt     time.Duration
+	StartTlsRtt time.Duration
+	TlsRtt      time.Duration
+
+	// negotiated params
+	Version string
+	Cipher  string
+
+	// leaf certificate details
+	Subject  string
+	Issuer   string
+	Serial   string
+	NotAfter time.Time
+
+	// when the probe was sent and how late
+	Tick
+
+	// set if the probe failed; the other fields are not valid
+	Err error
+}
+
+func (t TlsResult) String() string {
+	return fmt.Sprintf("dns: %s, tcp: %s, starttls: %s, tls: %s",
+		t.DnsRtt, t.ConnRtt, t.StartTlsRtt, t.TlsRtt)
+}
+
+// Cert returns a printable summary of the certificate and session
+func (t TlsResult) Cert() string {
+	days := int(time.Until(t.NotAfter).Hours() / 24)
+	return fmt.Sprintf("subject '%s', issuer '%s', serial %s, expires %s (%d days); %s, %s",
+		t.Subject, t.Issuer, t.Serial, t.NotAfter.Format(time.RFC3339), days, t.Version, t.Cipher)
+}
+
+type UdpResult struct {
+	DnsRtt time.Duration
+	Rtt    time.Duration
+	Jitter time.Duration
+
+	Sent      int
+	Recv      int
+	Lost      int
+	Reordered int
+	Dups      int
+
+	// when the probe was sent and how late
+	Tick
+
+	// set if the probe failed; the other fields are not valid
+	Err error
+}
+
+func (u UdpResult) String() string {
+	return fmt.Sprintf("dns: %s, rtt: %s, jitter: %s, sent %d, lost %d, reordered %d, dups %d",
+		u.DnsRtt, u.Rtt, u.Jitter, u.Sent, u.Lost, u.Reordered, u.Dups)
+}
+
+type H2Result struct {
+	DnsRtt      time.Duration
+	ConnRtt     time.Duration
+	TlsRtt      time.Duration
+	SettingsRtt time.Duration
+
+	// mean and max time to first byte across streams and the time
+	// for all streams to complete
+	Ttfb       time.Duration
+	TtfbMax    time.Duration
+	StreamsRtt time.Duration
+
+	// true if this probe made a new connection
+	NewConn bool
+
+	// true if the connection setup times are part of the sample
+	Setup bool
+
+	// when the probe was sent and how late
+	Tick
+
+	// set if the probe failed; the other fields are not valid
+	Err error
+}
+
+func (h H2Result) String() string {
+	return fmt.Sprintf("dns: %s, tcp: %s, tls: %s, settings: %s, ttfb: %s, ttfb-max: %s, streams: %s",
+		h.DnsRtt, h.ConnRtt, h.TlsRtt, h.SettingsRtt, h.Ttfb, h.TtfbMax, h.StreamsRtt)
+}
@@ -0,0 +1,115 @@
+// reflect.go - udp echo responder for the udp pinger
+//
+// 'latmon reflect' echoes every well formed probe packet back to its
+// sender unmodified; the pinger computes all the stats.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/pflag"
+)
+
+const _DefaultReflectAddr string = ":7862"
+
+func reflectMain(args []string) {
+	var help bool
+	var addr, logdest, lvl string
+
+	fs := pflag.NewFlagSet("reflect", pflag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help message and exit")
+	fs.StringVarP(&addr, "listen", "l", _DefaultReflectAddr, "Listen for udp probes on `A`")
+	fs.StringVarP(&logdest, "log", "L", "STDERR", "Send logs to destination `L`")
+	fs.StringVarP(&lvl, "log-level", "", "INFO", "Log at priority `P`")
+
+	err := fs.Parse(args)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	if help {
+		fmt.Printf(`%s reflect: udp echo responder for udp:host:port targets
+
+Usage: %s reflect [options]
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	prio, ok := logger.ToPriority(lvl)
+	if !ok {
+		Die("Unknown log level '%s'", lvl)
+	}
+
+	log, err := logger.NewLogger(logdest, prio, Z, logger.Ldate|logger.Ltime|logger.Lmicroseconds|logger.Lfileloc)
+	if err != nil {
+		Die("can't create logger: %s", err)
+	}
+
+	ua, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		Die("reflect: %s: %s", addr, err)
+	}
+
+	conn, err := net.ListenUDP("udp", ua)
+	if err != nil {
+		Die("reflect: %s", err)
+	}
+
+	log.Info("Starting udp reflector [%s, %s] on %s", ProductVersion, RepoVersion, conn.LocalAddr())
+
+	done := make(chan struct{})
+	go func() {
+		reflect(conn, log)
+		close(done)
+	}()
+
+	sigchan := make(chan os.Signal, 4)
+	signal.Notify(sigchan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	s := <-sigchan
+	log.Info("Caught signal %d; Terminating ..\n", int(s.(syscall.Signal)))
+
+	conn.Close()
+	<-done
+}
+
+// echo valid probes back till the socket is closed
+func reflect(conn *net.UDPConn, log logger.Logger) {
+	var p udpPkt
+	var n, bad uint64
+
+	buf := make([]byte, 1500)
+	for {
+		sz, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warn("reflect: read: %s", err)
+			}
+			break
+		}
+
+		if err = p.unmarshal(buf[:sz]); err != nil {
+			log.Debug("reflect: %s: %s", from, err)
+			bad++
+			continue
+		}
+
+		if _, err = conn.WriteToUDP(buf[:sz], from); err != nil {
+			log.Warn("reflect: %s: write: %s", from, err)
+			continue
+		}
+		n++
+	}
+
+	log.Info("reflect: echoed %d packets, dropped %d malformed", n, bad)
+}
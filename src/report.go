@@ -0,0 +1,619 @@
+// report.go - regenerate charts and summaries from the stored csv files
+//
+// 'latmon report' reads batch, daily or hist csv files (or the stats
+// dir of a target), merges them by target and time and writes for
+// each target:
+//
+//	<outdir>/stats/<target>/NAME.csv          merged samples
+//	<outdir>/stats/<target>/NAME-summary.csv  summary of each phase
+//	<outdir>/charts/<target>/NAME.html        the chart
+//	<outdir>/stats/<target>/NAME-slo.csv      the SLOs (with -c FILE)
+//
+// The target of a file is the name of its dir. Aggregated targets
+// (hist files) get a summary and a chart of the merged histograms.
+// With -c FILE, the SLOs of the targets in the config file are worked
+// out as of the last sample of the report (see slo.go) and shown
+// below its chart. With --compare, a single comparison of a phase across the targets
+// is written instead (see compare.go):
+//
+//	<outdir>/compare/NAME.html
+//	<outdir>/compare/NAME-summary.csv
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/opencoff/latmon/internal/hdr"
+	"github.com/opencoff/latmon/internal/plot"
+	"github.com/opencoff/pflag"
+)
+
+// the csv files of a target
+type reportInput struct {
+	name    string
+	samples []string
+	errors  []string
+	hists   []string
+}
+
+// what goes into a report
+type reportQuery struct {
+	from, to time.Time
+	phases   map[string]bool
+	ii       time.Duration
+}
+
+func (q *reportQuery) want(phase string) bool {
+	return q.phases == nil || q.phases[phase]
+}
+
+// latmon report [options] FILE|DIR [FILE|DIR..]
+func reportMain(args []string) {
+	var help, force bool
+	var outdir, name, from, to, cmpPhase, cfgFile string
+	var phases, outs []string
+
+	ii := defaultPingOpts().Interval
+
+	fs := pflag.NewFlagSet("report", pflag.ExitOnError)
+	fs.BoolVarP(&help, "help", "h", false, "Show this help message and exit")
+	fs.StringVarP(&outdir, "output-dir", "d", ".", "Put the reports in directory `D`")
+	fs.StringVarP(&name, "name", "n", "", "Name the reports `N` [report-FIRST--LAST]")
+	fs.StringVarP(&from, "from", "", "", "Skip samples before time `T` (RFC3339, unix secs or -duration)")
+	fs.StringVarP(&to, "to", "", "", "Skip samples at or after time `T`")
+	fs.StringSliceVarP(&phases, "phase", "p", nil, "Only report phases `P` (eg tcp,tls)")
+	fs.StringSliceVarP(&outs, "outputs", "", []string{"csv", "html"}, "Write outputs `O` (csv, html)")
+	fs.DurationVarP(&ii, "every", "i", ii, "Time the rows of batches without a time column `I` apart")
+	fs.StringVarP(&cmpPhase, "compare", "", "", "Compare phase `P` across the targets")
+	fs.StringVarP(&cfgFile, "config", "c", "", "Evaluate the SLOs of the targets in config file `F`")
+	fs.BoolVarP(&force, "force", "f", false, "Overwrite existing reports")
+
+	err := fs.Parse(args)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	args = fs.Args()
+	if help || len(args) == 0 {
+		fmt.Printf(`%s report: regenerate charts and summaries from stored csv files
+
+Usage: %s report [options] FILE|DIR [FILE|DIR..]
+
+FILE is a batch, daily, errors or hist csv file (optionally
+compressed); DIR is the stats dir of a target (all its batches). The
+files of each target are merged by time.
+
+Options:
+`, Z, Z)
+		fs.PrintDefaults()
+		os.Exit(0)
+	}
+
+	now := time.Now().UTC()
+	q := reportQuery{
+		to: time.Unix(1<<62, 0),
+		ii: ii,
+	}
+
+	if len(from) > 0 {
+		if q.from, err = parseTime(from, now); err != nil {
+			Die("from: %s", err)
+		}
+	}
+	if len(to) > 0 {
+		if q.to, err = parseTime(to, now); err != nil {
+			Die("to: %s", err)
+		}
+	}
+	if !q.from.Before(q.to) {
+		Die("'from' must be before 'to'")
+	}
+
+	if len(cmpPhase) > 0 {
+		phases = []string{cmpPhase}
+	}
+
+	if len(phases) > 0 {
+		q.phases = make(map[string]bool)
+		for _, p := range phases {
+			q.phases[strings.ToLower(strings.TrimSpace(p))] = true
+		}
+	}
+
+	out, err := ParseOutputs(outs)
+	if err != nil {
+		Die("%s", err)
+	}
+
+	// the SLOs of each target
+	slos := make(map[string][]SLO)
+	if len(cfgFile) > 0 {
+		base := defaultPingOpts()
+		c, err := ReadConfig(cfgFile, &base)
+		if err != nil {
+			Die("%s", err)
+		}
+		for i := range c.Targets {
+			o := &c.Targets[i]
+			slos[o.Name()] = o.SLOs
+		}
+	}
+
+	var targets []*reportInput
+	for _, a := range args {
+		if err := addReportInput(&targets, a, &q); err != nil {
+			Die("%s", err)
+		}
+	}
+
+	if len(cmpPhase) > 0 {
+		if err := compareReport(targets, &q, strings.ToLower(cmpPhase), outdir, name, out, force); err != nil {
+			Die("%s", err)
+		}
+		if err := writeRootIndex(outdir); err != nil {
+			Warn("%s", err)
+		}
+		os.Exit(0)
+	}
+
+	rc := 0
+	for _, in := range targets {
+		if err := makeReport(in, &q, slos[in.name], outdir, name, out, force); err != nil {
+			Warn("%s: %s", in.name, err)
+			rc = 1
+			continue
+		}
+		if err := writeIndexes(outdir, in.name); err != nil {
+			Warn("%s", err)
+		}
+	}
+	os.Exit(rc)
+}
+
+// add the csv files in 'fn' to the inputs of its target
+func addReportInput(targets *[]*reportInput, fn string, q *reportQuery) error {
+	fn, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+
+	nm := filepath.Base(filepath.Dir(fn))
+	files := []string{fn}
+	if fi.IsDir() {
+		nm = filepath.Base(fn)
+		files = files[:0]
+		for _, kind := range []string{batchSamples, batchErrors, batchHist} {
+			v, err := batchFiles(fn, kind, q.from, q.to)
+			if err != nil {
+				return err
+			}
+
+			// the rows repeated in the daily files are counted once
+			days, err := listDaily(fn, kind)
+			if err != nil {
+				return err
+			}
+			for _, b := range append(v, inRange(days, q.from, q.to, 24*time.Hour)...) {
+				files = append(files, b.name)
+			}
+		}
+	}
+
+	i := slices.IndexFunc(*targets, func(r *reportInput) bool { return r.name == nm })
+	if i < 0 {
+		*targets = append(*targets, &reportInput{name: nm})
+		i = len(*targets) - 1
+	}
+	in := (*targets)[i]
+
+	for _, f := range files {
+		base := strings.TrimSuffix(strings.TrimSuffix(f, ".gz"), ".zst")
+		switch {
+		case strings.HasSuffix(base, "-errors.csv"):
+			in.errors = append(in.errors, f)
+		case strings.HasSuffix(base, "-hist.csv"):
+			in.hists = append(in.hists, f)
+		case strings.HasSuffix(base, "-summary.csv"), strings.HasSuffix(base, "-worst.csv"),
+			strings.HasSuffix(base, "-path.csv"), strings.HasSuffix(base, "-events.csv"),
+			strings.HasSuffix(base, "-baseline.csv"), strings.HasSuffix(base, "-slo.csv"):
+			Warn("%s: not a samples file; skipping ..", f)
+		case strings.HasSuffix(base, ".csv"):
+			in.samples = append(in.samples, f)
+		default:
+			return fmt.Errorf("%s: not a csv file", f)
+		}
+	}
+	return nil
+}
+
+// make the report of target 'in' and evaluate its SLOs (if any)
+func makeReport(in *reportInput, q *reportQuery, slos []SLO, outdir, name string, out Outputs, force bool) error {
+	errs, err := reportErrorTimes(in, q)
+	if err != nil {
+		return err
+	}
+	counters := []plot.Counter{{Name: "errors", Val: uint64(len(errs))}}
+
+	if len(in.hists) > 0 {
+		if len(in.samples) > 0 {
+			Warn("%s: ignoring raw samples of an aggregated target", in.name)
+		}
+		if len(slos) > 0 {
+			Warn("%s: no raw samples to evaluate the SLOs with", in.name)
+		}
+
+		a, err := histReport(in, q)
+		if err != nil {
+			return err
+		}
+		if a.n == 0 {
+			return fmt.Errorf("no samples")
+		}
+		a.counters = counters
+
+		var last time.Time
+		if n := len(a.rows); n > 0 {
+			last = a.rows[n-1].t
+		}
+		stname, chname, err := reportFiles(in.name, outdir, reportName(name, a.start, last), out, force)
+		if err != nil {
+			return err
+		}
+		return writeReportAgg(a, out, stname, chname)
+	}
+
+	o, err := sampleReport(in, q)
+	if err != nil {
+		return err
+	}
+	if o.Minlen == 0 {
+		return fmt.Errorf("no samples")
+	}
+	o.Counters = counters
+
+	stname, chname, err := reportFiles(in.name, outdir, reportName(name, o.Start, o.Times[o.Minlen-1]), out, force)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d samples [%s] %s\n", in.name, o.Minlen, strings.Join(o.Names, ","), o.CounterString())
+	if len(slos) > 0 {
+		o.SLOs = evalSLOs(slos, o, errs)
+		for i := range o.SLOs {
+			s := &o.SLOs[i]
+			fmt.Printf("    slo %s: %.3f%% of %d probes (objective %.3f%% over %s); %.1f%% of the error budget spent\n",
+				s.Name, 100*s.Compliance, s.Total, 100*s.Objective, plot.Window(s.Window), 100*(1-s.Budget))
+		}
+
+		if out.Has(OutputCsv) {
+			fn := strings.TrimSuffix(stname, ".csv") + "-slo.csv"
+			if err := writeSLOCsv(o.SLOs, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return writeCharts(o, out, stname, chname)
+}
+
+// return the state of 'slos' as of the last sample in 'o'; 'errs' are
+// the failed probes.
+func evalSLOs(slos []SLO, o *plot.Columns, errs []time.Time) []plot.SLOStatus {
+	ss := newSloSet(slos)
+	for i := 0; i < o.Minlen; i++ {
+		s := Sample{
+			Time:  o.Times[i],
+			Names: o.Names,
+			Vals:  make([]time.Duration, len(o.Names)),
+		}
+		for j := range o.Names {
+			s.Vals[j] = o.Colref[j][i]
+		}
+		ss.observe(&s)
+	}
+	for _, t := range errs {
+		ss.failed(t)
+	}
+	return ss.status(o.Times[o.Minlen-1])
+}
+
+// compare 'phase' across the targets in 'targets'
+func compareReport(targets []*reportInput, q *reportQuery, phase, outdir, name string, out Outputs, force bool) error {
+	if !isPhase(phase) {
+		return fmt.Errorf("unknown phase '%s'", phase)
+	}
+
+	var v []*plot.Columns
+	var first, last time.Time
+	for _, in := range targets {
+		if len(in.samples) == 0 {
+			Warn("%s: no raw samples; skipping ..", in.name)
+			continue
+		}
+
+		o, err := sampleReport(in, q)
+		if err != nil {
+			return fmt.Errorf("%s: %w", in.name, err)
+		}
+		if o.Minlen == 0 {
+			Warn("%s: no %s samples; skipping ..", in.name, phase)
+			continue
+		}
+
+		errs, err := reportErrorTimes(in, q)
+		if err != nil {
+			return err
+		}
+		o.Counters = []plot.Counter{{Name: "errors", Val: uint64(len(errs))}}
+
+		if first.IsZero() || o.Start.Before(first) {
+			first = o.Start
+		}
+		if t := o.Times[o.Minlen-1]; t.After(last) {
+			last = t
+		}
+		v = append(v, o)
+	}
+
+	if len(v) == 0 {
+		return fmt.Errorf("no samples")
+	}
+
+	dir := filepath.Join(outdir, "compare")
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+
+	nm := reportName(name, first, last)
+	base := filepath.Join(dir, nm)
+	for _, fn := range []string{base + ".html", base + "-summary.csv"} {
+		if _, err := os.Stat(fn); err == nil && !force {
+			return fmt.Errorf("%s exists; use --force to overwrite", fn)
+		}
+	}
+
+	fmt.Printf("compare: %s of %d targets\n", phase, len(v))
+	return writeCompare(nm, phase, v, base, out)
+}
+
+// return the times of the failed probes of 'in'
+func reportErrorTimes(in *reportInput, q *reportQuery) ([]time.Time, error) {
+	var errs []time.Time
+	var err error
+	for _, fn := range in.errors {
+		if errs, err = readErrorFile(fn, q.from, q.to, errs); err != nil {
+			return nil, err
+		}
+	}
+
+	// the same probe may be in a batch and in its daily file
+	slices.SortFunc(errs, func(a, b time.Time) int { return a.Compare(b) })
+	return slices.CompactFunc(errs, func(a, b time.Time) bool { return a.Equal(b) }), nil
+}
+
+// merge the samples of 'in' by time
+func sampleReport(in *reportInput, q *reportQuery) (*plot.Columns, error) {
+	var v []Sample
+	for _, fn := range in.samples {
+		_, t, _ := classify(filepath.Base(fn))
+		err := readBatch(batchFile{fn, t}, in.name, q.from, q.to, q.ii, func(s *Sample) {
+			v = append(v, *s)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	o, skip := toColumns(in.name, v, q.want)
+	if skip > 0 {
+		Warn("%s: skipped %d samples without all the phases", in.name, skip)
+	}
+	return o, nil
+}
+
+// make columns of the phases in 'v' that 'want' wants; the samples
+// are merged by time. Returns the number of samples skipped for lack
+// of a phase.
+func toColumns(name string, v []Sample, want func(string) bool) (*plot.Columns, int) {
+	slices.SortStableFunc(v, func(a, b Sample) int {
+		return a.Time.Compare(b.Time)
+	})
+
+	o := &plot.Columns{Name: name}
+	for i := range v {
+		for _, c := range v[i].Names {
+			if want(c) && !slices.Contains(o.Names, c) {
+				o.Names = append(o.Names, c)
+			}
+		}
+	}
+	o.Colref = make([][]time.Duration, len(o.Names))
+
+	var skip int
+	for i := range v {
+		s := &v[i]
+
+		// the daily files repeat the batches
+		if i > 0 && s.Time.Equal(v[i-1].Time) {
+			continue
+		}
+
+		// a target that changed proto has different columns
+		if !hasAll(s.Names, o.Names) {
+			skip++
+			continue
+		}
+
+		for j, c := range o.Names {
+			k := slices.Index(s.Names, c)
+			o.Colref[j] = append(o.Colref[j], s.Vals[k])
+		}
+		o.Times = append(o.Times, s.Time)
+	}
+
+	o.Minlen = len(o.Times)
+	if o.Minlen > 0 {
+		o.Start = o.Times[0]
+	}
+	return o, skip
+}
+
+// return true if 'v' has all of 'names'
+func hasAll(v, names []string) bool {
+	for _, nm := range names {
+		if !slices.Contains(v, nm) {
+			return false
+		}
+	}
+	return true
+}
+
+// merge the histograms of 'in' by bucket
+func histReport(in *reportInput, q *reportQuery) (*aggSet, error) {
+	type bucket struct {
+		t     time.Time
+		names []string
+		hists []*hdr.Histogram
+	}
+
+	// a daily hist file has a single merged bucket of the day; the
+	// days are read up to the batches (see histCut)
+	var batches, days []batchFile
+	for _, fn := range in.hists {
+		kind, t, _ := classify(filepath.Base(fn))
+		if kind == fileDaily {
+			days = append(days, batchFile{fn, t})
+		} else {
+			batches = append(batches, batchFile{fn, t})
+		}
+	}
+	for _, v := range [][]batchFile{batches, days} {
+		slices.SortStableFunc(v, func(a, b batchFile) int {
+			return a.start.Compare(b.start)
+		})
+	}
+
+	m := make(map[int64]*bucket)
+	err := scanHistFiles(batches, days, q.from, q.to, func(t time.Time, ph string, h *hdr.Histogram) {
+		if !q.want(ph) {
+			return
+		}
+
+		b, ok := m[t.UnixNano()]
+		if !ok {
+			b = &bucket{t: t}
+			m[t.UnixNano()] = b
+		}
+		if !slices.Contains(b.names, ph) {
+			b.names = append(b.names, ph)
+			b.hists = append(b.hists, h)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bs := make([]*bucket, 0, len(m))
+	for _, b := range m {
+		bs = append(bs, b)
+	}
+	slices.SortFunc(bs, func(a, b *bucket) int {
+		return a.t.Compare(b.t)
+	})
+
+	a := newAggSet(in.name, time.Time{})
+	if len(bs) > 0 {
+		a.start = bs[0].t
+	}
+
+	for _, b := range bs {
+		var n uint64
+		for _, h := range b.hists {
+			n = max(n, h.Count())
+		}
+		a.record(b.t, int(n), b.names, b.hists)
+	}
+	return a, nil
+}
+
+// the name of a report over [first, last] unless given
+func reportName(name string, first, last time.Time) string {
+	if len(name) > 0 {
+		return name
+	}
+	return fmt.Sprintf("report-%s--%s", first.Format(_BatchFmt), last.Format(_BatchFmt))
+}
+
+// make the dirs of the report 'nm' of target 'target' and return the
+// names of its csv and chart files. Existing reports are removed if
+// 'force' is set.
+func reportFiles(target, outdir, nm string, out Outputs, force bool) (string, string, error) {
+	stdir := filepath.Join(outdir, "stats", target)
+	chdir := filepath.Join(outdir, "charts", target)
+	stname := filepath.Join(stdir, nm+".csv")
+	chname := filepath.Join(chdir, nm+".html")
+
+	var files []string
+	if out.Has(OutputCsv) {
+		if err := os.MkdirAll(stdir, 0750); err != nil {
+			return "", "", err
+		}
+		files = append(files, stname, filepath.Join(stdir, nm+"-summary.csv"), filepath.Join(stdir, nm+"-slo.csv"))
+	}
+	if out.Any(_ChartOutputs) {
+		if err := os.MkdirAll(chdir, 0750); err != nil {
+			return "", "", err
+		}
+	}
+	if out.Has(OutputHtml) {
+		files = append(files, chname)
+	}
+	if out.Has(OutputSvg) {
+		files = append(files, filepath.Join(chdir, nm+".svg"), filepath.Join(chdir, nm+"-spark.svg"))
+	}
+	if out.Has(OutputPng) {
+		files = append(files, filepath.Join(chdir, nm+".png"))
+	}
+
+	for _, fn := range files {
+		if _, err := os.Stat(fn); err != nil {
+			continue
+		}
+		if !force {
+			return "", "", fmt.Errorf("%s exists; use --force to overwrite", fn)
+		}
+		if err := os.Remove(fn); err != nil {
+			return "", "", err
+		}
+	}
+	return stname, chname, nil
+}
+
+// write the summary and chart of the aggregated report 'a'
+func writeReportAgg(a *aggSet, out Outputs, stname, chname string) error {
+	fmt.Printf("%s: %d samples in %d buckets [%s] %s\n", a.name, a.n, len(a.rows),
+		strings.Join(a.names, ","), plotCounters(a.counters))
+
+	if out.Has(OutputCsv) {
+		smname := strings.TrimSuffix(stname, ".csv") + "-summary.csv"
+		if err := writeSummary(a.summary(), smname); err != nil {
+			return err
+		}
+	}
+
+	if out.Any(_ChartOutputs) {
+		c := a.columns()
+		return writeChart(&c, out, chname)
+	}
+	return nil
+}
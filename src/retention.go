@@ -0,0 +1,474 @@
+// retention.go - retention, compression and the disk cap of the outputs
+//
+// The janitor periodically sweeps the stats, charts and compare dirs
+// of every target. The age of a file is the time in its name (the start of its
+// batch, day or rollup period):
+//
+//   - batch files (and hourly rollups) are kept for Retention.Batch
+//   - daily files are kept for Retention.Daily
+//   - weekly and monthly rollups are kept for Retention.Rollup
+//
+// csv files older than Retention.CompressAfter are compressed with
+// gzip or zstd. If the outputs exceed Retention.MaxDisk, the oldest
+// files are removed first.
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	logger "github.com/opencoff/go-logger"
+)
+
+// interval between sweeps
+const _JanitorEvery = 10 * time.Minute
+
+// Retention is the policy for the output files; the zero value keeps
+// everything forever.
+type Retention struct {
+	Batch  Age
+	Daily  Age
+	Rollup Age
+
+	// "gzip" or "zstd"; and the age at which csv files are compressed
+	Compress      string
+	CompressAfter Age
+
+	// max bytes used by the outputs; 0 is unlimited
+	MaxDisk int64
+}
+
+// Age is a span of calendar months and days or a fixed duration
+type Age struct {
+	Months int
+	Days   int
+	D      time.Duration
+}
+
+func (a Age) IsZero() bool {
+	return a == Age{}
+}
+
+// Before returns the time 'a' before 't'
+func (a Age) Before(t time.Time) time.Time {
+	return t.AddDate(0, -a.Months, -a.Days).Add(-a.D)
+}
+
+// After returns the time 'a' after 't'
+func (a Age) After(t time.Time) time.Time {
+	return t.AddDate(0, a.Months, a.Days).Add(a.D)
+}
+
+func (a Age) String() string {
+	switch {
+	case a.Months > 0:
+		return fmt.Sprintf("%dmo", a.Months)
+	case a.Days > 0:
+		return fmt.Sprintf("%dd", a.Days)
+	default:
+		return a.D.String()
+	}
+}
+
+// ParseAge parses a Go duration or a number of days (7d), weeks (2w),
+// months (6mo) or years (1y).
+func ParseAge(s string) (Age, error) {
+	var a Age
+	if len(s) == 0 {
+		return a, nil
+	}
+
+	units := []struct {
+		sfx          string
+		months, days int
+	}{
+		{"mo", 1, 0},
+		{"y", 12, 0},
+		{"w", 0, 7},
+		{"d", 0, 1},
+	}
+
+	for _, u := range units {
+		v, ok := strings.CutSuffix(s, u.sfx)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return a, fmt.Errorf("invalid age '%s'", s)
+		}
+		return Age{Months: n * u.months, Days: n * u.days}, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return a, fmt.Errorf("invalid age '%s'", s)
+	}
+	return Age{D: d}, nil
+}
+
+// ParseDuration parses a Go duration or a number of days (14d) or
+// weeks (2w); months and years have no fixed length.
+func ParseDuration(s string) (time.Duration, error) {
+	a, err := ParseAge(s)
+	if err != nil || a.Months > 0 {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	return a.D + time.Duration(a.Days)*24*time.Hour, nil
+}
+
+// ParseSize parses a size in bytes with an optional K, M, G or T
+// suffix (powers of 1024).
+func ParseSize(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+
+	v := strings.TrimSuffix(strings.ToUpper(s), "B")
+	v = strings.TrimSuffix(v, "I")
+
+	mult := int64(1)
+	if i := strings.IndexAny(v, "KMGT"); i >= 0 && i == len(v)-1 {
+		mult = 1 << (10 * (1 + strings.IndexByte("KMGT", v[i])))
+		v = v[:i]
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", s)
+	}
+	return n * mult, nil
+}
+
+// return the compressed file suffix for 'alg'
+func compressSuffix(alg string) (string, error) {
+	switch alg {
+	case "":
+		return "", nil
+	case "gzip":
+		return ".gz", nil
+	case "zstd":
+		return ".zst", nil
+	default:
+		return "", fmt.Errorf("unknown compression '%s'", alg)
+	}
+}
+
+// the kinds of output files
+const (
+	fileBatch = iota
+	fileDaily
+	fileRollup
+)
+
+var (
+	rollHourRe  = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}T\d{2})\.hour[-.]`)
+	rollWeekRe  = regexp.MustCompile(`^(\d{4})-W(\d{2})\.week[-.]`)
+	rollMonthRe = regexp.MustCompile(`^(\d{4}-\d{2})\.month[-.]`)
+	batchNameRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}-\d{2}\.\d{2}\.\d{2})[-.]`)
+	dailyNameRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})(\.\d+)?[-.]`)
+)
+
+// return the kind and time of the output file 'nm'
+func classify(nm string) (int, time.Time, bool) {
+	if m := batchNameRe.FindStringSubmatch(nm); m != nil {
+		t, err := time.Parse(_BatchFmt, m[1])
+		return fileBatch, t, err == nil
+	}
+
+	if m := rollHourRe.FindStringSubmatch(nm); m != nil {
+		t, err := time.Parse("2006-01-02T15", m[1])
+		return fileBatch, t, err == nil
+	}
+
+	if m := rollWeekRe.FindStringSubmatch(nm); m != nil {
+		y, _ := strconv.Atoi(m[1])
+		w, _ := strconv.Atoi(m[2])
+
+		// monday of ISO week 1 is in the week of Jan 4
+		jan4 := time.Date(y, 1, 4, 0, 0, 0, 0, time.UTC)
+		k := rollupKind{name: "week"}
+		return fileRollup, k.start(jan4).AddDate(0, 0, 7*(w-1)), true
+	}
+
+	if m := rollMonthRe.FindStringSubmatch(nm); m != nil {
+		t, err := time.Parse("2006-01", m[1])
+		return fileRollup, t, err == nil
+	}
+
+	if m := dailyNameRe.FindStringSubmatch(nm); m != nil {
+		t, err := time.Parse("2006-01-02", m[1])
+		return fileDaily, t, err == nil
+	}
+	return 0, time.Time{}, false
+}
+
+type janitor struct {
+	sync.Mutex
+	pol Retention
+
+	// the output dirs to sweep
+	roots func() []string
+	log   logger.Logger
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// start a janitor that applies 'pol' to the dirs returned by 'roots'
+func newJanitor(pol Retention, roots func() []string, log logger.Logger) *janitor {
+	j := &janitor{
+		pol:   pol,
+		roots: roots,
+		log:   log,
+		done:  make(chan struct{}),
+	}
+
+	j.wg.Add(1)
+	go j.run()
+	return j
+}
+
+// Set changes the policy
+func (j *janitor) Set(pol Retention) {
+	j.Lock()
+	j.pol = pol
+	j.Unlock()
+}
+
+func (j *janitor) Stop() {
+	close(j.done)
+	j.wg.Wait()
+}
+
+func (j *janitor) run() {
+	defer j.wg.Done()
+
+	tick := time.NewTicker(_JanitorEvery)
+	defer tick.Stop()
+
+	for {
+		j.Lock()
+		pol := j.pol
+		j.Unlock()
+
+		j.sweep(&pol, time.Now().UTC())
+
+		select {
+		case <-tick.C:
+		case <-j.done:
+			return
+		}
+	}
+}
+
+type outFile struct {
+	name string
+	kind int
+	t    time.Time
+	size int64
+}
+
+// apply 'pol' to the output files as of 'now'
+func (j *janitor) sweep(pol *Retention, now time.Time) {
+	if *pol == (Retention{}) {
+		return
+	}
+
+	var files []outFile
+	for _, root := range j.roots() {
+		files = append(files, outputFiles(root)...)
+	}
+
+	keep := [...]Age{
+		fileBatch:  pol.Batch,
+		fileDaily:  pol.Daily,
+		fileRollup: pol.Rollup,
+	}
+
+	sfx, _ := compressSuffix(pol.Compress)
+	zcut := pol.CompressAfter.Before(now)
+
+	var total int64
+	live := files[:0]
+	for _, f := range files {
+		if a := keep[f.kind]; !a.IsZero() && f.t.Before(a.Before(now)) {
+			j.remove(&f, "expired")
+			continue
+		}
+
+		if len(sfx) > 0 && strings.HasSuffix(f.name, ".csv") && f.t.Before(zcut) {
+			if sz, err := compressFile(f.name, pol.Compress, zcut); err != nil {
+				j.log.Warn("retention: %s", err)
+			} else if sz > 0 {
+				j.log.Info("retention: compressed %s (%d -> %d bytes)", f.name, f.size, sz)
+				f.name += sfx
+				f.size = sz
+			}
+		}
+
+		total += f.size
+		live = append(live, f)
+	}
+
+	if pol.MaxDisk <= 0 || total <= pol.MaxDisk {
+		return
+	}
+
+	slices.SortStableFunc(live, func(a, b outFile) int {
+		return a.t.Compare(b.t)
+	})
+
+	for i := range live {
+		if total <= pol.MaxDisk {
+			break
+		}
+
+		f := &live[i]
+		if j.remove(f, "over the disk cap") {
+			total -= f.size
+		}
+	}
+}
+
+func (j *janitor) remove(f *outFile, why string) bool {
+	if err := os.Remove(f.name); err != nil {
+		j.log.Warn("retention: %s", err)
+		return false
+	}
+	j.log.Info("retention: removed %s (%s)", f.name, why)
+	return true
+}
+
+// return the output files under 'root'
+func outputFiles(root string) []outFile {
+	var files []outFile
+	for _, sub := range []string{"stats", "charts", "compare"} {
+		dirs, _ := os.ReadDir(filepath.Join(root, sub))
+		for _, d := range dirs {
+			if !d.IsDir() {
+				continue
+			}
+
+			dir := filepath.Join(root, sub, d.Name())
+			de, _ := os.ReadDir(dir)
+			for _, e := range de {
+				kind, t, ok := classify(e.Name())
+				if !ok || !e.Type().IsRegular() {
+					continue
+				}
+
+				fi, err := e.Info()
+				if err != nil {
+					continue
+				}
+				files = append(files, outFile{filepath.Join(dir, e.Name()), kind, t, fi.Size()})
+			}
+		}
+	}
+	return files
+}
+
+// compress 'fn' with 'alg' and remove it. Files modified after 'cut'
+// may still be appended to and are left alone. Returns the size of
+// the compressed file (0 if skipped).
+func compressFile(fn, alg string, cut time.Time) (int64, error) {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return 0, err
+	}
+	if fi.ModTime().After(cut) {
+		return 0, nil
+	}
+
+	sfx, err := compressSuffix(alg)
+	if err != nil {
+		return 0, err
+	}
+
+	src, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst := fn + sfx
+	fd, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, fi.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+
+	var w io.WriteCloser
+	switch alg {
+	case "gzip":
+		w = gzip.NewWriter(fd)
+	default:
+		w, err = zstd.NewWriter(fd)
+	}
+
+	if err == nil {
+		_, err = io.Copy(w, src)
+		err = errors.Join(err, w.Close())
+	}
+	err = errors.Join(err, fd.Sync(), fd.Close())
+	if err != nil {
+		os.Remove(dst)
+		return 0, fmt.Errorf("compress %s: %w", fn, err)
+	}
+
+	st, err := os.Stat(dst)
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), os.Remove(fn)
+}
+
+// openCsv opens a csv file that may be compressed (.gz or .zst)
+func openCsv(fn string) (io.ReadCloser, error) {
+	fd, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case strings.HasSuffix(fn, ".gz"):
+		zr, err := gzip.NewReader(fd)
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+		return &zreader{zr, fd}, nil
+
+	case strings.HasSuffix(fn, ".zst"):
+		zr, err := zstd.NewReader(fd)
+		if err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+		return &zreader{zr.IOReadCloser(), fd}, nil
+	}
+	return fd, nil
+}
+
+// a decompressor and the file under it
+type zreader struct {
+	io.ReadCloser
+	fd *os.File
+}
+
+func (z *zreader) Close() error {
+	return errors.Join(z.ReadCloser.Close(), z.fd.Close())
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp Age
+		bad bool
+	}{
+		{"", Age{}, false},
+		{"0", Age{}, false},
+		{"90m", Age{D: 90 * time.Minute}, false},
+		{"36h", Age{D: 36 * time.Hour}, false},
+		{"7d", Age{Days: 7}, false},
+		{"2w", Age{Days: 14}, false},
+		{"6mo", Age{Months: 6}, false},
+		{"1y", Age{Months: 12}, false},
+		{"0d", Age{}, false},
+		{"-1d", Age{}, true},
+		{"-1h", Age{}, true},
+		{"d", Age{}, true},
+		{"1.5d", Age{}, true},
+		{"6 mo", Age{}, true},
+		{"1x", Age{}, true},
+	}
+
+	for _, tc := range tests {
+		a, err := ParseAge(tc.s)
+		switch {
+		case tc.bad && err == nil:
+			t.Fatalf("'%s': exp an error, saw %+v", tc.s, a)
+		case !tc.bad && err != nil:
+			t.Fatalf("'%s': %s", tc.s, err)
+		case !tc.bad && a != tc.exp:
+			t.Fatalf("'%s': exp %+v, saw %+v", tc.s, tc.exp, a)
+		}
+	}
+
+	// months are calendar months
+	a, _ := ParseAge("1mo")
+	t0 := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	if b := a.Before(t0); !b.Equal(time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC)) {
+		t.Fatalf("1mo before %s: saw %s", t0, b)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s   string
+		exp int64
+		bad bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"512", 512, false},
+		{"10K", 10 << 10, false},
+		{"10k", 10 << 10, false},
+		{"10KB", 10 << 10, false},
+		{"10KiB", 10 << 10, false},
+		{"3M", 3 << 20, false},
+		{"2G", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"-1G", 0, true},
+		{"G", 0, true},
+		{"1.5G", 0, true},
+		{"1P", 0, true},
+		{"1KM", 0, true},
+	}
+
+	for _, tc := range tests {
+		n, err := ParseSize(tc.s)
+		switch {
+		case tc.bad && err == nil:
+			t.Fatalf("'%s': exp an error, saw %d", tc.s, n)
+		case !tc.bad && err != nil:
+			t.Fatalf("'%s': %s", tc.s, err)
+		case !tc.bad && n != tc.exp:
+			t.Fatalf("'%s': exp %d, saw %d", tc.s, tc.exp, n)
+		}
+	}
+}
+
+func TestClassify(t *testing.T) {
+	day := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		nm   string
+		kind int
+		t    time.Time
+		ok   bool
+	}{
+		{"2024-05-01-10.20.30.csv", fileBatch, time.Date(2024, 5, 1, 10, 20, 30, 0, time.UTC), true},
+		{"2024-05-01-10.20.30-errors.csv.gz", fileBatch, time.Date(2024, 5, 1, 10, 20, 30, 0, time.UTC), true},
+		{"2024-05-01-10.20.30.html", fileBatch, time.Date(2024, 5, 1, 10, 20, 30, 0, time.UTC), true},
+		{"2024-05-01T10.hour-hist.csv.zst", fileBatch, time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC), true},
+		{"2024-05-01.csv", fileDaily, day(2024, 5, 1), true},
+		{"2024-05-01.2-summary.csv", fileDaily, day(2024, 5, 1), true},
+		{"2024-05-01-errors.csv", fileDaily, day(2024, 5, 1), true},
+		{"2024-05.month.csv", fileRollup, day(2024, 5, 1), true},
+		{"2024-W18.week.html", fileRollup, day(2024, 4, 29), true},
+
+		// ISO weeks at the year boundaries: week 1 has Jan 4 and
+		// starts on a monday
+		{"2020-W53.week.csv", fileRollup, day(2020, 12, 28), true},
+		{"2021-W01.week.csv", fileRollup, day(2021, 1, 4), true},
+		{"2025-W01.week.csv", fileRollup, day(2024, 12, 30), true},
+		{"2026-W01.week.csv", fileRollup, day(2025, 12, 29), true},
+		{"2026-W53.week.csv", fileRollup, day(2026, 12, 28), true},
+		{"2027-W01.week.csv", fileRollup, day(2027, 1, 4), true},
+
+		{"index.html", 0, time.Time{}, false},
+		{"report-x.csv", 0, time.Time{}, false},
+		{"2024-13-01.csv", fileDaily, time.Time{}, false},
+	}
+
+	for _, tc := range tests {
+		kind, x, ok := classify(tc.nm)
+		switch {
+		case ok != tc.ok:
+			t.Fatalf("%s: exp ok=%v, saw %v", tc.nm, tc.ok, ok)
+		case ok && (kind != tc.kind || !x.Equal(tc.t)):
+			t.Fatalf("%s: exp kind %d at %s, saw %d at %s", tc.nm, tc.kind, tc.t, kind, x)
+		}
+	}
+
+	// the week of a rollup file round trips; across the year boundary
+	k := rollupKind{name: "week"}
+	for t0 := day(2020, 12, 20); t0.Before(day(2027, 1, 20)); t0 = t0.AddDate(0, 0, 1) {
+		w := k.start(t0)
+		if _, x, ok := classify(k.fname(w) + ".csv"); !ok || !x.Equal(w) {
+			t.Fatalf("%s: week %s starts %s, saw %s", t0, k.fname(w), w, x)
+		}
+		if t0.Month() == time.February {
+			t0 = day(t0.Year(), time.December, 20)
+		}
+	}
+}
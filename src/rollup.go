@@ -0,0 +1,321 @@
+// rollup.go - hourly, weekly and monthly rollups of the stored data
+//
+// A rollup merges the stored samples (or histograms) and errors of a
+// target over a period into per-bucket histograms: minutes for an
+// hour and hours for a week or a month. Each rollup writes (in UTC):
+//
+//	stats/<target>/PERIOD-summary.csv  percentiles and availability per phase
+//	stats/<target>/PERIOD-worst.csv    the worst buckets of the period
+//	charts/<target>/PERIOD.html        p50, p99 and max of each bucket
+//
+// where PERIOD is 2006-01-02T15.hour, 2006-W01.week or 2006-01.month.
+// A rollup is made when the batch that ends the period is flushed.
+
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	"github.com/opencoff/latmon/internal/hdr"
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+// number of worst buckets in a rollup
+const _WorstN = 10
+
+type rollupKind struct {
+	name string
+
+	// width of each bucket in the period
+	bucket time.Duration
+}
+
+var rollupKinds = []rollupKind{
+	{"hour", time.Minute},
+	{"week", time.Hour},
+	{"month", time.Hour},
+}
+
+// start of the period of 'kind' that has 't'
+func (k *rollupKind) start(t time.Time) time.Time {
+	t = t.UTC()
+	switch k.name {
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "week":
+		// ISO weeks start on monday
+		d := (int(t.Weekday()) + 6) % 7
+		y, m, dd := t.AddDate(0, 0, -d).Date()
+		return time.Date(y, m, dd, 0, 0, 0, 0, time.UTC)
+	default:
+		y, m, _ := t.Date()
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// end of the period of 'kind' that starts at 't'
+func (k *rollupKind) end(t time.Time) time.Time {
+	switch k.name {
+	case "hour":
+		return t.Add(time.Hour)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+// file name for the period of 'kind' that starts at 't'
+func (k *rollupKind) fname(t time.Time) string {
+	switch k.name {
+	case "hour":
+		return t.Format("2006-01-02T15") + ".hour"
+	case "week":
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d.week", y, w)
+	default:
+		return t.Format("2006-01") + ".month"
+	}
+}
+
+// a bucket of a rollup
+type rollBucket struct {
+	t     time.Time
+	errs  int
+	names []string
+	hists []*hdr.Histogram
+}
+
+func (b *rollBucket) hist(nm string) *hdr.Histogram {
+	i := slices.Index(b.names, nm)
+	if i < 0 {
+		b.names = append(b.names, nm)
+		b.hists = append(b.hists, hdr.New())
+		i = len(b.names) - 1
+	}
+	return b.hists[i]
+}
+
+// number of samples in the bucket; a sample needn't have every phase
+func (b *rollBucket) samples() int {
+	var n uint64
+	for _, h := range b.hists {
+		n = max(n, h.Count())
+	}
+	return int(n)
+}
+
+func (b *rollBucket) availability() float64 {
+	n := b.samples()
+	if n+b.errs == 0 {
+		return 1
+	}
+	return float64(n) / float64(n+b.errs)
+}
+
+type rollup struct {
+	kind       *rollupKind
+	start, end time.Time
+
+	buckets []rollBucket
+
+	// merged histograms and the per bucket percentiles
+	set *aggSet
+}
+
+// make the rollup of 'kind' for target 'name' over the period that
+// starts at 'start' from the data in 'dir'. Batches without a time
+// column are timed by 'ii'.
+func makeRollup(dir, name string, kind *rollupKind, start time.Time, ii time.Duration) (*rollup, error) {
+	end := kind.end(start)
+	r := &rollup{
+		kind:    kind,
+		start:   start,
+		end:     end,
+		buckets: make([]rollBucket, int(end.Sub(start)/kind.bucket)),
+		set:     newAggSet(name, start),
+	}
+
+	for i := range r.buckets {
+		r.buckets[i].t = start.Add(time.Duration(i) * kind.bucket)
+	}
+
+	bucket := func(t time.Time) *rollBucket {
+		i := int(t.Sub(start) / kind.bucket)
+		return &r.buckets[min(i, len(r.buckets)-1)]
+	}
+
+	err := scanSamples(dir, name, start, end, ii, func(s *Sample) {
+		b := bucket(s.Time)
+		for j, c := range s.Names {
+			b.hist(c).Record(s.Vals[j])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanHists(dir, start, end, func(t time.Time, phase string, h *hdr.Histogram) {
+		bucket(t).hist(phase).Merge(h)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	errs, err := readErrors(dir, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range errs {
+		bucket(t).errs++
+	}
+
+	r.set.counters = []plot.Counter{{Name: "errors", Val: uint64(len(errs))}}
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if n := b.samples(); n > 0 {
+			r.set.record(b.t, n, b.names, b.hists)
+		}
+	}
+	return r, nil
+}
+
+// return true if the rollup has no data
+func (r *rollup) empty() bool {
+	return r.set.n == 0 && r.set.counters[0].Val == 0
+}
+
+// the phase that ranks the buckets: the one with the largest median
+// (usually the end-to-end latency).
+func (r *rollup) headline() string {
+	var nm string
+	var p50 time.Duration = -1
+	for i, h := range r.set.hists {
+		if x := h.Quantile(0.5); x > p50 {
+			nm, p50 = r.set.names[i], x
+		}
+	}
+	return nm
+}
+
+// return the worst buckets: the least available and then the ones
+// with the highest p99 of the headline phase.
+func (r *rollup) worst(n int) []*rollBucket {
+	ph := r.headline()
+	p99 := func(b *rollBucket) time.Duration {
+		if i := slices.Index(b.names, ph); i >= 0 {
+			return b.hists[i].Quantile(0.99)
+		}
+		return 0
+	}
+
+	var v []*rollBucket
+	for i := range r.buckets {
+		b := &r.buckets[i]
+		if b.samples()+b.errs > 0 {
+			v = append(v, b)
+		}
+	}
+
+	slices.SortStableFunc(v, func(a, b *rollBucket) int {
+		if c := cmp.Compare(a.availability(), b.availability()); c != 0 {
+			return c
+		}
+		return cmp.Compare(p99(b), p99(a))
+	})
+	return v[:min(n, len(v))]
+}
+
+// write the rollup 'r' to 'stdir' and 'chdir'
+func writeRollup(r *rollup, stdir, chdir string, out Outputs, labels map[string]string) error {
+	fname := r.kind.fname(r.start)
+
+	if out.Has(OutputCsv) {
+		if err := writeRollupSummary(r, path.Join(stdir, fname+"-summary.csv")); err != nil {
+			return err
+		}
+		if err := writeWorst(r, path.Join(stdir, fname+"-worst.csv")); err != nil {
+			return err
+		}
+	}
+
+	if out.Any(_ChartOutputs) && len(r.set.rows) > 0 {
+		c := r.set.columns()
+		c.Labels = labels
+		return writeChart(&c, out, path.Join(chdir, fname+".html"))
+	}
+	return nil
+}
+
+// like the batch summary with the availability of the period
+func writeRollupSummary(r *rollup, fn string) error {
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", fn, err)
+	}
+	defer fd.Close()
+
+	errs := r.set.counters[0].Val
+	avail := 1.0
+	if tot := uint64(r.set.n) + errs; tot > 0 {
+		avail = float64(r.set.n) / float64(tot)
+	}
+
+	fmt.Fprintf(fd, "phase,count,failures,availability,min,mean,stddev,p50,p90,p95,p99,p99.9,max\n")
+	for _, s := range r.set.summary() {
+		fmt.Fprintf(fd, "%s,%d,%d,%.6f,%d,%d,%d,%d,%d,%d,%d,%d,%d\n", s.Name, s.N, s.Failures, avail,
+			s.Min, s.Mean, s.Stddev, s.P50, s.P90, s.P95, s.P99, s.P999, s.Max)
+	}
+	return nil
+}
+
+func writeWorst(r *rollup, fn string) error {
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", fn, err)
+	}
+	defer fd.Close()
+
+	ph := r.headline()
+	fmt.Fprintf(fd, "rank,start,end,phase,count,failures,availability,p50,p99,max\n")
+	for i, b := range r.worst(_WorstN) {
+		var p50, p99, pmax time.Duration
+		if j := slices.Index(b.names, ph); j >= 0 {
+			h := b.hists[j]
+			p50, p99, pmax = h.Quantile(0.5), h.Quantile(0.99), h.Max()
+		}
+
+		fmt.Fprintf(fd, "%d,%s,%s,%s,%d,%d,%.6f,%d,%d,%d\n", i+1, b.t.Format(time.RFC3339),
+			b.t.Add(r.kind.bucket).Format(time.RFC3339), ph, b.samples(), b.errs,
+			b.availability(), p50, p99, pmax)
+	}
+	return nil
+}
+
+// make the rollups of the periods of 'hs' that ended in (from, to].
+// All the samples of these periods are on disk by now.
+func (m *Measurer) rollups(hs *hostStats, from, to time.Time) {
+	for i := range rollupKinds {
+		k := &rollupKinds[i]
+		for st := k.start(from); !k.end(st).After(to); st = k.end(st) {
+			r, err := makeRollup(hs.statsDir, hs.name, k, st, hs.interval)
+			if err != nil {
+				m.log.Warn("%s: %s rollup: %s", hs.name, k.name, err)
+				continue
+			}
+			if r.empty() {
+				continue
+			}
+
+			m.log.Info("rollup: %s: [%s] %d samples", hs.name, k.fname(st), r.set.n)
+			if err := writeRollup(r, hs.statsDir, hs.chartDir, hs.outputs, hs.labels); err != nil {
+				m.log.Warn("%s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// schedule.go - when the probes of a target are sent
+//
+// The probes of a target are 'interval' apart; the first one is sent
+// at a random offset in [0, interval) after the target starts, so that
+// targets with the same interval don't all fire at once. 'jitter'
+// moves each probe by up to +/- jitter (uniformly) around its slot
+// without drifting from it.
+//
+// In poisson mode, the gaps between the probes are exponentially
+// distributed with a mean of 'interval'. The probes then see the time
+// average of the target (Poisson arrivals see time averages) instead
+// of aliasing with something periodic on the path.
+//
+// Up to 'concurrency' probes (1 by default) run at once. A probe that
+// is due while that many are running is sent as soon as one of them is
+// done; the ones due after it are skipped (as with time.Ticker). Each
+// result has the time its probe was sent, how late it was (the lag)
+// and the probes skipped before it; the samples are timed by the
+// former, the lag is in the "lag" column and the skipped probes are
+// counted.
+
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+type ScheduleOpts struct {
+	// "fixed" or "poisson"
+	Mode string
+
+	// fixed: max move of each probe from its slot
+	Jitter time.Duration
+
+	// offset of the first probe; random if negative
+	Offset time.Duration
+
+	// max probes in flight
+	Concurrency int
+}
+
+// Tick is a probe that was sent
+type Tick struct {
+	// when it was sent and how long after it was due
+	At  time.Time
+	Lag time.Duration
+
+	// probes skipped since the previous one
+	Skipped int
+}
+
+// Validate checks the schedule against the interval 'ii'
+func (o *ScheduleOpts) Validate(ii time.Duration) error {
+	if o.Concurrency < 1 {
+		return fmt.Errorf("concurrency must be at least 1")
+	}
+
+	switch o.Mode {
+	case "fixed":
+		if o.Jitter < 0 || o.Jitter >= ii/2 {
+			return fmt.Errorf("jitter must be less than half the interval (%s)", ii)
+		}
+	case "poisson":
+		if o.Jitter != 0 {
+			return fmt.Errorf("poisson schedule has no jitter")
+		}
+	default:
+		return fmt.Errorf("unknown schedule '%s'", o.Mode)
+	}
+	return nil
+}
+
+// parse the offset of the first probe: "random" or a duration
+func parseOffset(s string) (time.Duration, error) {
+	if s == "random" {
+		return -1, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid offset '%s'", s)
+	}
+	return d, nil
+}
+
+// schedule sends on C when a probe is due
+type schedule struct {
+	ScheduleOpts
+	ii time.Duration
+
+	// the slot of the next probe and the time it is due (the slot
+	// moved by the jitter)
+	slot time.Time
+	due  time.Time
+
+	timer *time.Timer
+	C     <-chan time.Time
+}
+
+func newSchedule(ii time.Duration, o ScheduleOpts) *schedule {
+	off := o.Offset
+	if off < 0 {
+		off = rand.N(ii)
+	}
+
+	s := &schedule{
+		ScheduleOpts: o,
+		ii:           ii,
+		slot:         time.Now().Add(off),
+	}
+	s.due = s.jitter(s.slot)
+	s.timer = time.NewTimer(time.Until(s.due))
+	s.C = s.timer.C
+	return s
+}
+
+// next is called when a probe is due (ie after a receive on C) and
+// about to be sent; it arms the schedule for the next probe that
+// isn't past and returns the due one. The probes past by now are
+// skipped.
+func (s *schedule) next() Tick {
+	now := time.Now()
+	t := Tick{
+		At:  now,
+		Lag: max(now.Sub(s.due), 0),
+	}
+
+	for {
+		s.slot = s.step(s.slot)
+		if s.due = s.jitter(s.slot); s.due.After(now) {
+			break
+		}
+		t.Skipped++
+	}
+
+	s.timer.Reset(s.due.Sub(now))
+	return t
+}
+
+// run calls 'probe' for each probe as it is due, in a goroutine of its
+// own with up to 'n' running at once, till 'done' is closed. It returns
+// when the running probes are done.
+func (s *schedule) run(done <-chan struct{}, n int, probe func(t Tick)) {
+	var wg sync.WaitGroup
+
+	sem := make(chan struct{}, max(n, 1))
+	defer wg.Wait()
+	for {
+		select {
+		case <-s.C:
+		case <-done:
+			return
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-done:
+			return
+		}
+
+		t := s.next()
+		wg.Add(1)
+		go func() {
+			probe(t)
+			<-sem
+			wg.Done()
+		}()
+	}
+}
+
+// return the slot after 't'
+func (s *schedule) step(t time.Time) time.Time {
+	if s.Mode == "poisson" {
+		return t.Add(time.Duration(rand.ExpFloat64() * float64(s.ii)))
+	}
+	return t.Add(s.ii)
+}
+
+// return the slot 't' moved by the jitter
+func (s *schedule) jitter(t time.Time) time.Time {
+	if s.Jitter <= 0 {
+		return t
+	}
+	return t.Add(rand.N(2*s.Jitter+1) - s.Jitter)
+}
+
+func (s *schedule) Stop() {
+	s.timer.Stop()
+}
@@ -0,0 +1,437 @@
+// slo.go - service level objectives and their error budgets
+//
+// An SLO of a target is the fraction of its probes that must be good
+// over a rolling window; eg 99.9% of the probes under 500ms over 28
+// days. A probe is good if it didn't fail and (for a latency SLO) its
+// phase (e2e by default) took at most 'latency'. The error budget is
+// the fraction of bad probes the objective allows. The burn rate over
+// a window is the fraction of bad probes in it over the budget: at 1
+// the budget runs out at the end of the window of the SLO; at 14.4
+// over the last hour, a 30 day budget is gone in ~2 days.
+//
+// Each target counts its good and bad probes in slots of _SLOSlot
+// that span the window of each SLO. When a target starts, the counts
+// are filled in from its stored batches and errors (in the
+// background); so they survive restarts for as long as the batches
+// are kept (see retention.go). Aggregated targets don't store their
+// raw samples: their counts come from the histograms of each bucket,
+// to within the resolution of the histograms.
+//
+// The state of the SLOs is in the daily charts and <day>-slo.csv, the
+// query API and /metrics. 'latmon report -c FILE' works it out from
+// the stored samples of the report.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/opencoff/latmon/internal/hdr"
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+const (
+	// width of the slots the probes are counted in; the shortest
+	// burn rate window
+	_SLOSlot = 5 * time.Minute
+
+	// default window of an SLO
+	_SLOWindow = 28 * 24 * time.Hour
+)
+
+// windows of the burn rates; those longer than the window of an SLO
+// are left out
+var sloBurnWindows = []time.Duration{
+	5 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	72 * time.Hour,
+}
+
+// SLO is a service level objective of a target (see slo.go)
+type SLO struct {
+	Name string
+
+	// the fraction of good probes
+	Objective float64
+
+	// a good probe is at most this slow in 'phase'; zero if any
+	// probe that didn't fail is good
+	Latency time.Duration
+	Phase   string
+
+	Window time.Duration
+}
+
+// Validate checks the SLO and fills in the defaults
+func (s *SLO) Validate() error {
+	if len(s.Name) == 0 {
+		return fmt.Errorf("missing slo name")
+	}
+	if s.Objective <= 0 || s.Objective >= 1 {
+		return fmt.Errorf("slo %s: objective must be between 0 and 100%%", s.Name)
+	}
+	if s.Latency < 0 {
+		return fmt.Errorf("slo %s: negative latency", s.Name)
+	}
+
+	if len(s.Phase) == 0 {
+		s.Phase = "e2e"
+	}
+	if s.Phase != "e2e" && !isPhase(s.Phase) {
+		return fmt.Errorf("slo %s: unknown phase '%s'", s.Name, s.Phase)
+	}
+	if s.Latency == 0 && s.Phase != "e2e" {
+		return fmt.Errorf("slo %s: phase without a latency", s.Name)
+	}
+
+	if s.Window == 0 {
+		s.Window = _SLOWindow
+	}
+	if s.Window < time.Hour || s.Window%_SLOSlot != 0 {
+		return fmt.Errorf("slo %s: window must be a multiple of %s and at least 1h", s.Name, _SLOSlot)
+	}
+	return nil
+}
+
+// Indicator returns what a good probe is
+func (s *SLO) Indicator() string {
+	if s.Latency == 0 {
+		return "available"
+	}
+	return fmt.Sprintf("%s <= %s", s.Phase, s.Latency)
+}
+
+// return true if 's' is a good probe; false if it isn't counted (eg
+// it doesn't have the phase)
+func (s *SLO) good(x *Sample) (good bool, ok bool) {
+	if s.Latency == 0 {
+		return true, true
+	}
+
+	v, ok := x.value(s.Phase)
+	if !ok {
+		return false, false
+	}
+	return v <= s.Latency, true
+}
+
+// the probes in a slot; 'at' is its number since the epoch
+type sloSlot struct {
+	at        int64
+	good, bad uint32
+}
+
+// the slots of a window; slot 'n' is at n % len
+type sloRing []sloSlot
+
+func newSloRing(w time.Duration) sloRing {
+	return make(sloRing, w/_SLOSlot)
+}
+
+func slotOf(t time.Time) int64 {
+	return t.UnixNano() / int64(_SLOSlot)
+}
+
+// count the probes at 't'; a probe older than the slot that is there
+// has fallen out of the window
+func (r sloRing) add(t time.Time, good, bad uint32) {
+	n := slotOf(t)
+	x := &r[n%int64(len(r))]
+	switch {
+	case x.at > n:
+		return
+	case x.at < n:
+		*x = sloSlot{at: n}
+	}
+	x.good += good
+	x.bad += bad
+}
+
+// return the probes in the slots of the last 'd' up to 'now'
+func (r sloRing) sum(now time.Time, d time.Duration) (good, bad uint64) {
+	n := slotOf(now)
+	first := n - int64(d/_SLOSlot)
+	for i := range r {
+		if x := &r[i]; x.at > first && x.at <= n {
+			good += uint64(x.good)
+			bad += uint64(x.bad)
+		}
+	}
+	return good, bad
+}
+
+// add the probes in 'o' to 'r'
+func (r sloRing) merge(o sloRing) {
+	for i := range o {
+		if x := &o[i]; x.good+x.bad > 0 {
+			r.add(time.Unix(0, x.at*int64(_SLOSlot)), x.good, x.bad)
+		}
+	}
+}
+
+// the SLOs of a target and their probes
+type sloSet struct {
+	slos  []SLO
+	rings []sloRing
+}
+
+func newSloSet(v []SLO) *sloSet {
+	ss := &sloSet{
+		slos:  v,
+		rings: make([]sloRing, len(v)),
+	}
+	for i := range v {
+		ss.rings[i] = newSloRing(v[i].Window)
+	}
+	return ss
+}
+
+// count the probe 's'
+func (ss *sloSet) observe(s *Sample) {
+	if s.Err != nil {
+		ss.failed(s.Time)
+		return
+	}
+
+	for i := range ss.slos {
+		if good, ok := ss.slos[i].good(s); ok {
+			if good {
+				ss.rings[i].add(s.Time, 1, 0)
+			} else {
+				ss.rings[i].add(s.Time, 0, 1)
+			}
+		}
+	}
+}
+
+// count the probes in the histograms 'b' of a bucket (at 't') of an
+// aggregated target. A latency SLO counts the probes of its phase; an
+// availability SLO those of the busiest column, which has every probe
+// that didn't fail.
+func (ss *sloSet) observeHists(t time.Time, b map[string]*hdr.Histogram) {
+	var all uint64
+	for _, h := range b {
+		all = max(all, h.Count())
+	}
+
+	for i := range ss.slos {
+		s := &ss.slos[i]
+		if s.Latency == 0 {
+			ss.rings[i].add(t, uint32(all), 0)
+			continue
+		}
+
+		h := histColumn(s.Phase, b)
+		if h == nil {
+			continue
+		}
+
+		var good, bad uint64
+		h.Each(func(lo time.Duration, n uint64) {
+			if lo <= s.Latency {
+				good += n
+			} else {
+				bad += n
+			}
+		})
+		ss.rings[i].add(t, uint32(good), uint32(bad))
+	}
+}
+
+// return the histogram of 'phase' in 'b'; the e2e latency is the
+// column the workers use for it (see Sample.e2e). nil if there is no
+// such column; eg the e2e latency of tls is the sum of its phases.
+func histColumn(phase string, b map[string]*hdr.Histogram) *hdr.Histogram {
+	if phase != "e2e" {
+		return b[phase]
+	}
+
+	for _, nm := range []string{"https", "streams", "rtt"} {
+		if h, ok := b[nm]; ok {
+			return h
+		}
+	}
+	if _, ok := b["tls"]; ok {
+		return nil
+	}
+	return b["tcp"]
+}
+
+// count a failed probe at 't'
+func (ss *sloSet) failed(t time.Time) {
+	for i := range ss.rings {
+		ss.rings[i].add(t, 0, 1)
+	}
+}
+
+// add the probes in 'o' (which has the same SLOs) to 'ss'
+func (ss *sloSet) merge(o *sloSet) {
+	for i := range ss.rings {
+		ss.rings[i].merge(o.rings[i])
+	}
+}
+
+// return the longest window of the SLOs
+func (ss *sloSet) window() time.Duration {
+	var w time.Duration
+	for i := range ss.slos {
+		w = max(w, ss.slos[i].Window)
+	}
+	return w
+}
+
+// return the state of the SLOs at 'now'
+func (ss *sloSet) status(now time.Time) []plot.SLOStatus {
+	v := make([]plot.SLOStatus, len(ss.slos))
+	for i := range ss.slos {
+		s, r := &ss.slos[i], ss.rings[i]
+		budget := 1 - s.Objective
+
+		good, bad := r.sum(now, s.Window)
+		st := plot.SLOStatus{
+			Name:      s.Name,
+			Objective: s.Objective,
+			Indicator: s.Indicator(),
+			Window:    s.Window,
+			Total:     good + bad,
+			Bad:       bad,
+			Budget:    1,
+		}
+		if st.Total > 0 {
+			st.Compliance = float64(good) / float64(st.Total)
+			st.Budget = 1 - (float64(bad)/float64(st.Total))/budget
+		}
+
+		for _, w := range sloBurnWindows {
+			if w > s.Window {
+				break
+			}
+
+			g, b := r.sum(now, w)
+			x := plot.Burn{Window: w, Total: g + b}
+			if x.Total > 0 {
+				x.Rate = (float64(b) / float64(x.Total)) / budget
+			}
+			st.Burn = append(st.Burn, x)
+		}
+		v[i] = st
+	}
+	return v
+}
+
+// fill in the probes of 'hs' before 'to' from its stored batches (or
+// histograms) and errors. This reads up to a window of samples; so it
+// runs in the background and the counts are merged when it is done.
+func (m *Measurer) seedSLOs(hs *hostStats, to time.Time) {
+	ss := newSloSet(hs.slo.slos)
+	from := to.Add(-ss.window())
+
+	var err error
+	if hs.agg != nil {
+		err = scanBuckets(hs.statsDir, from, to, ss.observeHists)
+	} else {
+		err = scanSamples(hs.statsDir, hs.name, from, to, hs.interval, ss.observe)
+	}
+	if err != nil {
+		m.log.Warn("%s: slo: %s", hs.name, err)
+		return
+	}
+
+	errs, err := readErrors(hs.statsDir, from, to)
+	if err != nil {
+		m.log.Warn("%s: slo: %s", hs.name, err)
+		return
+	}
+	for _, t := range errs {
+		ss.failed(t)
+	}
+
+	hs.Lock()
+	hs.slo.merge(ss)
+	hs.Unlock()
+	m.log.Debug("%s: slo: counted the stored probes since %s", hs.name, from.Format(time.RFC3339))
+}
+
+// SLOs returns the state of the SLOs of target 'name'; nil if it has
+// none
+func (m *Measurer) SLOs(name string) ([]plot.SLOStatus, error) {
+	hs, err := m.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return hs.sloStatus(time.Now()), nil
+}
+
+func (h *hostStats) sloStatus(now time.Time) []plot.SLOStatus {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.slo == nil {
+		return nil
+	}
+	return h.slo.status(now)
+}
+
+// log the state of the SLOs of 'hs' for the daily report and write
+// it to 'fname'-slo.csv; return it for the chart.
+func (m *Measurer) reportSLOs(hs *hostStats, fname string) []plot.SLOStatus {
+	v := hs.sloStatus(time.Now())
+	if len(v) == 0 {
+		return nil
+	}
+
+	for i := range v {
+		s := &v[i]
+		if s.Met() {
+			m.log.Info("%s: slo %s: %.3f%% of %d probes (objective %.3f%%); %.1f%% of the error budget left",
+				hs.name, s.Name, 100*s.Compliance, s.Total, 100*s.Objective, 100*s.Budget)
+		} else {
+			m.log.Warn("%s: slo %s not met: %.3f%% of %d probes (objective %.3f%%); %.1f%% of the error budget spent",
+				hs.name, s.Name, 100*s.Compliance, s.Total, 100*s.Objective, 100*(1-s.Budget))
+		}
+	}
+
+	if hs.outputs.Has(OutputCsv) {
+		fn := path.Join(hs.statsDir, fname+"-slo.csv")
+		if err := writeSLOCsv(v, fn); err != nil {
+			m.log.Warn("%s", err)
+		}
+	}
+	return v
+}
+
+// write the state of the SLOs in 'v' to 'fn'; a column for the burn
+// rate over each window (empty if it is longer than the SLO's).
+func writeSLOCsv(v []plot.SLOStatus, fn string) error {
+	fd, err := os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("create %s: %s", fn, err)
+	}
+	defer fd.Close()
+
+	fmt.Fprintf(fd, "slo,indicator,objective,window,probes,bad,compliance,budget")
+	for _, w := range sloBurnWindows {
+		fmt.Fprintf(fd, ",burn-%s", plot.Window(w))
+	}
+	fmt.Fprintf(fd, "\n")
+
+	for i := range v {
+		s := &v[i]
+		fmt.Fprintf(fd, "%s,%s,%g,%s,%d,%d,%.6f,%.6f", s.Name, s.Indicator, s.Objective,
+			plot.Window(s.Window), s.Total, s.Bad, s.Compliance, s.Budget)
+		for j := range sloBurnWindows {
+			if j < len(s.Burn) {
+				fmt.Fprintf(fd, ",%.4f", s.Burn[j].Rate)
+			} else {
+				fmt.Fprintf(fd, ",")
+			}
+		}
+		fmt.Fprintf(fd, "\n")
+	}
+	return nil
+}
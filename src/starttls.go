@@ -0,0 +1,118 @@
+// starttls.go - protocol specific upgrades to TLS
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/opencoff/latmon/internal/http"
+)
+
+// return the STARTTLS negotiator for 'proto'; an empty proto
+// means the service speaks TLS right away.
+func starttls(proto string) (http.Upgrader, error) {
+	switch strings.ToLower(proto) {
+	case "":
+		return nil, nil
+	case "smtp":
+		return smtpStartTls, nil
+	case "imap":
+		return imapStartTls, nil
+	case "postgres":
+		return pgStartTls, nil
+	default:
+		return nil, fmt.Errorf("unknown starttls proto '%s'", proto)
+	}
+}
+
+// RFC 3207
+func smtpStartTls(conn net.Conn) error {
+	tr := textproto.NewReader(bufio.NewReader(conn))
+
+	// server greeting
+	if _, _, err := tr.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp: greeting: %w", err)
+	}
+
+	ehlo, err := os.Hostname()
+	if err != nil {
+		ehlo = "localhost"
+	}
+
+	if _, err := fmt.Fprintf(conn, "EHLO %s\r\n", ehlo); err != nil {
+		return fmt.Errorf("smtp: ehlo: %w", err)
+	}
+
+	if _, _, err := tr.ReadResponse(250); err != nil {
+		return fmt.Errorf("smtp: ehlo: %w", err)
+	}
+
+	if _, err := fmt.Fprintf(conn, "STARTTLS\r\n"); err != nil {
+		return fmt.Errorf("smtp: starttls: %w", err)
+	}
+
+	if _, _, err := tr.ReadResponse(220); err != nil {
+		return fmt.Errorf("smtp: starttls: %w", err)
+	}
+	return nil
+}
+
+// RFC 3501 (Sec 6.2.1)
+func imapStartTls(conn net.Conn) error {
+	tr := textproto.NewReader(bufio.NewReader(conn))
+
+	line, err := tr.ReadLine()
+	if err != nil {
+		return fmt.Errorf("imap: greeting: %w", err)
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("imap: unexpected greeting: %s", line)
+	}
+
+	const tag = "a1"
+	if _, err = fmt.Fprintf(conn, "%s STARTTLS\r\n", tag); err != nil {
+		return fmt.Errorf("imap: starttls: %w", err)
+	}
+
+	// skip untagged responses till we see our tag
+	for {
+		line, err = tr.ReadLine()
+		if err != nil {
+			return fmt.Errorf("imap: starttls: %w", err)
+		}
+
+		if !strings.HasPrefix(line, tag+" ") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, tag+" OK") {
+			return fmt.Errorf("imap: starttls refused: %s", line)
+		}
+		return nil
+	}
+}
+
+// postgres SSLRequest message: length (8) and the magic 80877103
+var pgSslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+func pgStartTls(conn net.Conn) error {
+	if _, err := conn.Write(pgSslRequest); err != nil {
+		return fmt.Errorf("postgres: ssl request: %w", err)
+	}
+
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return fmt.Errorf("postgres: ssl request: %w", err)
+	}
+
+	if b[0] != 'S' {
+		return fmt.Errorf("postgres: server refused ssl (%q)", b[0])
+	}
+	return nil
+}
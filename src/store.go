@@ -0,0 +1,543 @@
+// store.go - read the measurements written by the Measurer
+//
+// Each batch is a csv file named after the start of the batch (UTC)
+// under stats/<target>/. The first column is the time of the sample;
+// batches written before that column existed are timed by the
+// interval. Failed probes are in <batch>-errors.csv and the
+// histograms of aggregated targets in <batch>-hist.csv. Any of these
+// may be compressed (see retention.go).
+//
+// The daily files (<day>.csv, <day>-errors.csv and <day>-hist.csv)
+// repeat the batches of each day; a day starts with its first batch
+// and its histograms are merged into one row per phase. The janitor
+// removes the oldest batches first: the readers take what is before
+// the first batch that's left from the daily files.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/opencoff/latmon/internal/hdr"
+)
+
+const _BatchFmt = "2006-01-02-15.04.05"
+
+// batch files; the daily files (YYYY-MM-DD.csv) repeat the batches
+var batchRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2}-\d{2}\.\d{2}\.\d{2})(-errors|-hist)?\.csv(\.gz|\.zst)?$`)
+
+// kinds of batch files
+const (
+	batchSamples = ""
+	batchErrors  = "-errors"
+	batchHist    = "-hist"
+)
+
+// after any time in a file
+var endOfTime = time.Unix(1<<62, 0)
+
+type batchFile struct {
+	name  string
+	start time.Time
+}
+
+// daily files; a restart or a reload starts a new one (<day>.N)
+var dailyRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})(?:\.(\d+))?(-errors|-hist)?\.csv(\.gz|\.zst)?$`)
+
+// return the batch files of 'kind' in 'dir' that may have samples in
+// [from, to); sorted by time.
+func batchFiles(dir string, kind string, from, to time.Time) ([]batchFile, error) {
+	v, err := listBatches(dir, kind)
+	if err != nil {
+		return nil, err
+	}
+	return inRange(v, from, to, 0), nil
+}
+
+// return the batch files of 'kind' in 'dir'; sorted by time
+func listBatches(dir string, kind string) ([]batchFile, error) {
+	de, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var v []batchFile
+	for _, e := range de {
+		m := batchRe.FindStringSubmatch(e.Name())
+		if m == nil || m[2] != kind {
+			continue
+		}
+
+		t, err := time.Parse(_BatchFmt, m[1])
+		if err != nil {
+			continue
+		}
+		v = append(v, batchFile{filepath.Join(dir, e.Name()), t})
+	}
+
+	slices.SortFunc(v, func(a, b batchFile) int {
+		return a.start.Compare(b.start)
+	})
+	return v, nil
+}
+
+// return the daily files of 'kind' in 'dir'; sorted by time. They
+// are named after the day they start in.
+func listDaily(dir string, kind string) ([]batchFile, error) {
+	de, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type daily struct {
+		batchFile
+		seq int
+	}
+
+	var v []daily
+	for _, e := range de {
+		m := dailyRe.FindStringSubmatch(e.Name())
+		if m == nil || m[3] != kind {
+			continue
+		}
+
+		t, err := time.Parse("2006-01-02", m[1])
+		if err != nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[2])
+		v = append(v, daily{batchFile{filepath.Join(dir, e.Name()), t}, n})
+	}
+
+	slices.SortFunc(v, func(a, b daily) int {
+		if c := a.start.Compare(b.start); c != 0 {
+			return c
+		}
+		return a.seq - b.seq
+	})
+
+	r := make([]batchFile, len(v))
+	for i := range v {
+		r[i] = v[i].batchFile
+	}
+	return r, nil
+}
+
+// return the files in 'v' (sorted by time) that may have rows in
+// [from, to). A file ends where the next one starts; give or take
+// 'slack' if they are named after the day they start in.
+func inRange(v []batchFile, from, to time.Time, slack time.Duration) []batchFile {
+	var r []batchFile
+	for i, b := range v {
+		if !b.start.Before(to) {
+			break
+		}
+		if i+1 < len(v) && !v[i+1].start.Add(slack).After(from) {
+			continue
+		}
+		r = append(r, b)
+	}
+	return r
+}
+
+// scanStored calls 'fp' for each file of 'kind' in 'dir' that may have
+// rows in [from, to) with the part of [from, to) to read from it: the
+// daily files before the first batch and the batches after it.
+func scanStored(dir, kind string, from, to time.Time, fp func(b batchFile, from, to time.Time) error) error {
+	batches, err := listBatches(dir, kind)
+	if err != nil {
+		return err
+	}
+
+	cut := to
+	if len(batches) > 0 && batches[0].start.Before(to) {
+		cut = batches[0].start
+	}
+
+	if from.Before(cut) {
+		days, err := listDaily(dir, kind)
+		if err != nil {
+			return err
+		}
+		for _, b := range inRange(days, from, cut, 24*time.Hour) {
+			if err = fp(b, from, cut); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cut.Before(from) {
+		cut = from
+	}
+	for _, b := range inRange(batches, cut, to, 0) {
+		if err = fp(b, cut, to); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSamples returns the samples of target 'name' in [from, to)
+// from the batches (or daily files) in 'dir'. Batches without a time
+// column are timed by 'ii'.
+func readSamples(dir, name string, from, to time.Time, ii time.Duration) ([]Sample, error) {
+	var v []Sample
+	err := scanSamples(dir, name, from, to, ii, func(s *Sample) {
+		v = append(v, *s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// scanSamples calls 'fp' for each sample of target 'name' in
+// [from, to); in time order.
+func scanSamples(dir, name string, from, to time.Time, ii time.Duration, fp func(s *Sample)) error {
+	return scanStored(dir, batchSamples, from, to, func(b batchFile, from, to time.Time) error {
+		return readBatch(b, name, from, to, ii, fp)
+	})
+}
+
+// call 'fp' for the samples in [from, to) of batch 'b'
+func readBatch(b batchFile, name string, from, to time.Time, ii time.Duration, fp func(s *Sample)) error {
+	fd, err := openCsv(b.name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	if !sc.Scan() {
+		return sc.Err()
+	}
+
+	names := strings.Split(sc.Text(), ",")
+	timed := len(names) > 0 && names[0] == "time"
+	if timed {
+		names = names[1:]
+	}
+
+	for row := 0; sc.Scan(); row++ {
+		f := strings.Split(sc.Text(), ",")
+		t := b.start.Add(time.Duration(row) * ii)
+		if timed {
+			t, err = time.Parse(time.RFC3339Nano, f[0])
+			if err != nil {
+				return fmt.Errorf("%s: row %d: %w", b.name, row+2, err)
+			}
+			f = f[1:]
+		}
+		if len(f) != len(names) {
+			return fmt.Errorf("%s: row %d: malformed", b.name, row+2)
+		}
+
+		if t.Before(from) || !t.Before(to) {
+			continue
+		}
+
+		s := Sample{
+			Target: name,
+			Time:   t,
+			Names:  names,
+			Vals:   make([]time.Duration, len(f)),
+		}
+		for i := range f {
+			x, err := strconv.ParseInt(f[i], 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: row %d: %w", b.name, row+2, err)
+			}
+			s.Vals[i] = time.Duration(x)
+		}
+		fp(&s)
+	}
+	return sc.Err()
+}
+
+// readErrors returns the times of the failed probes in [from, to)
+func readErrors(dir string, from, to time.Time) ([]time.Time, error) {
+	var v []time.Time
+	err := scanStored(dir, batchErrors, from, to, func(b batchFile, from, to time.Time) error {
+		var err error
+		v, err = readErrorFile(b.name, from, to, v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// append the times in [from, to) of errors file 'fn' to 'v'
+func readErrorFile(fn string, from, to time.Time, v []time.Time) ([]time.Time, error) {
+	buf, err := readCsv(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	// skip the header
+	lines := strings.Split(string(buf), "\n")
+	for _, ln := range lines[1:] {
+		ts, _, ok := strings.Cut(ln, ",")
+		if !ok {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fn, err)
+		}
+		if !t.Before(from) && t.Before(to) {
+			v = append(v, t)
+		}
+	}
+	return v, nil
+}
+
+// writeDailyErrors copies the errors of the batches in 'dir' that
+// start in [from, to] to the daily errors file 'fn'; if there are any.
+func writeDailyErrors(dir string, from, to time.Time, fn string) error {
+	v, err := listBatches(dir, batchErrors)
+	if err != nil {
+		return err
+	}
+
+	var rows []string
+	for _, b := range v {
+		if b.start.Before(from) || b.start.After(to) {
+			continue
+		}
+
+		buf, err := readCsv(b.name)
+		if err != nil {
+			return err
+		}
+
+		// skip the header
+		lines := strings.Split(string(buf), "\n")
+		for _, ln := range lines[1:] {
+			if len(ln) > 0 {
+				rows = append(rows, ln)
+			}
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	err = os.WriteFile(fn, []byte("time,error\n"+strings.Join(rows, "\n")+"\n"), 0640)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", fn, err)
+	}
+	return nil
+}
+
+// scanHists calls 'fp' for each histogram in [from, to) of an
+// aggregated target; 't' is the start of its bucket. Before the first
+// batch that's left, a bucket is a day (see histCut).
+func scanHists(dir string, from, to time.Time, fp func(t time.Time, phase string, h *hdr.Histogram)) error {
+	batches, err := listBatches(dir, batchHist)
+	if err != nil {
+		return err
+	}
+	days, err := listDaily(dir, batchHist)
+	if err != nil {
+		return err
+	}
+	return scanHistFiles(batches, days, from, to, fp)
+}
+
+// scanHistFiles is scanHists over the hist 'batches' and daily files
+// 'days'; both sorted by time.
+func scanHistFiles(batches, days []batchFile, from, to time.Time, fp func(t time.Time, phase string, h *hdr.Histogram)) error {
+	cut, err := histCut(batches, days)
+	if err != nil {
+		return err
+	}
+
+	end := to
+	if cut.Before(end) {
+		end = cut
+	}
+	for _, b := range inRange(days, from, end, 24*time.Hour) {
+		if err = readHists(b, from, end, fp); err != nil {
+			return err
+		}
+	}
+
+	if cut.Before(from) {
+		cut = from
+	}
+	for _, b := range inRange(batches, cut, to, 0) {
+		if err = readHists(b, cut, to, fp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return the time the hist batches are read from; the daily files are
+// read before it. A daily file has the merged histograms of its day:
+// the day of the first batch is read from its daily file and the rest
+// of its batches are skipped. If there's no daily file after it, the
+// last one may be that day or the one before it: it's taken to be the
+// day before if the batches start a day (as long as the one before
+// it) after it and skipped otherwise.
+func histCut(batches, days []batchFile) (time.Time, error) {
+	if len(batches) == 0 {
+		return endOfTime, nil
+	}
+
+	first := batches[0].start
+	var prev, last time.Time
+	for _, b := range days {
+		// a day starts within the day it's named after
+		if b.start.Before(first.Add(-48 * time.Hour)) {
+			continue
+		}
+
+		t, err := histStart(b)
+		if err != nil {
+			return first, err
+		}
+		if !t.Before(first) {
+			return t, nil
+		}
+		prev, last = last, t
+	}
+
+	if last.IsZero() {
+		return first, nil
+	}
+
+	day := 24 * time.Hour
+	if !prev.IsZero() {
+		day = last.Sub(prev)
+	}
+	if !first.Before(last.Add(day)) {
+		return first, nil
+	}
+	return last, nil
+}
+
+// scanBuckets is scanHists with the histograms of each bucket
+// together: 'b' maps each column to its histogram.
+func scanBuckets(dir string, from, to time.Time, fp func(t time.Time, b map[string]*hdr.Histogram)) error {
+	var t0 time.Time
+	var b map[string]*hdr.Histogram
+
+	err := scanHists(dir, from, to, func(t time.Time, phase string, h *hdr.Histogram) {
+		if !t.Equal(t0) {
+			if len(b) > 0 {
+				fp(t0, b)
+			}
+			t0, b = t, make(map[string]*hdr.Histogram)
+		}
+		if x, ok := b[phase]; ok {
+			x.Merge(h)
+		} else {
+			b[phase] = h
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(b) > 0 {
+		fp(t0, b)
+	}
+	return nil
+}
+
+// return the time of the first row of hist file 'b'
+func histStart(b batchFile) (time.Time, error) {
+	var t time.Time
+	err := readHists(b, b.start, endOfTime, func(x time.Time, _ string, _ *hdr.Histogram) {
+		if t.IsZero() {
+			t = x
+		}
+	})
+	if t.IsZero() {
+		t = b.start
+	}
+	return t, err
+}
+
+// call 'fp' for the histograms in [from, to) of hist file 'b'
+func readHists(b batchFile, from, to time.Time, fp func(t time.Time, phase string, h *hdr.Histogram)) error {
+	fd, err := openCsv(b.name)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	sc.Buffer(nil, 1024*1024)
+
+	// skip the header
+	sc.Scan()
+	for row := 2; sc.Scan(); row++ {
+		t, ph, h, err := parseHist(sc.Text())
+		if err != nil {
+			return fmt.Errorf("%s: row %d: %w", b.name, row, err)
+		}
+		if !t.Before(from) && t.Before(to) {
+			fp(t, ph, h)
+		}
+	}
+	return sc.Err()
+}
+
+// parse a row of a hist file; see _HistHeader
+func parseHist(ln string) (time.Time, string, *hdr.Histogram, error) {
+	var t time.Time
+
+	f := strings.Split(ln, ",")
+	if len(f) != 8 {
+		return t, "", nil, fmt.Errorf("malformed")
+	}
+
+	t, err := time.Parse(time.RFC3339Nano, f[0])
+	if err != nil {
+		return t, "", nil, err
+	}
+
+	n, err1 := strconv.ParseUint(f[2], 10, 64)
+	lo, err2 := strconv.ParseInt(f[3], 10, 64)
+	hi, err3 := strconv.ParseInt(f[4], 10, 64)
+	sum, err4 := strconv.ParseFloat(f[5], 64)
+	sumsq, err5 := strconv.ParseFloat(f[6], 64)
+	if err := errors.Join(err1, err2, err3, err4, err5); err != nil {
+		return t, "", nil, err
+	}
+
+	h, err := hdr.Parse(f[7], n, time.Duration(lo), time.Duration(hi), sum, sumsq)
+	if err != nil {
+		return t, "", nil, err
+	}
+	return t, f[1], h, nil
+}
+
+// read all of a csv file that may be compressed
+func readCsv(fn string) ([]byte, error) {
+	fd, err := openCsv(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	b, err := io.ReadAll(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,146 @@
+// tcp.go - tcp connect pinger
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/http"
+)
+
+// max bytes of server banner we will read
+const _MaxBanner int = 1024
+
+type tping struct {
+	PingOpts
+
+	log  logger.Logger
+	addr string
+	cl   *http.Client
+	ch   chan TcpResult
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ Pinger = &tping{}
+
+func NewTcp(cx context.Context, opts PingOpts) (*tping, chan TcpResult, error) {
+	if opts.Port == 0 {
+		return nil, nil, fmt.Errorf("tcp: %s: missing port", opts.Host)
+	}
+
+	ctx, cancel := context.WithCancel(cx)
+	t := &tping{
+		PingOpts: opts,
+		log:      opts.Logger.New("tcp", 0),
+		addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
+		cl:       opts.newClient(),
+		ch:       make(chan TcpResult, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	// a banner regex implies reading the banner
+	if t.BannerMatch != nil {
+		t.Banner = true
+	}
+
+	t.log.Info("starting tcp pinger: %s, every %s, timeout %s, banner %v",
+		t.addr, t.Interval, t.Timeout, t.Banner)
+
+	t.wg.Add(1)
+	go t.run()
+
+	return t, t.ch, nil
+}
+
+func (t *tping) Stop() {
+	t.cancel()
+	t.wg.Wait()
+	close(t.ch)
+	t.log.Info("stopped tcp pinger: %s", t.addr)
+}
+
+func (t *tping) run() {
+	sch := newSchedule(t.Interval, t.Schedule)
+	defer func() {
+		sch.Stop()
+		t.wg.Done()
+	}()
+
+	var errs failures
+	sch.run(t.ctx.Done(), t.Schedule.Concurrency, func(tk Tick) {
+		t.log.Debug("ping %s ..", t.addr)
+		r, err := t.ping()
+		if err != nil {
+			errs.failed(t.log, t.addr, err)
+			t.ch <- TcpResult{Tick: tk, Err: err}
+			return
+		}
+		errs.ok(t.log, t.addr)
+		r.Tick = tk
+		t.ch <- r
+	})
+}
+
+func (t *tping) ping() (TcpResult, error) {
+	var r TcpResult
+
+	conn, err := t.cl.Dial(t.ctx, t.Host, int(t.Port))
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+
+	r.DnsRtt = conn.Dns
+	r.ConnRtt = conn.Tcp
+	if !t.Banner {
+		return r, nil
+	}
+
+	banner, rtt, err := t.readBanner(conn)
+	if err != nil {
+		return r, err
+	}
+
+	r.BannerRtt = rtt
+	r.Banner = banner
+	return r, nil
+}
+
+// read the server banner and return the time to the first byte.
+// If we have a regex to match, keep reading until we find a match
+// or run out of buffer or time.
+func (t *tping) readBanner(conn *http.Conn) (string, time.Duration, error) {
+	buf := make([]byte, _MaxBanner)
+
+	conn.SetReadDeadline(time.Now().Add(t.Timeout))
+
+	st := time.Now()
+	n, err := conn.Read(buf)
+	if n == 0 {
+		return "", 0, fmt.Errorf("tcp: %s: banner: %w", t.addr, err)
+	}
+	rtt := time.Now().Sub(st)
+
+	re := t.BannerMatch
+	if re == nil {
+		return string(buf[:n]), rtt, nil
+	}
+
+	for !re.Match(buf[:n]) {
+		if err != nil || n == len(buf) {
+			return "", 0, fmt.Errorf("tcp: %s: banner doesn't match '%s'", t.addr, re)
+		}
+
+		var m int
+		m, err = conn.Read(buf[n:])
+		n += m
+	}
+	return string(buf[:n]), rtt, nil
+}
@@ -0,0 +1,128 @@
+// tls.go - tls handshake pinger
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/http"
+)
+
+type tlsping struct {
+	PingOpts
+
+	log  logger.Logger
+	addr string
+	cl   *http.Client
+	up   http.Upgrader
+	ch   chan TlsResult
+
+	// serial# of the last cert we saw; used to log cert changes
+	sync.Mutex
+	serial string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ Pinger = &tlsping{}
+
+func NewTls(cx context.Context, opts PingOpts) (*tlsping, chan TlsResult, error) {
+	if opts.Port == 0 {
+		return nil, nil, fmt.Errorf("tls: %s: missing port", opts.Host)
+	}
+
+	up, err := starttls(opts.StartTls)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tls: %s: %w", opts.Host, err)
+	}
+
+	ctx, cancel := context.WithCancel(cx)
+	t := &tlsping{
+		PingOpts: opts,
+		log:      opts.Logger.New("tls", 0),
+		addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
+		cl:       opts.newClient(),
+		up:       up,
+		ch:       make(chan TlsResult, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	t.log.Info("starting tls pinger: %s, every %s, timeout %s, starttls '%s'",
+		t.addr, t.Interval, t.Timeout, t.StartTls)
+
+	t.wg.Add(1)
+	go t.run()
+
+	return t, t.ch, nil
+}
+
+func (t *tlsping) Stop() {
+	t.cancel()
+	t.wg.Wait()
+	close(t.ch)
+	t.log.Info("stopped tls pinger: %s", t.addr)
+}
+
+func (t *tlsping) run() {
+	sch := newSchedule(t.Interval, t.Schedule)
+	defer func() {
+		sch.Stop()
+		t.wg.Done()
+	}()
+
+	var errs failures
+	sch.run(t.ctx.Done(), t.Schedule.Concurrency, func(tk Tick) {
+		t.log.Debug("ping %s ..", t.addr)
+		r, err := t.ping()
+		if err != nil {
+			errs.failed(t.log, t.addr, err)
+			t.ch <- TlsResult{Tick: tk, Err: err}
+			return
+		}
+		errs.ok(t.log, t.addr)
+
+		t.Lock()
+		if r.Serial != t.serial {
+			t.log.Info("%s: cert %s", t.addr, r.Cert())
+			t.serial = r.Serial
+		}
+		t.Unlock()
+		r.Tick = tk
+		t.ch <- r
+	})
+}
+
+func (t *tlsping) ping() (TlsResult, error) {
+	var r TlsResult
+
+	conn, err := t.cl.DialTLS(t.ctx, t.Host, int(t.Port), t.up)
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+
+	st := conn.ConnectionState()
+	r = TlsResult{
+		DnsRtt:      conn.Tcp.Dns,
+		ConnRtt:     conn.Tcp.Tcp,
+		StartTlsRtt: conn.StartTls,
+		TlsRtt:      conn.Tls,
+		Version:     tls.VersionName(st.Version),
+		Cipher:      tls.CipherSuiteName(st.CipherSuite),
+	}
+
+	if len(st.PeerCertificates) > 0 {
+		c := st.PeerCertificates[0]
+		r.Subject = c.Subject.String()
+		r.Issuer = c.Issuer.String()
+		r.Serial = c.SerialNumber.Text(16)
+		r.NotAfter = c.NotAfter
+	}
+	return r, nil
+}
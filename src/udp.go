@@ -0,0 +1,295 @@
+// udp.go - udp echo pinger
+//
+// Every tick we send a train of sequenced, timestamped packets to an
+// echo responder (see reflect.go) and compute the rtt, RFC 3550
+// interarrival jitter, loss, reordering and duplicates of the train.
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	logger "github.com/opencoff/go-logger"
+	"github.com/opencoff/latmon/internal/http"
+)
+
+const (
+	// "LTMN"
+	_UdpMagic uint32 = 0x4c544d4e
+
+	// magic, train#, seq#, tx timestamp
+	_UdpPktSize int = 4 + 4 + 4 + 8
+
+	_DefaultUdpCount int = 10
+	_DefaultUdpRate  int = 50
+)
+
+// udp probe packet; all fields are big-endian on the wire
+type udpPkt struct {
+	train uint32
+	seq   uint32
+
+	// tx time in nanoseconds since the pinger started
+	tx int64
+}
+
+func (p *udpPkt) marshal(b []byte) []byte {
+	be := binary.BigEndian
+	b = be.AppendUint32(b, _UdpMagic)
+	b = be.AppendUint32(b, p.train)
+	b = be.AppendUint32(b, p.seq)
+	b = be.AppendUint64(b, uint64(p.tx))
+	return b
+}
+
+func (p *udpPkt) unmarshal(b []byte) error {
+	if len(b) < _UdpPktSize {
+		return errShortPkt
+	}
+
+	be := binary.BigEndian
+	if be.Uint32(b[:4]) != _UdpMagic {
+		return errBadMagic
+	}
+
+	p.train = be.Uint32(b[4:8])
+	p.seq = be.Uint32(b[8:12])
+	p.tx = int64(be.Uint64(b[12:20]))
+	return nil
+}
+
+var (
+	errShortPkt = errors.New("short packet")
+	errBadMagic = errors.New("bad magic")
+	errAllLost  = errors.New("all packets lost")
+)
+
+type uping struct {
+	PingOpts
+
+	log  logger.Logger
+	addr string
+	cl   *http.Client
+	ch   chan UdpResult
+
+	// all packet timestamps are relative to this
+	epoch time.Time
+	train uint32
+
+	// RFC 3550 interarrival jitter estimate and the last transit
+	// time it was computed from
+	jitter  float64
+	transit time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+var _ Pinger = &uping{}
+
+func NewUdp(cx context.Context, opts PingOpts) (*uping, chan UdpResult, error) {
+	if opts.Port == 0 {
+		return nil, nil, fmt.Errorf("udp: %s: missing port", opts.Host)
+	}
+
+	if opts.Count <= 0 {
+		opts.Count = _DefaultUdpCount
+	}
+	if opts.Rate <= 0 {
+		opts.Rate = _DefaultUdpRate
+	}
+
+	ctx, cancel := context.WithCancel(cx)
+	u := &uping{
+		PingOpts: opts,
+		log:      opts.Logger.New("udp", 0),
+		addr:     fmt.Sprintf("%s:%d", opts.Host, opts.Port),
+		cl:       opts.newClient(),
+		ch:       make(chan UdpResult, 1),
+		epoch:    time.Now(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+
+	u.log.Info("starting udp pinger: %s, every %s, timeout %s, %d pkts at %d pps",
+		u.addr, u.Interval, u.Timeout, u.Count, u.Rate)
+
+	u.wg.Add(1)
+	go u.run()
+
+	return u, u.ch, nil
+}
+
+func (u *uping) Stop() {
+	u.cancel()
+	u.wg.Wait()
+	close(u.ch)
+	u.log.Info("stopped udp pinger: %s", u.addr)
+}
+
+func (u *uping) run() {
+	sch := newSchedule(u.Interval, u.Schedule)
+	defer func() {
+		sch.Stop()
+		u.wg.Done()
+	}()
+
+	var errs failures
+	sch.run(u.ctx.Done(), u.Schedule.Concurrency, func(tk Tick) {
+		u.log.Debug("ping %s ..", u.addr)
+		r, err := u.ping()
+		if err != nil {
+			errs.failed(u.log, u.addr, err)
+			u.ch <- UdpResult{Tick: tk, Err: err}
+			return
+		}
+		errs.ok(u.log, u.addr)
+		if r.Lost > 0 || r.Reordered > 0 || r.Dups > 0 {
+			u.log.Debug("%s: %s", u.addr, r)
+		}
+		r.Tick = tk
+		u.ch <- r
+	})
+}
+
+// an echoed packet as seen by the receiver
+type udpRx struct {
+	seq uint32
+	rtt time.Duration
+}
+
+func (u *uping) ping() (UdpResult, error) {
+	var r UdpResult
+
+	conn, err := u.cl.DialUDP(u.ctx, u.Host, int(u.Port))
+	if err != nil {
+		return r, err
+	}
+	defer conn.Close()
+
+	u.train++
+	r.DnsRtt = conn.Dns
+	r.Sent = u.Count
+
+	space := time.Second / time.Duration(u.Rate)
+	last := time.Now().Add(time.Duration(u.Count-1) * space)
+	conn.SetReadDeadline(last.Add(u.Timeout))
+
+	// the receiver runs concurrently with the sender
+	rxch := make(chan []udpRx, 1)
+	go u.recv(conn, rxch)
+
+	p := udpPkt{
+		train: u.train,
+	}
+
+	buf := make([]byte, 0, _UdpPktSize)
+	for i := 0; i < u.Count; i++ {
+		if i > 0 {
+			time.Sleep(space)
+		}
+
+		p.seq = uint32(i)
+		p.tx = int64(time.Since(u.epoch))
+		if _, err := conn.Write(p.marshal(buf[:0])); err != nil {
+			conn.Close()
+			<-rxch
+			return r, fmt.Errorf("udp: %s: write: %w", u.addr, err)
+		}
+	}
+
+	rx := <-rxch
+	u.tally(&r, rx)
+	return r, nil
+}
+
+// read echoes till we have all of them or the read deadline expires
+func (u *uping) recv(conn *http.Conn, rxch chan []udpRx) {
+	var p udpPkt
+
+	rx := make([]udpRx, 0, u.Count)
+	seen := make([]bool, u.Count)
+	nuniq := 0
+
+	buf := make([]byte, 1500)
+	for len(rx) < 2*u.Count {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				u.log.Debug("%s: read: %s", u.addr, err)
+			}
+			break
+		}
+
+		now := time.Since(u.epoch)
+		if err = p.unmarshal(buf[:n]); err != nil {
+			u.log.Debug("%s: rx: %s", u.addr, err)
+			continue
+		}
+
+		// ignore stragglers from an earlier train
+		if p.train != u.train || p.seq >= uint32(u.Count) {
+			continue
+		}
+
+		rx = append(rx, udpRx{p.seq, now - time.Duration(p.tx)})
+		if !seen[p.seq] {
+			seen[p.seq] = true
+			nuniq++
+		}
+
+		// we're done once every seq# is in
+		if nuniq == u.Count {
+			break
+		}
+	}
+	rxch <- rx
+}
+
+// compute the stats for this train from the received echoes
+// (in the order of arrival).
+func (u *uping) tally(r *UdpResult, rx []udpRx) {
+	seen := make([]bool, u.Count)
+
+	var tot time.Duration
+	var maxseq uint32
+	for i := range rx {
+		x := &rx[i]
+		if seen[x.seq] {
+			r.Dups++
+			continue
+		}
+		seen[x.seq] = true
+
+		if r.Recv > 0 && x.seq < maxseq {
+			r.Reordered++
+		}
+		maxseq = max(maxseq, x.seq)
+
+		// RFC 3550, 6.4.1: J += (|D(i-1, i)| - J)/16
+		// Both the send and receive times are from our clock; so the
+		// transit time is the rtt.
+		if u.transit > 0 {
+			d := math.Abs(float64(x.rtt - u.transit))
+			u.jitter += (d - u.jitter) / 16
+		}
+		u.transit = x.rtt
+
+		tot += x.rtt
+		r.Recv++
+	}
+
+	r.Lost = r.Sent - r.Recv
+	r.Jitter = time.Duration(u.jitter)
+	if r.Recv > 0 {
+		r.Rtt = tot / time.Duration(r.Recv)
+	}
+}
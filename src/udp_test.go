@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// start a udp responder on loopback that calls 'echo' for each probe
+// packet; return its port
+func startResponder(t *testing.T, echo func(conn *net.UDPConn)) int {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		echo(conn)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		conn.Close()
+		<-done
+	})
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// run a train against the responder on 'port' and return its result
+func udpTrain(t *testing.T, port int) UdpResult {
+	o := testPingOpts(t, "udp", port)
+	o.Count = 10
+	o.Rate = 500
+	o.Timeout = 200 * time.Millisecond
+
+	u, ch, err := NewUdp(context.Background(), o)
+	if err != nil {
+		t.Fatalf("udp: %s", err)
+	}
+	r := recvResult(t, ch)
+	discard(u, ch)
+
+	if r.Err != nil {
+		t.Fatalf("udp: %s", r.Err)
+	}
+	return r
+}
+
+func TestUdpReflect(t *testing.T) {
+	log := testLogger(t)
+	port := startResponder(t, func(conn *net.UDPConn) {
+		reflect(conn, log)
+	})
+
+	r := udpTrain(t, port)
+	if r.Sent != 10 || r.Recv != 10 || r.Lost != 0 || r.Reordered != 0 || r.Dups != 0 {
+		t.Fatalf("clean train: %s", r)
+	}
+	if r.Rtt <= 0 {
+		t.Fatalf("clean train: no rtt: %s", r)
+	}
+}
+
+// a responder that drops seq 3, echoes seq 5 twice and holds seq 1
+// back till seq 2 is echoed
+func TestUdpLossy(t *testing.T) {
+	port := startResponder(t, func(conn *net.UDPConn) {
+		var p udpPkt
+		var held []byte
+
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if p.unmarshal(buf[:n]) != nil {
+				continue
+			}
+
+			b := buf[:n]
+			switch p.seq {
+			case 1:
+				held = append([]byte(nil), b...)
+			case 2:
+				conn.WriteToUDP(b, from)
+				conn.WriteToUDP(held, from)
+			case 3:
+			case 5:
+				conn.WriteToUDP(b, from)
+				conn.WriteToUDP(b, from)
+			default:
+				conn.WriteToUDP(b, from)
+			}
+		}
+	})
+
+	r := udpTrain(t, port)
+	if r.Sent != 10 || r.Recv != 9 || r.Lost != 1 || r.Reordered != 1 || r.Dups != 1 {
+		t.Fatalf("lossy train: %s", r)
+	}
+}
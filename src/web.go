@@ -0,0 +1,360 @@
+// web.go - built-in dashboard
+//
+// The dashboard lists the targets and serves a live chart of the
+// recent samples of each target; the chart is updated via
+// server-sent events. The batch and daily charts already written to
+// disk are linked from the index.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencoff/latmon/internal/plot"
+)
+
+// interval between keepalives on an idle event stream
+const _SseKeepAlive = 15 * time.Second
+
+type webServer struct {
+	d    *daemon
+	feed *liveFeed
+	srv  *http.Server
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// start the dashboard on 'addr'
+func newWebServer(d *daemon, feed *liveFeed, addr string) (*webServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("http: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webServer{
+		d:      d,
+		feed:   feed,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", w.index)
+	mux.HandleFunc("GET /live/{name}", w.live)
+	mux.HandleFunc("GET /events/{name}", w.events)
+	mux.HandleFunc("GET /charts/{name}/{$}", w.history)
+	mux.HandleFunc("GET /charts/{name}/{file}", w.chart)
+
+	mux.HandleFunc("GET /api/v1/targets", w.apiTargets)
+	mux.HandleFunc("GET /api/v1/targets/{name}/samples", w.apiSamples)
+	mux.HandleFunc("GET /api/v1/targets/{name}/summary", w.apiSummary)
+	mux.HandleFunc("GET /api/v1/targets/{name}/slo", w.apiSLOs)
+	mux.HandleFunc("GET /metrics", w.metrics)
+
+	w.srv = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+
+		// the event streams end when we shut down
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	d.log.Info("http: dashboard on http://%s/", ln.Addr())
+
+	w.wg.Add(1)
+	go func() {
+		err := w.srv.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			d.log.Warn("http: %s", err)
+		}
+		w.wg.Done()
+	}()
+	return w, nil
+}
+
+func (w *webServer) Stop() {
+	w.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	w.srv.Shutdown(ctx)
+	w.wg.Wait()
+}
+
+func (w *webServer) index(rw http.ResponseWriter, r *http.Request) {
+	ti, err := w.d.list("")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = indexTmpl.Execute(rw, struct {
+		Window  time.Duration
+		Targets []TargetInfo
+	}{w.feed.window, ti})
+	if err != nil {
+		w.d.log.Debug("http: index: %s", err)
+	}
+}
+
+// render the live chart for a target
+func (w *webServer) live(rw http.ResponseWriter, r *http.Request) {
+	nm := r.PathValue("name")
+	if _, err := w.d.list(nm); err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	v := w.feed.samples(nm)
+	if len(v) == 0 {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		emptyTmpl.Execute(rw, nm)
+		return
+	}
+
+	o := liveColumns(nm, v)
+	o.Baseline = w.baseline(nm, &o)
+	o.SLOs, _ = w.d.m.SLOs(nm)
+	ev := fmt.Sprintf("/events/%s", url.PathEscape(nm))
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := plot.Live(&o, rw, ev, w.feed.window); err != nil {
+		w.d.log.Debug("http: live %s: %s", nm, err)
+	}
+}
+
+// return the comparison of the live samples in 'o' with the baseline
+// of target 'nm'; nil if it has none (or is aggregated: it has no
+// stored samples)
+func (w *webServer) baseline(nm string, o *plot.Columns) *plot.Baseline {
+	opt, ok := w.d.lookup(nm)
+	if !ok || opt.Baseline.IsZero() || opt.Aggregate > 0 {
+		return nil
+	}
+
+	dir, ii, err := w.d.locate(nm)
+	if err != nil {
+		return nil
+	}
+
+	from, to := o.Times[0], o.Times[o.Minlen-1].Add(1)
+	base, err := readBaseline(dir, nm, from, to, opt.Baseline, ii)
+	if err != nil || base == nil {
+		return nil
+	}
+	return plot.NewBaseline(baselineLabel(from, opt.Baseline), o, base)
+}
+
+// stream new samples of a target as server-sent events
+func (w *webServer) events(rw http.ResponseWriter, r *http.Request) {
+	nm := r.PathValue("name")
+	if _, err := w.d.list(nm); err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	fl, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := w.feed.subscribe(nm)
+	defer w.feed.unsubscribe(sub)
+
+	h := rw.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	fl.Flush()
+
+	tick := time.NewTicker(_SseKeepAlive)
+	defer tick.Stop()
+
+	done := r.Context().Done()
+	for {
+		select {
+		case s := <-sub.ch:
+			b, err := json.Marshal(plot.NewPoint(s.Time, s.Names, s.Vals))
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(rw, "data: %s\n\n", b); err != nil {
+				return
+			}
+
+		case <-tick.C:
+			if _, err := fmt.Fprintf(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+
+		case <-done:
+			return
+		}
+		fl.Flush()
+	}
+}
+
+// list the batch and daily charts of a target; newest first
+func (w *webServer) history(rw http.ResponseWriter, r *http.Request) {
+	nm := r.PathValue("name")
+	ti, err := w.d.list(nm)
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	files, err := filepath.Glob(filepath.Join(ti[0].ChartDir, "*.html"))
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range files {
+		files[i] = filepath.Base(files[i])
+	}
+	slices.Sort(files)
+	slices.Reverse(files)
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	historyTmpl.Execute(rw, struct {
+		Name  string
+		Files []string
+	}{nm, files})
+}
+
+// serve a chart from the chart dir of a target
+func (w *webServer) chart(rw http.ResponseWriter, r *http.Request) {
+	nm := r.PathValue("name")
+	ti, err := w.d.list(nm)
+	if err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+
+	fn := r.PathValue("file")
+	if fn != filepath.Base(fn) || !strings.HasSuffix(fn, ".html") {
+		http.NotFound(rw, r)
+		return
+	}
+
+	fn = filepath.Join(ti[0].ChartDir, fn)
+	if _, err := os.Stat(fn); err != nil {
+		http.NotFound(rw, r)
+		return
+	}
+	http.ServeFile(rw, r, fn)
+}
+
+// make the columns for a chart from the samples in 'v'. A column
+// missing from a sample is charted as zero.
+func liveColumns(nm string, v []Sample) plot.Columns {
+	o := plot.Columns{
+		Name:   nm,
+		Start:  v[0].Time,
+		Minlen: len(v),
+		Times:  make([]time.Time, len(v)),
+	}
+
+	idx := make(map[string]int)
+	for i := range v {
+		s := &v[i]
+		o.Times[i] = s.Time
+		for j, c := range s.Names {
+			k, ok := idx[c]
+			if !ok {
+				k = len(o.Names)
+				idx[c] = k
+				o.Names = append(o.Names, c)
+				o.Colref = append(o.Colref, make([]time.Duration, len(v)))
+			}
+			o.Colref[k][i] = s.Vals[j]
+		}
+	}
+	return o
+}
+
+var indexTmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>latmon</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 4px 12px; text-align: left; border-bottom: 1px solid #ddd; }
+</style>
+</head>
+<body>
+<h2>latmon targets</h2>
+<table>
+<tr><th>Name</th><th>Target</th><th>Every</th><th>State</th><th>Batch</th><th>Charts</th></tr>
+{{- range .Targets}}
+<tr>
+<td>{{.Name}}</td>
+<td>{{.Proto}}:{{.Host}}:{{.Port}}</td>
+<td>{{.Interval}}</td>
+<td>{{if .Paused}}paused{{else}}running{{end}}</td>
+<td>{{.Samples}}/{{.Batchsize}}</td>
+<td><a href="/live/{{.Name}}">live</a> &middot; <a href="/charts/{{.Name}}/">history</a></td>
+</tr>
+{{- end}}
+</table>
+<p>Live charts show the last {{.Window}}.</p>
+</body>
+</html>
+`))
+
+var historyTmpl = template.Must(template.New("history").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} charts</title>
+<style>body { font-family: sans-serif; }</style>
+</head>
+<body>
+<h2>{{.Name}}</h2>
+<p><a href="/">targets</a> &middot; <a href="/live/{{.Name}}">live</a></p>
+<ul>
+{{- range .Files}}
+<li><a href="{{.}}">{{.}}</a></li>
+{{- else}}
+<li>no charts yet</li>
+{{- end}}
+</ul>
+</body>
+</html>
+`))
+
+var emptyTmpl = template.Must(template.New("empty").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>{{.}} (live)</title>
+<style>body { font-family: sans-serif; }</style>
+</head>
+<body>
+<p>No recent samples for {{.}}; this page will refresh shortly.</p>
+<p><a href="/">targets</a></p>
+</body>
+</html>
+`))